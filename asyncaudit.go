@@ -0,0 +1,92 @@
+package skoap
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// writes the audit log entries from a background goroutine
+type asyncAudit struct {
+	mu      sync.RWMutex
+	closed  bool
+	entries chan *auditDoc
+	done    chan struct{}
+	drop    bool
+	dropped uint64
+	log     *auditLog
+}
+
+func newAsyncAudit(al *auditLog, size int, drop bool) *asyncAudit {
+	a := &asyncAudit{
+		entries: make(chan *auditDoc, size),
+		done:    make(chan struct{}),
+		drop:    drop,
+		log:     al}
+	go a.run()
+	return a
+}
+
+func (a *asyncAudit) run() {
+	for doc := range a.entries {
+		if err := a.log.encode(doc); err != nil {
+			log.Println(err)
+		}
+	}
+
+	close(a.done)
+}
+
+// after closing, the entries are written synchronously
+func (a *asyncAudit) enqueue(doc *auditDoc) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.closed {
+		if err := a.log.encode(doc); err != nil {
+			log.Println(err)
+		}
+
+		return
+	}
+
+	if !a.drop {
+		a.entries <- doc
+		return
+	}
+
+	select {
+	case a.entries <- doc:
+	default:
+		atomic.AddUint64(&a.dropped, 1)
+	}
+}
+
+// close writes the queued entries, and waits until they are written
+func (a *asyncAudit) close() {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+
+	a.closed = true
+	close(a.entries)
+	a.mu.Unlock()
+
+	<-a.done
+	if n := atomic.LoadUint64(&a.dropped); n > 0 {
+		log.Printf("%s: dropped %d entries", AuditLogName, n)
+	}
+}
+
+// Close writes the entries queued with AuditLogOptions.AsyncBuffer,
+// and waits until they are written. The entries of the requests
+// finishing after Close are written synchronously.
+func (al *auditLog) Close() error {
+	if al.async != nil {
+		al.async.close()
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package skoap
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blocks the writes until released
+type gatedWriter struct {
+	release chan struct{}
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	writes  int
+}
+
+func newGatedWriter() *gatedWriter {
+	return &gatedWriter{release: make(chan struct{})}
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	<-w.release
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes++
+	return w.buf.Write(p)
+}
+
+func (w *gatedWriter) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writes
+}
+
+func sendAuditEntries(t *testing.T, al *auditLog, n int) {
+	f, err := al.CreateFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < n; i++ {
+			req, err := http.NewRequest("GET", "https://www.example.org/foo", nil)
+			if err != nil {
+				t.Error(err)
+				break
+			}
+
+			ctx := newTestContext(req, &http.Response{StatusCode: http.StatusOK})
+			f.Request(ctx)
+			f.Response(ctx)
+		}
+
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("the requests were blocked by the audit log writer")
+	}
+}
+
+func TestAsyncAuditLog(t *testing.T) {
+	w := newGatedWriter()
+	s := NewAuditLogWithOptions(AuditLogOptions{Writer: w, AsyncBuffer: 8})
+
+	// the writer is blocked, but the requests are not
+	sendAuditEntries(t, s.(*auditLog), 5)
+	if n := w.count(); n != 0 {
+		t.Error("unexpected synchronous writes", n)
+	}
+
+	close(w.release)
+	if err := s.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := w.count(); n != 5 {
+		t.Error("failed to flush the entries on close", n)
+	}
+
+	// written synchronously after close
+	sendAuditEntries(t, s.(*auditLog), 1)
+	if n := w.count(); n != 6 {
+		t.Error("failed to write after close", n)
+	}
+
+	if err := s.(io.Closer).Close(); err != nil {
+		t.Error("failed to close twice", err)
+	}
+}
+
+func TestAsyncAuditLogDrop(t *testing.T) {
+	w := newGatedWriter()
+	s := NewAuditLogWithOptions(AuditLogOptions{Writer: w, AsyncBuffer: 1, DropWhenFull: true})
+	al := s.(*auditLog)
+
+	sendAuditEntries(t, al, 5)
+
+	close(w.release)
+	al.Close()
+
+	written, dropped := w.count(), int(atomic.LoadUint64(&al.async.dropped))
+	if dropped == 0 || written+dropped != 5 {
+		t.Error("invalid number of dropped entries", written, dropped)
+	}
+}
+
+func TestSyncAuditLogClose(t *testing.T) {
+	var b bytes.Buffer
+	s := NewAuditLogWithOptions(AuditLogOptions{Writer: &b})
+	sendAuditEntries(t, s.(*auditLog), 1)
+	if b.Len() == 0 {
+		t.Error("failed to write synchronously")
+	}
+
+	if err := s.(io.Closer).Close(); err != nil {
+		t.Error(err)
+	}
+}
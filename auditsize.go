@@ -0,0 +1,62 @@
+package skoap
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+const auditRequestBytesKey = "audit-request-bytes"
+
+// counts the bytes read through a body, and calls done once, when the
+// body is closed
+type countingBody struct {
+	body io.ReadCloser
+	n    int64
+	once sync.Once
+	done func(n int64)
+}
+
+func (cb *countingBody) Read(b []byte) (int, error) {
+	n, err := cb.body.Read(b)
+	atomic.AddInt64(&cb.n, int64(n))
+	return n, err
+}
+
+func (cb *countingBody) Close() error {
+	err := cb.body.Close()
+	if cb.done != nil {
+		cb.once.Do(func() { cb.done(cb.count()) })
+	}
+
+	return err
+}
+
+func (cb *countingBody) count() int64 {
+	return atomic.LoadInt64(&cb.n)
+}
+
+func requestBytes(sb map[string]interface{}) *int64 {
+	var n int64
+	if cb, ok := sb[auditRequestBytesKey].(*countingBody); ok {
+		n = cb.count()
+	}
+
+	return &n
+}
+
+// the entry is written when the proxy has finished copying the response
+// body to the client, and closed it
+func (al *auditLog) writeWithSizes(sb map[string]interface{}, rsp *http.Response, doc *auditDoc) {
+	if rsp.Body == nil {
+		doc.RequestBytes, doc.ResponseBytes = requestBytes(sb), new(int64)
+		al.writeOrLog(doc)
+		return
+	}
+
+	rsp.Body = &countingBody{body: rsp.Body, done: func(n int64) {
+		doc.RequestBytes, doc.ResponseBytes = requestBytes(sb), &n
+		al.writeOrLog(doc)
+	}}
+}
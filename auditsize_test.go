@@ -0,0 +1,112 @@
+package skoap
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zalando/skipper/eskip"
+	"github.com/zalando/skipper/filters"
+	"github.com/zalando/skipper/proxy/proxytest"
+)
+
+func TestAuditSizes(t *testing.T) {
+	const (
+		requestSize  = 12345
+		responseSize = 54321
+	)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			t.Error(err)
+		}
+
+		w.Write(bytes.Repeat([]byte("b"), responseSize))
+	}))
+	defer backend.Close()
+
+	for _, ti := range []struct {
+		msg     string
+		args    []interface{}
+		body    string
+		request int64
+	}{{
+		msg:     "without body logging",
+		body:    strings.Repeat("a", requestSize),
+		request: requestSize,
+	}, {
+		msg:     "body logged, limited",
+		args:    []interface{}{float64(100)},
+		body:    strings.Repeat("a", requestSize),
+		request: requestSize,
+	}, {
+		msg:  "no request body",
+		args: []interface{}{float64(100)},
+	}} {
+		var logged bytes.Buffer
+		s := NewAuditLogWithOptions(AuditLogOptions{Writer: &logged, RecordSizes: true})
+		fr := make(filters.Registry)
+		fr.Register(s)
+		r := &eskip.Route{Filters: []*eskip.Filter{{Name: s.Name(), Args: ti.args}}, Backend: backend.URL}
+		proxy := proxytest.New(fr, r)
+
+		rsp, err := http.Post(proxy.URL, "text/plain", strings.NewReader(ti.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if err != nil || len(b) != responseSize {
+			t.Error(ti.msg, "failed to receive the response", err, len(b))
+		}
+
+		// waits for the request to be finished
+		proxy.Close()
+
+		var doc auditDoc
+		if err := json.Unmarshal(logged.Bytes(), &doc); err != nil {
+			t.Error(ti.msg, err, logged.String())
+			continue
+		}
+
+		if doc.RequestBytes == nil || *doc.RequestBytes != ti.request {
+			t.Error(ti.msg, "invalid request bytes", logged.String())
+		}
+
+		if doc.ResponseBytes == nil || *doc.ResponseBytes != responseSize {
+			t.Error(ti.msg, "invalid response bytes", logged.String())
+		}
+	}
+}
+
+func TestAuditSizesServed(t *testing.T) {
+	var logged bytes.Buffer
+	al, err := NewAuditLogWithOptions(AuditLogOptions{Writer: &logged, RecordSizes: true}).CreateFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "https://www.example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := newTestContext(req, nil)
+	al.Request(ctx)
+	ctx.FResponse = &http.Response{StatusCode: http.StatusUnauthorized}
+	al.Response(ctx)
+
+	var doc auditDoc
+	if err := json.Unmarshal(logged.Bytes(), &doc); err != nil {
+		t.Fatal(err, logged.String())
+	}
+
+	if doc.RequestBytes == nil || *doc.RequestBytes != 0 || doc.ResponseBytes == nil || *doc.ResponseBytes != 0 {
+		t.Error("invalid sizes", logged.String())
+	}
+}
@@ -0,0 +1,201 @@
+package skoap
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zalando/skipper/filters"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BasicAuthCheckName is the name of the basicAuthCheck filter.
+const BasicAuthCheckName = "basicAuthCheck"
+
+const (
+	missingBasicAuth   rejectReason = "missing-basic-auth"
+	invalidCredentials rejectReason = "invalid-credentials"
+)
+
+// MaxBasicAuthFailureTTL is the maximum of
+// BasicAuthCheckOptions.FailureCacheTTL.
+const MaxBasicAuthFailureTTL = time.Second
+
+// BasicAuthCheckOptions contains the settings of the basicAuthCheck
+// filter specification created with NewBasicAuthCheckWithOptions.
+type BasicAuthCheckOptions struct {
+
+	// CacheTTL, when set, is the time for which the successful
+	// verifications of the credentials are cached, so that the
+	// repeated requests of a client don't run bcrypt every time. The
+	// entries are keyed by a keyed hash of the user name, the password
+	// and the bcrypt hash, and the cache doesn't hold the passwords.
+	CacheTTL time.Duration
+
+	// FailureCacheTTL, when set, is the time for which the failed
+	// verifications are cached. It is capped at
+	// MaxBasicAuthFailureTTL, so that a corrected password is accepted
+	// shortly. Used only with CacheTTL.
+	FailureCacheTTL time.Duration
+
+	// Now, when set, is used as the clock of the cache, e.g. in tests.
+	Now func() time.Time
+}
+
+type (
+	basicAuthCheckSpec struct {
+		options BasicAuthCheckOptions
+		cache   *cache
+
+		// the key of the cache key hashes, generated on startup
+		cacheKey []byte
+
+		// bcrypt.CompareHashAndPassword, replaced in tests
+		compare func(hash, pwd []byte) error
+	}
+
+	basicAuthCheck struct {
+		spec *basicAuthCheckSpec
+
+		// bcrypt hashes by user name
+		hashes map[string][]byte
+	}
+)
+
+// NewBasicAuthCheck creates a filter specification that checks the
+// basic authorization credentials of the incoming requests. Its
+// arguments are the accepted credentials, as user name and bcrypt hash
+// pairs, separated by a colon, so that the route configuration doesn't
+// contain the passwords in clear text:
+//
+//     basicAuthCheck("jdoe:$2a$10$...", "jane:$2a$10$...")
+//
+// Filters with malformed hashes fail to be created. The requests
+// without credentials are rejected with the missing-basic-auth reason,
+// the requests with unknown users or wrong passwords with the
+// invalid-credentials reason.
+func NewBasicAuthCheck() filters.Spec {
+	return NewBasicAuthCheckWithOptions(BasicAuthCheckOptions{})
+}
+
+// NewBasicAuthCheckWithOptions creates a basicAuthCheck filter
+// specification with the settings in the options. See
+// BasicAuthCheckOptions and NewBasicAuthCheck. The cache is shared by
+// the filters created from the specification.
+func NewBasicAuthCheckWithOptions(o BasicAuthCheckOptions) filters.Spec {
+	s := &basicAuthCheckSpec{options: o, compare: bcrypt.CompareHashAndPassword}
+	if o.CacheTTL <= 0 {
+		return s
+	}
+
+	if s.options.FailureCacheTTL > MaxBasicAuthFailureTTL {
+		s.options.FailureCacheTTL = MaxBasicAuthFailureTTL
+	}
+
+	s.cacheKey = make([]byte, sha256.Size)
+	if _, err := rand.Read(s.cacheKey); err != nil {
+		log.Printf("%s: caching disabled: %v", BasicAuthCheckName, err)
+		return s
+	}
+
+	s.cache = newCache(o.CacheTTL, o.Now)
+	return s
+}
+
+func (s *basicAuthCheckSpec) Name() string { return BasicAuthCheckName }
+
+func (s *basicAuthCheckSpec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	pairs, err := getStrings(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pairs) == 0 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	f := &basicAuthCheck{spec: s, hashes: make(map[string][]byte)}
+	for _, p := range pairs {
+		i := strings.Index(p, ":")
+		if i <= 0 || i == len(p)-1 {
+			return nil, filters.ErrInvalidFilterParameters
+		}
+
+		user, hash := p[:i], []byte(p[i+1:])
+		if _, err := bcrypt.Cost(hash); err != nil {
+			log.Printf("%s: invalid hash for %s: %v", BasicAuthCheckName, user, err)
+			return nil, filters.ErrInvalidFilterParameters
+		}
+
+		f.hashes[user] = hash
+	}
+
+	return f, nil
+}
+
+func (f *basicAuthCheck) Request(ctx filters.FilterContext) {
+	user, pwd, ok := ctx.Request().BasicAuth()
+	if !ok {
+		f.unauthorized(ctx, "", missingBasicAuth)
+		return
+	}
+
+	hash, ok := f.hashes[user]
+	if !ok || !f.spec.verify(user, pwd, hash) {
+		f.unauthorized(ctx, user, invalidCredentials)
+		return
+	}
+
+	authorized(ctx, user)
+}
+
+// the cache keys are HMACs of the credentials with a random key, so
+// that the lookups don't depend on the secret values, and the keys can't
+// be used to guess the passwords
+func (s *basicAuthCheckSpec) credentialKey(user, pwd string, hash []byte) string {
+	m := hmac.New(sha256.New, s.cacheKey)
+	m.Write([]byte(user))
+	m.Write([]byte{0})
+	m.Write([]byte(pwd))
+	m.Write([]byte{0})
+	m.Write(hash)
+	return string(m.Sum(nil))
+}
+
+func (s *basicAuthCheckSpec) verify(user, pwd string, hash []byte) bool {
+	if s.cache == nil {
+		return s.compare(hash, []byte(pwd)) == nil
+	}
+
+	key := s.credentialKey(user, pwd, hash)
+	if valid, ok := s.cache.get(key); ok {
+		return valid.(bool)
+	}
+
+	valid := s.compare(hash, []byte(pwd)) == nil
+	if valid {
+		s.cache.set(key, true)
+	} else if s.options.FailureCacheTTL > 0 {
+		// the wrong passwords are not looked up again, so their expired
+		// entries are removed here, to keep guessing from growing the
+		// cache
+		s.cache.reap()
+		s.cache.setTTL(key, false, s.options.FailureCacheTTL)
+	}
+
+	return valid
+}
+
+func (f *basicAuthCheck) unauthorized(ctx filters.FilterContext, user string, reason rejectReason) {
+	ctx.StateBag()[authUserKey] = user
+	ctx.StateBag()[authRejectReasonKey] = string(reason)
+	ctx.Serve(&http.Response{
+		StatusCode: http.StatusUnauthorized,
+		Header:     http.Header{"Www-Authenticate": []string{`Basic realm="skoap"`}}})
+}
+
+func (f *basicAuthCheck) Response(_ filters.FilterContext) {}
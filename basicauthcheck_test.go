@@ -0,0 +1,249 @@
+package skoap
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBasicAuthCheckArgs(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ti := range []struct {
+		msg  string
+		args []interface{}
+		fail bool
+	}{{
+		msg:  "no args",
+		fail: true,
+	}, {
+		msg:  "not a string",
+		args: []interface{}{42},
+		fail: true,
+	}, {
+		msg:  "missing separator",
+		args: []interface{}{"jdoe"},
+		fail: true,
+	}, {
+		msg:  "missing user",
+		args: []interface{}{":" + string(hash)},
+		fail: true,
+	}, {
+		msg:  "missing hash",
+		args: []interface{}{"jdoe:"},
+		fail: true,
+	}, {
+		msg:  "malformed hash",
+		args: []interface{}{"jdoe:secret"},
+		fail: true,
+	}, {
+		msg:  "valid",
+		args: []interface{}{"jdoe:" + string(hash), "jane:" + string(hash)},
+	}} {
+		_, err := NewBasicAuthCheck().CreateFilter(ti.args)
+		if ti.fail && err == nil {
+			t.Error(ti.msg, "failed to fail")
+		} else if !ti.fail && err != nil {
+			t.Error(ti.msg, err)
+		}
+	}
+}
+
+func TestBasicAuthCheck(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := NewBasicAuthCheck().CreateFilter([]interface{}{"jdoe:" + string(hash)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ti := range []struct {
+		msg    string
+		noAuth bool
+		user   string
+		pwd    string
+		reason rejectReason
+	}{{
+		msg:  "valid",
+		user: "jdoe",
+		pwd:  "secret",
+	}, {
+		msg:    "wrong password",
+		user:   "jdoe",
+		pwd:    "wrong",
+		reason: invalidCredentials,
+	}, {
+		msg:    "unknown user",
+		user:   "jane",
+		pwd:    "secret",
+		reason: invalidCredentials,
+	}, {
+		msg:    "no credentials",
+		noAuth: true,
+		reason: missingBasicAuth,
+	}} {
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !ti.noAuth {
+			req.SetBasicAuth(ti.user, ti.pwd)
+		}
+
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+
+		if ti.reason == "" {
+			if ctx.FServedWithResponse || ctx.StateBag()[authUserKey] != ti.user {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+
+			continue
+		}
+
+		if !ctx.FServedWithResponse ||
+			ctx.FResponse.StatusCode != http.StatusUnauthorized ||
+			ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+
+		if ctx.FResponse.Header.Get("WWW-Authenticate") == "" {
+			t.Error(ti.msg, "missing challenge")
+		}
+	}
+}
+
+func TestBasicAuthCheckCache(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ti := range []struct {
+		msg        string
+		options    BasicAuthCheckOptions
+		requests   []string
+		advance    time.Duration
+		valid      []bool
+		comparison int
+	}{{
+		msg:        "no cache",
+		requests:   []string{"secret", "secret", "secret"},
+		valid:      []bool{true, true, true},
+		comparison: 3,
+	}, {
+		msg:        "cached",
+		options:    BasicAuthCheckOptions{CacheTTL: time.Minute},
+		requests:   []string{"secret", "secret", "secret"},
+		valid:      []bool{true, true, true},
+		comparison: 1,
+	}, {
+		msg:        "expired",
+		options:    BasicAuthCheckOptions{CacheTTL: time.Minute},
+		requests:   []string{"secret", "secret", "secret"},
+		advance:    time.Minute,
+		valid:      []bool{true, true, true},
+		comparison: 3,
+	}, {
+		msg:        "per credential",
+		options:    BasicAuthCheckOptions{CacheTTL: time.Minute},
+		requests:   []string{"secret", "wrong", "secret", "wrong"},
+		valid:      []bool{true, false, true, false},
+		comparison: 3,
+	}, {
+		msg:        "failure cached",
+		options:    BasicAuthCheckOptions{CacheTTL: time.Minute, FailureCacheTTL: 100 * time.Millisecond},
+		requests:   []string{"wrong", "wrong", "secret"},
+		valid:      []bool{false, false, true},
+		comparison: 2,
+	}, {
+		msg:        "failure TTL capped",
+		options:    BasicAuthCheckOptions{CacheTTL: time.Hour, FailureCacheTTL: time.Hour},
+		requests:   []string{"wrong", "wrong"},
+		advance:    MaxBasicAuthFailureTTL,
+		valid:      []bool{false, false},
+		comparison: 2,
+	}} {
+		clock := newTestClock()
+		ti.options.Now = clock.Now
+		s := NewBasicAuthCheckWithOptions(ti.options)
+
+		var comparison int
+		compare := s.(*basicAuthCheckSpec).compare
+		s.(*basicAuthCheckSpec).compare = func(hash, pwd []byte) error {
+			comparison++
+			return compare(hash, pwd)
+		}
+
+		f, err := s.CreateFilter([]interface{}{"jdoe:" + string(hash)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, pwd := range ti.requests {
+			req, err := http.NewRequest("GET", "https://www.example.org", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.SetBasicAuth("jdoe", pwd)
+			ctx := newTestContext(req, nil)
+			f.Request(ctx)
+			if ctx.FServedWithResponse == ti.valid[i] {
+				t.Error(ti.msg, "invalid result", i)
+			}
+
+			clock.advance(ti.advance)
+		}
+
+		if comparison != ti.comparison {
+			t.Error(ti.msg, "invalid number of bcrypt comparisons", comparison)
+		}
+	}
+}
+
+func BenchmarkBasicAuthCheck(b *testing.B) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.DefaultCost)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bi := range []struct {
+		name    string
+		options BasicAuthCheckOptions
+	}{
+		{"uncached", BasicAuthCheckOptions{}},
+		{"cached", BasicAuthCheckOptions{CacheTTL: time.Minute}},
+	} {
+		b.Run(bi.name, func(b *testing.B) {
+			f, err := NewBasicAuthCheckWithOptions(bi.options).CreateFilter([]interface{}{"jdoe:" + string(hash)})
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			req, err := http.NewRequest("GET", "https://www.example.org", nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			req.SetBasicAuth("jdoe", "secret")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ctx := newTestContext(req, nil)
+				f.Request(ctx)
+				if ctx.FServedWithResponse {
+					b.Fatal("failed to authorize")
+				}
+			}
+		})
+	}
+}
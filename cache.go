@@ -0,0 +1,190 @@
+package skoap
+
+import (
+	"sync"
+	"time"
+)
+
+// CacheStats contains the counters of a cache used by the filters.
+type CacheStats struct {
+
+	// Entries is the number of entries currently stored, including
+	// the expired ones not evicted yet.
+	Entries int
+
+	// Hits is the number of lookups that found a valid entry.
+	Hits uint64
+
+	// Misses is the number of lookups that didn't find a valid entry.
+	Misses uint64
+
+	// Evictions is the number of expired entries removed.
+	Evictions uint64
+}
+
+// Stats contains the statistics of the caches used by the filters
+// created from a filter specification.
+type Stats struct {
+	Auth     CacheStats
+	Teams    CacheStats
+	UserInfo CacheStats
+}
+
+type cacheItem struct {
+	value   interface{}
+	created time.Time
+	expires time.Time
+}
+
+// cache is a simple, thread safe TTL cache. Expired entries are evicted
+// when accessed.
+type cache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	maxAge    time.Duration
+	now       func() time.Time
+	items     map[string]*cacheItem
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// creates a cache using the now function as the clock, or time.Now,
+// when nil
+func newCache(ttl time.Duration, now func() time.Time) *cache {
+	if now == nil {
+		now = time.Now
+	}
+
+	return &cache{ttl: ttl, now: now, items: make(map[string]*cacheItem)}
+}
+
+func (c *cache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i, ok := c.items[key]
+	if ok && c.expired(i) {
+		delete(c.items, key)
+		c.evictions++
+		ok = false
+	}
+
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	c.hits++
+	return i.value, true
+}
+
+// an entry is expired after its TTL, or when older than the maximum
+// age, if set
+func (c *cache) expired(i *cacheItem) bool {
+	now := c.now()
+	return !now.Before(i.expires) || c.maxAge > 0 && now.Sub(i.created) >= c.maxAge
+}
+
+func (c *cache) set(key string, value interface{}) {
+	c.setTTL(key, value, c.ttl)
+}
+
+// stores an entry with a custom TTL
+func (c *cache) setTTL(key string, value interface{}, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.items[key] = &cacheItem{value: value, created: now, expires: now.Add(ttl)}
+}
+
+// returns an entry even if it is expired, without counting a hit or a
+// miss
+func (c *cache) peek(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	return i.value, true
+}
+
+func (c *cache) del(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.items, key)
+}
+
+func (c *cache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Entries:   len(c.items),
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions}
+}
+
+// evicts the expired entries, and returns their number
+func (c *cache) reap() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var n int
+	for key, i := range c.items {
+		if c.expired(i) {
+			delete(c.items, key)
+			n++
+		}
+	}
+
+	c.evictions += uint64(n)
+	return n
+}
+
+// reaper evicts the expired entries of the caches periodically, from a
+// background goroutine
+type reaper struct {
+	once sync.Once
+	quit chan struct{}
+	done chan struct{}
+}
+
+func startReaper(interval time.Duration, caches ...*cache) *reaper {
+	r := &reaper{quit: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(r.done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				for _, c := range caches {
+					if c != nil {
+						c.reap()
+					}
+				}
+			case <-r.quit:
+				return
+			}
+		}
+	}()
+
+	return r
+}
+
+// stops the reaper, and waits until its goroutine exits
+func (r *reaper) stop() {
+	if r == nil {
+		return
+	}
+
+	r.once.Do(func() { close(r.quit) })
+	<-r.done
+}
@@ -0,0 +1,137 @@
+package skoap
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	c := newCache(30*time.Millisecond, nil)
+	if _, ok := c.get("foo"); ok {
+		t.Error("unexpected entry")
+	}
+
+	c.set("foo", "bar")
+	if v, ok := c.get("foo"); !ok || v.(string) != "bar" {
+		t.Error("failed to get entry")
+	}
+
+	c.set("baz", "qux")
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := c.get("foo"); ok {
+		t.Error("failed to expire entry")
+	}
+
+	st := c.stats()
+	if st.Entries != 1 || st.Hits != 1 || st.Misses != 2 || st.Evictions != 1 {
+		t.Error("invalid stats", st)
+	}
+}
+
+func TestCacheCustomTTL(t *testing.T) {
+	c := newCache(time.Minute, nil)
+	c.setTTL("foo", "bar", 30*time.Millisecond)
+	c.set("baz", "qux")
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := c.get("foo"); ok {
+		t.Error("failed to expire entry")
+	}
+
+	if _, ok := c.get("baz"); !ok {
+		t.Error("failed to get entry")
+	}
+}
+
+func TestCachePeek(t *testing.T) {
+	c := newCache(30*time.Millisecond, nil)
+	c.set("foo", "bar")
+	time.Sleep(60 * time.Millisecond)
+	if v, ok := c.peek("foo"); !ok || v.(string) != "bar" {
+		t.Error("failed to peek expired entry")
+	}
+
+	c.del("foo")
+	if _, ok := c.peek("foo"); ok {
+		t.Error("failed to delete entry")
+	}
+
+	if st := c.stats(); st.Hits != 0 || st.Misses != 0 {
+		t.Error("unexpected stats", st)
+	}
+}
+
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestCacheClock(t *testing.T) {
+	clock := newTestClock()
+	c := newCache(time.Minute, clock.Now)
+	c.set("foo", "bar")
+
+	clock.advance(time.Minute - time.Second)
+	if _, ok := c.get("foo"); !ok {
+		t.Error("failed to get entry")
+	}
+
+	clock.advance(time.Second)
+	if _, ok := c.get("foo"); ok {
+		t.Error("failed to expire entry")
+	}
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	clock := newTestClock()
+	c := newCache(time.Hour, clock.Now)
+	c.maxAge = time.Minute
+	c.setTTL("foo", "bar", 2*time.Hour)
+	c.set("baz", "qux")
+
+	clock.advance(time.Minute - time.Second)
+	if _, ok := c.get("foo"); !ok {
+		t.Error("failed to get entry")
+	}
+
+	clock.advance(time.Second)
+	if _, ok := c.get("foo"); ok {
+		t.Error("failed to expire entry with custom TTL")
+	}
+
+	if _, ok := c.get("baz"); ok {
+		t.Error("failed to expire entry")
+	}
+}
+
+func TestCacheReap(t *testing.T) {
+	clock := newTestClock()
+	c := newCache(time.Minute, clock.Now)
+	c.set("foo", "bar")
+	c.setTTL("baz", "qux", time.Hour)
+
+	clock.advance(time.Minute)
+	if n := c.reap(); n != 1 {
+		t.Error("invalid number of evictions", n)
+	}
+
+	if st := c.stats(); st.Entries != 1 || st.Evictions != 1 || st.Misses != 0 {
+		t.Error("invalid stats", st)
+	}
+}
@@ -0,0 +1,99 @@
+package skoap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	cefVersion       = 0
+	cefDeviceVendor  = "skoap"
+	cefDeviceProduct = "skoap"
+	cefDeviceVersion = "1"
+
+	cefRequestSignature = "request"
+	cefRequestName      = "Request"
+	cefRejectName       = "Request rejected"
+
+	cefRequestSeverity = 3
+	cefRejectSeverity  = 6
+)
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+func cefExtension(b *bytes.Buffer, key, value string) {
+	if value == "" {
+		return
+	}
+
+	if b.Len() > 0 {
+		b.WriteByte(' ')
+	}
+
+	b.WriteString(key)
+	b.WriteByte('=')
+	b.WriteString(cefExtensionEscaper.Replace(value))
+}
+
+// writes a single audit entry in the format of:
+//
+//     CEF:Version|Device Vendor|Device Product|Device Version|Signature ID|Name|Severity|Extension
+//
+// When the request was rejected by an auth filter, the reject reason
+// is used as the signature id.
+func writeCEF(w io.Writer, doc *auditDoc) error {
+	signature, name, severity := cefRequestSignature, cefRequestName, cefRequestSeverity
+
+	var ext bytes.Buffer
+	cefExtension(&ext, "requestMethod", doc.Method)
+	cefExtension(&ext, "request", doc.Path)
+	if doc.Status != 0 {
+		cefExtension(&ext, "cn1", fmt.Sprint(doc.Status))
+		cefExtension(&ext, "cn1Label", "status")
+	}
+
+	cefExtension(&ext, "src", doc.ClientIP)
+	if doc.RequestBytes != nil {
+		cefExtension(&ext, "in", fmt.Sprint(*doc.RequestBytes))
+	}
+
+	if doc.ResponseBytes != nil {
+		cefExtension(&ext, "out", fmt.Sprint(*doc.ResponseBytes))
+	}
+
+	if doc.Phase != "" {
+		cefExtension(&ext, "cs1", doc.Phase)
+		cefExtension(&ext, "cs1Label", "phase")
+	}
+
+	if doc.AuthStatus != nil {
+		cefExtension(&ext, "suser", doc.AuthStatus.User)
+		if doc.AuthStatus.Rejected {
+			signature, name, severity = doc.AuthStatus.Reason, cefRejectName, cefRejectSeverity
+			cefExtension(&ext, "outcome", "rejected")
+			cefExtension(&ext, "reason", doc.AuthStatus.Reason)
+		}
+	}
+
+	if s, ok := cefSeverities[doc.Severity]; ok {
+		severity = s
+	}
+
+	_, err := fmt.Fprintf(
+		w,
+		"CEF:%d|%s|%s|%s|%s|%s|%d|%s\n",
+		cefVersion,
+		cefHeaderEscaper.Replace(cefDeviceVendor),
+		cefHeaderEscaper.Replace(cefDeviceProduct),
+		cefHeaderEscaper.Replace(cefDeviceVersion),
+		cefHeaderEscaper.Replace(signature),
+		cefHeaderEscaper.Replace(name),
+		severity,
+		ext.String())
+	return err
+}
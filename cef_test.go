@@ -0,0 +1,101 @@
+package skoap
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCEF(t *testing.T) {
+	for _, ti := range []struct {
+		msg    string
+		doc    *auditDoc
+		header string
+		ext    string
+	}{{
+		msg:    "request",
+		doc:    &auditDoc{Method: "GET", Path: "/foo", Status: 200, ClientIP: "10.0.0.1"},
+		header: "CEF:0|skoap|skoap|1|request|Request|3",
+		ext:    "requestMethod=GET request=/foo cn1=200 cn1Label=status src=10.0.0.1",
+	}, {
+		msg: "authenticated",
+		doc: &auditDoc{
+			Method:     "POST",
+			Path:       "/foo",
+			Status:     201,
+			ClientIP:   "10.0.0.1",
+			AuthStatus: &authStatusDoc{User: testUid}},
+		header: "CEF:0|skoap|skoap|1|request|Request|3",
+		ext:    "requestMethod=POST request=/foo cn1=201 cn1Label=status src=10.0.0.1 suser=jdoe",
+	}, {
+		msg: "rejected",
+		doc: &auditDoc{
+			Method:     "GET",
+			Path:       "/foo",
+			Status:     401,
+			ClientIP:   "10.0.0.1",
+			AuthStatus: &authStatusDoc{User: testUid, Rejected: true, Reason: string(invalidScope)}},
+		header: "CEF:0|skoap|skoap|1|invalid-scope|Request rejected|6",
+		ext:    "requestMethod=GET request=/foo cn1=401 cn1Label=status src=10.0.0.1 suser=jdoe outcome=rejected reason=invalid-scope",
+	}, {
+		msg:    "start phase",
+		doc:    &auditDoc{Phase: "start", Method: "GET", Path: "/foo", ClientIP: "10.0.0.1"},
+		header: "CEF:0|skoap|skoap|1|request|Request|3",
+		ext:    "requestMethod=GET request=/foo src=10.0.0.1 cs1=start cs1Label=phase",
+	}, {
+		msg:    "end phase",
+		doc:    &auditDoc{Phase: "end", Method: "GET", Path: "/foo", Status: 200, ClientIP: "10.0.0.1"},
+		header: "CEF:0|skoap|skoap|1|request|Request|3",
+		ext:    "requestMethod=GET request=/foo cn1=200 cn1Label=status src=10.0.0.1 cs1=end cs1Label=phase",
+	}, {
+		msg:    "escaping",
+		doc:    &auditDoc{Method: "GET", Path: "/foo=bar\\baz\nqux", Status: 200},
+		header: "CEF:0|skoap|skoap|1|request|Request|3",
+		ext:    `requestMethod=GET request=/foo\=bar\\baz\nqux cn1=200 cn1Label=status`,
+	}} {
+		var b bytes.Buffer
+		if err := writeCEF(&b, ti.doc); err != nil {
+			t.Error(ti.msg, err)
+			continue
+		}
+
+		line := b.String()
+		if !strings.HasSuffix(line, "\n") || strings.Count(line, "\n") != 1 {
+			t.Error(ti.msg, "invalid line", line)
+			continue
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line != ti.header+"|"+ti.ext {
+			t.Error(ti.msg, "invalid entry", line, ti.header+"|"+ti.ext)
+		}
+	}
+}
+
+func TestAuditLogCEF(t *testing.T) {
+	var b bytes.Buffer
+	s := NewAuditLogWithOptions(AuditLogOptions{Writer: &b, Format: AuditCEF})
+	f, err := s.CreateFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "https://www.example.org/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.RemoteAddr = "10.0.0.1:42000"
+	ctx := newTestContext(req, &http.Response{StatusCode: http.StatusUnauthorized})
+	ctx.StateBag()[authRejectReasonKey] = string(missingBearerToken)
+
+	f.Request(ctx)
+	f.Response(ctx)
+
+	expected := "CEF:0|skoap|skoap|1|missing-bearer-token|Request rejected|6|" +
+		"requestMethod=GET request=/foo cn1=401 cn1Label=status src=10.0.0.1 outcome=rejected reason=missing-bearer-token\n"
+	if b.String() != expected {
+		t.Error("invalid entry", b.String(), expected)
+	}
+}
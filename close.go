@@ -0,0 +1,36 @@
+package skoap
+
+import (
+	"io"
+
+	"github.com/zalando/skipper/filters"
+)
+
+// CloseAll closes the filter specifications that implement io.Closer,
+// e.g. the auth and the auditLog specifications, to stop their
+// background goroutines and to flush their pending work, e.g. the
+// queued audit log entries. It is meant to be called on shutdown, with
+// the same specifications that were passed to skipper as custom
+// filters, after the proxy stopped accepting requests:
+//
+//     specs := []filters.Spec{skoap.NewAuth(authUrl), skoap.NewAuditLogWithOptions(o)}
+//     ...
+//     skoap.CloseAll(specs...)
+//
+// All the specifications are closed, even when some of them fail, and
+// the first error is returned.
+func CloseAll(specs ...filters.Spec) error {
+	var first error
+	for _, s := range specs {
+		c, ok := s.(io.Closer)
+		if !ok {
+			continue
+		}
+
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
@@ -0,0 +1,72 @@
+package skoap
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/zalando/skipper/filters"
+)
+
+type testCloser struct {
+	filters.Spec
+	closed bool
+	err    error
+}
+
+func (c *testCloser) Close() error {
+	c.closed = true
+	return c.err
+}
+
+func TestCloseAll(t *testing.T) {
+	first, second := &testCloser{err: errors.New("first")}, &testCloser{err: errors.New("second")}
+	ok := &testCloser{}
+	if err := CloseAll(NewBasicAuth(), first, ok, second); err != first.err {
+		t.Error("failed to return the first error", err)
+	}
+
+	if !first.closed || !ok.closed || !second.closed {
+		t.Error("failed to close all the specifications")
+	}
+
+	if err := CloseAll(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCloseStopsGoroutines(t *testing.T) {
+	auth := NewAuthWithOptions(Options{
+		AuthUrlBase:       "https://auth.example.org",
+		AuthCacheTTL:      time.Minute,
+		CacheReapInterval: time.Millisecond})
+	team := NewAuthTeamWithOptions(Options{
+		AuthUrlBase:       "https://auth.example.org",
+		CacheReapInterval: time.Millisecond})
+	audit := NewAuditLogWithOptions(AuditLogOptions{Writer: ioutil.Discard, AsyncBuffer: 16})
+
+	specs := []filters.Spec{auth, team, audit}
+	if err := CloseAll(specs...); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []*spec{auth.(*spec), team.(*spec)} {
+		select {
+		case <-s.reaper.done:
+		default:
+			t.Error("failed to stop the cache reaper of", s.Name())
+		}
+	}
+
+	select {
+	case <-audit.(*auditLog).async.done:
+	default:
+		t.Error("failed to stop the audit log writer")
+	}
+
+	// closing again doesn't block or fail
+	if err := CloseAll(specs...); err != nil {
+		t.Error(err)
+	}
+}
@@ -4,6 +4,13 @@ This command provides an executable http Skipper proxy with the skoap filters.
 For the list of command line options, run:
 
 	skoap -help
+
+On SIGTERM or interrupt, the command waits for the -shutdown-delay, to let
+the in-flight requests finish, then closes the filter specifications,
+flushing e.g. the queued audit log entries, and exits. The entries of the
+requests finishing after the flush are written synchronously. The
+embedded skipper proxy doesn't provide a shutdown hook, so it keeps
+accepting requests during the delay.
 */
 package main
 
@@ -12,7 +19,10 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/zalando-incubator/skoap"
@@ -43,6 +53,10 @@ const (
 	authUrlBaseFlag    = "auth-url"
 	defaultAuthUrlBase = "http://[::1]:9081"
 
+	introspectionFlag = "introspection"
+	clientIdEnv       = "SKOAP_CLIENT_ID"
+	clientSecretEnv   = "SKOAP_CLIENT_SECRET"
+
 	teamUrlBaseFlag    = "team-url"
 	defaultTeamUrlBase = "http://[::1]:9082/?uid="
 
@@ -52,6 +66,9 @@ const (
 	verboseFlag = "v"
 
 	experimentalUpgradeFlag = "experimental-upgrade"
+
+	shutdownDelayFlag    = "shutdown-delay"
+	defaultShutdownDelay = 5 * time.Second
 )
 
 const (
@@ -66,7 +83,7 @@ The command supports two modes:
 - single route mode: when a target address is specified, only a single route is used and the authorization
   parameters (realm and scopes or teams) are specified as command line flags.
 - routes configuration: supports any number of routes with custom predicate and filter settings. The
-  authorization parameters are set in the routes file with the auth and authTeam filters.
+  authorization parameters are set in the routes file with the auth, authTeam and authRole filters.
 
 When used with eskip configuration files, it is possible to apply detailed augmentation of the requests and
 responses using Skipper rules.
@@ -108,6 +125,9 @@ https://godoc.org/github.com/zalando/skipper/eskip`
 in the incoming requests will be validated agains this service. It will be passed as the Authorization Bearer
 header`
 
+	introspectionUsage = `validate the tokens with an RFC 7662 token introspection endpoint at the auth-url. The
+client credentials of skoap are taken from the SKOAP_CLIENT_ID and SKOAP_CLIENT_SECRET environment variables`
+
 	teamUrlBaseUsage = `URL base of the team service. The user id received from the authentication service will
 be appended to this url, and the list of teams that the user is a member of will be requested`
 
@@ -118,6 +138,9 @@ be appended to this url, and the list of teams that the user is a member of will
 	verboseUsage = `log level: Debug`
 
 	experimentalUpgradeUsage = "enable experimental feature to handle upgrade protocol requests"
+
+	shutdownDelayUsage = `on SIGTERM or interrupt, wait this long for the in-flight requests before flushing the
+audit log and exiting`
 )
 
 type singleRouteClient eskip.Route
@@ -138,11 +161,13 @@ var (
 	routesFile          string
 	insecure            bool
 	authUrlBase         string
+	introspection       bool
 	teamUrlBase         string
 	certPathTLS         string
 	keyPathTLS          string
 	verbose             bool
 	experimentalUpgrade bool
+	shutdownDelay       time.Duration
 )
 
 func (src *singleRouteClient) LoadAll() ([]*eskip.Route, error) {
@@ -175,11 +200,13 @@ func init() {
 	fs.StringVar(&routesFile, routesFileFlag, "", routesFileUsage)
 	fs.BoolVar(&insecure, insecureFlag, false, insecureUsage)
 	fs.StringVar(&authUrlBase, authUrlBaseFlag, "", authUrlBaseUsage)
+	fs.BoolVar(&introspection, introspectionFlag, false, introspectionUsage)
 	fs.StringVar(&teamUrlBase, teamUrlBaseFlag, "", teamUrlBaseUsage)
 	fs.StringVar(&certPathTLS, tlsCertFlag, "", certPathTLSUsage)
 	fs.StringVar(&keyPathTLS, tlsKeyFlag, "", keyPathTLSUsage)
 	fs.BoolVar(&verbose, verboseFlag, false, verboseUsage)
 	fs.BoolVar(&experimentalUpgrade, experimentalUpgradeFlag, false, experimentalUpgradeUsage)
+	fs.DurationVar(&shutdownDelay, shutdownDelayFlag, defaultShutdownDelay, shutdownDelayUsage)
 
 	err := fs.Parse(os.Args[1:])
 	if err != nil {
@@ -244,13 +271,22 @@ func main() {
 		teamUrlBase = defaultTeamUrlBase
 	}
 
+	ao := skoap.Options{AuthUrlBase: authUrlBase, TeamUrlBase: teamUrlBase}
+	if introspection {
+		ao.Introspection = true
+		ao.ClientId = os.Getenv(clientIdEnv)
+		ao.ClientSecret = os.Getenv(clientSecretEnv)
+	}
+
 	o := skipper.Options{
 		Address:    address,
 		EtcdPrefix: etcdPrefix,
 		CustomFilters: []filters.Spec{
-			skoap.NewAuth(authUrlBase),
-			skoap.NewAuthTeam(authUrlBase, teamUrlBase),
+			skoap.NewAuthWithOptions(ao),
+			skoap.NewAuthTeamWithOptions(ao),
+			skoap.NewAuthRoleWithOptions(ao),
 			skoap.NewBasicAuth(),
+			skoap.NewBasicAuthCheck(),
 			skoap.NewAuditLog(os.Stderr)},
 		AccessLogDisabled:   true,
 		ProxyOptions:        proxy.OptionsPreserveOriginal,
@@ -318,7 +354,27 @@ func main() {
 				Backend: targetAddress}}
 	}
 
-	err := skipper.Run(o)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+
+	done := make(chan error, 1)
+	go func() { done <- skipper.Run(o) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-sigs:
+		// skipper doesn't provide a shutdown hook, the in-flight
+		// requests get the shutdown delay to finish
+		time.Sleep(shutdownDelay)
+	}
+
+	// the filter specifications are closed to flush their pending
+	// work, e.g. the queued audit log entries
+	if cerr := skoap.CloseAll(o.CustomFilters...); cerr != nil {
+		log.Println(cerr)
+	}
+
 	if err != nil {
 		log.Fatal(err)
 	}
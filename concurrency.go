@@ -0,0 +1,136 @@
+package skoap
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/zalando/skipper/filters"
+)
+
+// ConcurrencyLimitName is the name of the concurrencyLimit filter.
+const ConcurrencyLimitName = "concurrencyLimit"
+
+const (
+	tooManyConcurrent rejectReason = "too-many-concurrent"
+
+	concurrencyAcquiredKey = "concurrency-limit-acquired"
+)
+
+type (
+	concurrencySpec struct {
+		mu       sync.Mutex
+		inFlight map[string]int
+	}
+
+	concurrencyLimit struct {
+		spec  *concurrencySpec
+		limit int
+	}
+
+	// an acquired in-flight slot of a user, released once
+	concurrencySlot struct {
+		spec     *concurrencySpec
+		uid      string
+		once     sync.Once
+		released chan struct{}
+	}
+)
+
+// NewConcurrencyLimit creates a concurrencyLimit filter specification.
+// The filter needs to be placed after an auth filter in the route, and
+// it limits the number of the in-flight requests of the authenticated
+// user. The requests above the limit are rejected with 429 and the
+// too-many-concurrent reason. Requests without an authenticated user
+// are rejected with 401. The in-flight requests are counted per user
+// across all the routes using the filter, while each route checks its
+// own limit. The slots are released when the response filters run, or
+// when the incoming request finished without them, e.g. because the
+// backend couldn't be reached.
+//
+//     * -> auth() -> concurrencyLimit(3) -> "https://www.example.org"
+//
+func NewConcurrencyLimit() filters.Spec {
+	return &concurrencySpec{inFlight: make(map[string]int)}
+}
+
+func (s *concurrencySpec) Name() string { return ConcurrencyLimitName }
+
+func (s *concurrencySpec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	if len(args) != 1 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	limit, ok := args[0].(float64)
+	if !ok || limit < 1 || limit != float64(int(limit)) {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	return &concurrencyLimit{spec: s, limit: int(limit)}, nil
+}
+
+func (s *concurrencySpec) acquire(uid string, limit int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inFlight[uid] >= limit {
+		return false
+	}
+
+	s.inFlight[uid]++
+	return true
+}
+
+func (s *concurrencySpec) release(uid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inFlight[uid]--
+	if s.inFlight[uid] <= 0 {
+		delete(s.inFlight, uid)
+	}
+}
+
+func (sl *concurrencySlot) release() {
+	sl.once.Do(func() {
+		sl.spec.release(sl.uid)
+		close(sl.released)
+	})
+}
+
+// the proxy doesn't run the response filters when the backend call
+// fails, but the context of the incoming request is always canceled
+// when it is finished
+func (sl *concurrencySlot) releaseWhenDone(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		sl.release()
+	case <-sl.released:
+	}
+}
+
+func (c *concurrencyLimit) Request(ctx filters.FilterContext) {
+	uid, _ := ctx.StateBag()[authUserKey].(string)
+	if uid == "" {
+		ctx.StateBag()[authRejectReasonKey] = string(missingUser)
+		ctx.Serve(&http.Response{StatusCode: http.StatusUnauthorized})
+		return
+	}
+
+	if !c.spec.acquire(uid, c.limit) {
+		ctx.StateBag()[authRejectReasonKey] = string(tooManyConcurrent)
+		ctx.Serve(&http.Response{StatusCode: http.StatusTooManyRequests})
+		return
+	}
+
+	sl := &concurrencySlot{spec: c.spec, uid: uid, released: make(chan struct{})}
+	ctx.StateBag()[concurrencyAcquiredKey] = sl
+	go sl.releaseWhenDone(ctx.Request().Context())
+}
+
+func (c *concurrencyLimit) Response(ctx filters.FilterContext) {
+	if sl, ok := ctx.StateBag()[concurrencyAcquiredKey].(*concurrencySlot); ok {
+		delete(ctx.StateBag(), concurrencyAcquiredKey)
+		sl.release()
+	}
+}
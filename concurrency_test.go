@@ -0,0 +1,139 @@
+package skoap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zalando/skipper/eskip"
+	"github.com/zalando/skipper/filters"
+	"github.com/zalando/skipper/proxy/proxytest"
+)
+
+func TestConcurrencyLimitArgs(t *testing.T) {
+	for _, args := range [][]interface{}{
+		nil,
+		{"3"},
+		{float64(0)},
+		{1.5},
+		{float64(1), float64(2)},
+	} {
+		if _, err := NewConcurrencyLimit().CreateFilter(args); err == nil {
+			t.Error("failed to fail on invalid args", args)
+		}
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	const limit = 2
+
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			arrived <- struct{}{}
+			<-release
+		}
+	}))
+	defer backend.Close()
+
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}})
+	defer authServer.Close()
+
+	fr := make(filters.Registry)
+	fr.Register(NewAuth(authServer.URL))
+	fr.Register(NewConcurrencyLimit())
+	r := &eskip.Route{Filters: []*eskip.Filter{
+		{Name: AuthName},
+		{Name: ConcurrencyLimitName, Args: []interface{}{float64(limit)}}}, Backend: backend.URL}
+	proxy := proxytest.New(fr, r)
+	defer proxy.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < limit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rsp := testRequest(t, proxy.URL+"/block", testToken); rsp.StatusCode != http.StatusOK {
+				t.Error("failed to allow request within the limit", rsp.StatusCode)
+			}
+		}()
+	}
+
+	for i := 0; i < limit; i++ {
+		<-arrived
+	}
+
+	var rejected sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		rejected.Add(1)
+		go func() {
+			defer rejected.Done()
+			if rsp := testRequest(t, proxy.URL+"/block", testToken); rsp.StatusCode != http.StatusTooManyRequests {
+				t.Error("failed to reject request above the limit", rsp.StatusCode)
+			}
+		}()
+	}
+
+	rejected.Wait()
+	close(release)
+	wg.Wait()
+
+	if rsp := testRequest(t, proxy.URL, testToken); rsp.StatusCode != http.StatusOK {
+		t.Error("failed to release the in-flight requests", rsp.StatusCode)
+	}
+
+	if rsp := testRequest(t, proxy.URL, ""); rsp.StatusCode != http.StatusUnauthorized {
+		t.Error("failed to reject unauthenticated request", rsp.StatusCode)
+	}
+}
+
+func TestConcurrencyLimitBackendFailure(t *testing.T) {
+	const limit = 2
+
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}})
+	defer authServer.Close()
+
+	spec := NewConcurrencyLimit()
+	fr := make(filters.Registry)
+	fr.Register(NewAuth(authServer.URL))
+	fr.Register(spec)
+	r := &eskip.Route{Filters: []*eskip.Filter{
+		{Name: AuthName},
+		{Name: ConcurrencyLimitName, Args: []interface{}{float64(limit)}}}, Backend: unreachable.URL}
+	proxy := proxytest.New(fr, r)
+	defer proxy.Close()
+
+	inFlight := func() int {
+		s := spec.(*concurrencySpec)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.inFlight)
+	}
+
+	// the slots are released asynchronously, after the request finished
+	released := func() bool {
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			if inFlight() == 0 {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for i := 0; i < 2*limit; i++ {
+		if rsp := testRequest(t, proxy.URL, testToken); rsp.StatusCode == http.StatusTooManyRequests {
+			t.Fatal("failed to release the slot of a failed request", i)
+		}
+
+		if !released() {
+			t.Fatal("failed to release the slot of a failed request", i)
+		}
+	}
+}
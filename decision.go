@@ -0,0 +1,60 @@
+package skoap
+
+import "github.com/zalando/skipper/filters"
+
+// Decision is an authorization decision of an auth filter.
+type Decision struct {
+
+	// Allowed tells whether the request was let through.
+	Allowed bool
+
+	// Reason is the reject reason, e.g. invalid-scope. It is set for
+	// the allowed requests, too, when they were let through because
+	// of their user agent. See Options.GraceUserAgents.
+	Reason string
+
+	// GraceAllowed is set when the request would have been rejected,
+	// but was let through because of its user agent.
+	GraceAllowed bool
+
+	// User is the user id of the token, when known.
+	User string
+
+	// TrustedNetwork is set when the request was allowed based on its
+	// source network, without a token.
+	TrustedNetwork bool
+
+	// MatchedScopes are the scopes of the filter that the token was
+	// authorized with.
+	MatchedScopes []string
+
+	// MatchedTeams are the teams of the filter that the user was
+	// authorized with.
+	MatchedTeams []string
+
+	// Method and Path are the method and the path of the request.
+	Method string
+	Path   string
+}
+
+// DecisionLogger receives the authorization decisions of the auth
+// filters, independent of the auditLog filter, e.g. to record them in
+// a dedicated sink. See Options.DecisionLogger.
+type DecisionLogger interface {
+	LogDecision(Decision)
+}
+
+func (f *filter) logDecision(ctx filters.FilterContext, d Decision) {
+	if f.options.DecisionLogger == nil {
+		return
+	}
+
+	sb := ctx.StateBag()
+	d.TrustedNetwork, _ = sb[authTrustedKey].(bool)
+	d.MatchedScopes, _ = sb[authMatchedScopesKey].([]string)
+	d.MatchedTeams, _ = sb[authMatchedTeamsKey].([]string)
+
+	r := ctx.Request()
+	d.Method, d.Path = r.Method, r.URL.Path
+	f.options.DecisionLogger.LogDecision(d)
+}
@@ -0,0 +1,95 @@
+package skoap
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+type decisionRecorder struct {
+	mu        sync.Mutex
+	decisions []Decision
+}
+
+func (r *decisionRecorder) LogDecision(d Decision) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.decisions = append(r.decisions, d)
+}
+
+func TestDecisionLogger(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}, Scopes: []string{"read"}})
+	defer authServer.Close()
+
+	for _, ti := range []struct {
+		msg       string
+		args      []interface{}
+		token     string
+		userAgent string
+		expected  Decision
+	}{{
+		msg:   "allowed",
+		args:  []interface{}{testRealm, "read", "write"},
+		token: testToken,
+		expected: Decision{
+			Allowed:       true,
+			User:          testUid,
+			MatchedScopes: []string{"read"}},
+	}, {
+		msg:      "rejected without token",
+		expected: Decision{Reason: string(missingBearerToken)},
+	}, {
+		msg:   "rejected scope",
+		args:  []interface{}{testRealm, "write"},
+		token: testToken,
+		expected: Decision{
+			Reason: string(invalidScope),
+			User:   testUid},
+	}, {
+		msg:       "grace allowed",
+		args:      []interface{}{testRealm, "write"},
+		token:     testToken,
+		userAgent: "legacy-client/1.0",
+		expected: Decision{
+			Allowed:      true,
+			GraceAllowed: true,
+			Reason:       string(invalidScope),
+			User:         testUid},
+	}} {
+		var r decisionRecorder
+		f, err := NewAuthWithOptions(Options{
+			AuthUrlBase:     authServer.URL,
+			GraceUserAgents: []*regexp.Regexp{regexp.MustCompile("^legacy-client/")},
+			DecisionLogger:  &r}).CreateFilter(ti.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org/orders", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ti.token != "" {
+			req.Header.Set(authHeaderName, "Bearer "+ti.token)
+		}
+
+		req.Header.Set("User-Agent", ti.userAgent)
+
+		// no auditLog filter in the chain
+		f.Request(newTestContext(req, nil))
+
+		if len(r.decisions) != 1 {
+			t.Error(ti.msg, "invalid number of decisions", len(r.decisions))
+			continue
+		}
+
+		d := r.decisions[0]
+		ti.expected.Method, ti.expected.Path = "GET", "/orders"
+		if !reflect.DeepEqual(d, ti.expected) {
+			t.Errorf("%s: invalid decision: %+v, expected: %+v", ti.msg, d, ti.expected)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package skoap
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Describer is implemented by the auth and the auditLog filters. The
+// description summarizes the effective configuration of the filter,
+// e.g. to be shown on an admin endpoint, to verify the deployed
+// routes. It doesn't contain secrets: the credentials and the query
+// values of the service urls are redacted, and the secret options are
+// only reported as set.
+type Describer interface {
+	Describe() string
+}
+
+// removes the user info and the query values from the url
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "<invalid>"
+	}
+
+	if u.User != nil {
+		u.User = url.User("redacted")
+	}
+
+	if u.RawQuery != "" {
+		q := u.Query()
+		for k, v := range q {
+			for i := range v {
+				if v[i] != "" {
+					v[i] = "redacted"
+				}
+			}
+
+			q[k] = v
+		}
+
+		u.RawQuery = q.Encode()
+	}
+
+	return u.String()
+}
+
+type description struct {
+	bytes.Buffer
+}
+
+func (d *description) add(key string, value interface{}) {
+	if d.Len() > 0 {
+		d.WriteByte(' ')
+	}
+
+	fmt.Fprintf(d, "%s=%v", key, value)
+}
+
+func (f *filter) checkName() string {
+	switch f.typ {
+	case checkTeam:
+		return "teams"
+	case checkRole:
+		return "roles"
+	case checkPolicy:
+		return "policy"
+	default:
+		return "scopes"
+	}
+}
+
+// Describe returns the effective configuration of the filter, e.g.:
+//
+// 	check=teams realms=[/employees] teams=2 validateOnly=false
+// 	authUrl=https://auth.example.org/tokeninfo timeout=0s ...
+//
+func (f *filter) Describe() string {
+	var d description
+	o := f.options
+
+	d.add("check", f.checkName())
+	d.add("realms", "["+strings.Join(f.realms, " ")+"]")
+	if f.typ != checkPolicy {
+		d.add(f.checkName(), len(f.args))
+	}
+
+	d.add("validateOnly", f.validateOnly)
+	d.add("authUrl", redactURL(f.authClient.urlBase))
+	if f.teamClient != nil {
+		d.add("teamUrl", redactURL(f.teamClient.urlBase))
+	}
+
+	if f.policyClient != nil {
+		d.add("policyUrl", redactURL(f.policyClient.url))
+	}
+
+	d.add("timeout", f.authClient.client.Timeout)
+	d.add("authCacheTTL", o.AuthCacheTTL)
+	if f.teamClient != nil {
+		d.add("teamCacheTTL", f.teamClient.cache.ttl)
+	}
+
+	if f.policyClient != nil {
+		d.add("policyCacheTTL", o.PolicyCacheTTL)
+	}
+
+	d.add("slowCallThreshold", o.SlowCallThreshold)
+	d.add("pathScopes", len(o.PathScopes))
+	d.add("defaultScopes", len(o.DefaultScopes))
+	d.add("deniedScopes", len(o.DeniedScopes))
+	d.add("blockedRealms", len(o.BlockedRealms))
+	d.add("trustedCIDRs", len(f.trustedNets))
+	d.add("strictDecoding", o.StrictDecoding)
+	d.add("forwardTeams", o.ForwardTeams)
+	d.add("forwardIdentity", o.ForwardIdentity)
+	d.add("identitySecret", len(o.IdentitySecret) > 0)
+	return d.String()
+}
+
+func auditFormatName(f AuditFormat) string {
+	switch f {
+	case AuditCEF:
+		return "cef"
+	case AuditLogfmt:
+		return "logfmt"
+	default:
+		return "json"
+	}
+}
+
+// Describe returns the effective configuration of the filter, e.g.:
+//
+// 	format=json maxBodyLog=1024 rejectedOnly=false debugSecret=true
+//
+func (al *auditLog) Describe() string {
+	var d description
+	d.add("format", auditFormatName(al.options.Format))
+	d.add("maxBodyLog", al.maxBodyLog)
+	d.add("rejectedOnly", al.options.RejectedOnly)
+	d.add("debugSecret", al.options.DebugSecret != "")
+	if al.options.DefaultSeverity != severityNone {
+		d.add("defaultSeverity", al.options.DefaultSeverity)
+	}
+
+	for _, sink := range al.options.Sinks {
+		d.add("sink", auditFormatName(sink.Format))
+	}
+
+	d.add("tokenFingerprint", al.options.TokenFingerprint)
+	d.add("sequence", al.options.Sequence)
+	return d.String()
+}
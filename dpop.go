@@ -0,0 +1,262 @@
+package skoap
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	dpopHeaderName        = "DPoP"
+	dpopScheme            = "DPoP "
+	dpopProofType         = "dpop+jwt"
+	dpopConfirmationClaim = "cnf"
+
+	invalidDPoP rejectReason = "invalid-dpop-proof"
+)
+
+// DefaultDPoPMaxAge is the default value of Options.DPoPMaxAge.
+const DefaultDPoPMaxAge = 5 * time.Minute
+
+var errInvalidDPoP = errors.New("invalid DPoP proof")
+
+type (
+	dpopHeader struct {
+		Typ string `json:"typ"`
+		Alg string `json:"alg"`
+		JWK *jwk   `json:"jwk"`
+	}
+
+	jwk struct {
+		Kty string `json:"kty"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	}
+
+	dpopClaims struct {
+		Jti string `json:"jti"`
+		Htm string `json:"htm"`
+		Htu string `json:"htu"`
+		Iat int64  `json:"iat"`
+		Ath string `json:"ath"`
+	}
+
+	dpopConfirmation struct {
+		Jkt string `json:"jkt"`
+	}
+)
+
+// takes the token from the Authorization header with the DPoP scheme
+func dpopToken(r *http.Request) (string, error) {
+	h := r.Header.Get(authHeaderName)
+	if !strings.HasPrefix(h, dpopScheme) || len(h) == len(dpopScheme) {
+		return "", errInvalidAuthorizationHeader
+	}
+
+	return h[len(dpopScheme):], nil
+}
+
+func decodeSegment(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errInvalidDPoP
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch {
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errInvalidDPoP
+		}
+
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	case k.Kty == "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errInvalidDPoP
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	default:
+		return nil, errInvalidDPoP
+	}
+}
+
+// the JWK thumbprint, as defined by RFC 7638, with the required members
+// in lexicographic order
+func (k *jwk) thumbprint() string {
+	var b []byte
+	if k.Kty == "EC" {
+		b, _ = json.Marshal(struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{k.Crv, k.Kty, k.X, k.Y})
+	} else {
+		b, _ = json.Marshal(struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{k.E, k.Kty, k.N})
+	}
+
+	h := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+func verifySignature(alg string, key crypto.PublicKey, input, sig []byte) bool {
+	h := sha256.Sum256(input)
+	switch alg {
+	case "ES256":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return false
+		}
+
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(k, h[:], r, s)
+	case "RS256":
+		k, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], sig) == nil
+	default:
+		return false
+	}
+}
+
+// the url of the request as seen by the client, taking the scheme from
+// the X-Forwarded-Proto header, when set by a load balancer
+func requestScheme(r *http.Request) string {
+	if p := r.Header.Get("X-Forwarded-Proto"); p != "" {
+		return strings.ToLower(strings.TrimSpace(strings.Split(p, ",")[0]))
+	}
+
+	if r.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// the htu claim is compared without the query and the fragment
+func matchHtu(r *http.Request, htu string) bool {
+	u, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Scheme, requestScheme(r)) &&
+		strings.EqualFold(u.Host, r.Host) &&
+		u.EscapedPath() == r.URL.EscapedPath()
+}
+
+func tokenHashClaim(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// verifies the DPoP proof of the request, bound to the access token,
+// and returns the thumbprint of its key
+func verifyDPoP(r *http.Request, token string, now time.Time, maxAge time.Duration) (string, error) {
+	proofs := r.Header[http.CanonicalHeaderKey(dpopHeaderName)]
+	if len(proofs) != 1 {
+		return "", errInvalidDPoP
+	}
+
+	parts := strings.Split(proofs[0], ".")
+	if len(parts) != 3 {
+		return "", errInvalidDPoP
+	}
+
+	var h dpopHeader
+	if err := decodeSegment(parts[0], &h); err != nil || h.Typ != dpopProofType || h.JWK == nil {
+		return "", errInvalidDPoP
+	}
+
+	key, err := h.JWK.publicKey()
+	if err != nil {
+		return "", err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !verifySignature(h.Alg, key, []byte(parts[0]+"."+parts[1]), sig) {
+		return "", errInvalidDPoP
+	}
+
+	var c dpopClaims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return "", errInvalidDPoP
+	}
+
+	if maxAge <= 0 {
+		maxAge = DefaultDPoPMaxAge
+	}
+
+	age := now.Sub(time.Unix(c.Iat, 0))
+	if c.Jti == "" ||
+		c.Htm != r.Method ||
+		!matchHtu(r, c.Htu) ||
+		age > maxAge || age < -maxAge ||
+		c.Ath != tokenHashClaim(token) {
+		return "", errInvalidDPoP
+	}
+
+	return h.JWK.thumbprint(), nil
+}
+
+// when the token validation service returns the confirmation claim,
+// the token needs to be bound to the key of the proof
+func validateDPoPBinding(a *authDoc, thumbprint string) bool {
+	raw, ok := a.Claims[dpopConfirmationClaim]
+	if !ok {
+		return true
+	}
+
+	var c dpopConfirmation
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return false
+	}
+
+	return c.Jkt == "" || c.Jkt == thumbprint
+}
@@ -0,0 +1,257 @@
+package skoap
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func testJWK(key crypto.Signer) *jwk {
+	switch k := key.Public().(type) {
+	case *ecdsa.PublicKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		k.X.FillBytes(x)
+		k.Y.FillBytes(y)
+		return &jwk{Kty: "EC", Crv: "P-256", X: b64(x), Y: b64(y)}
+	case *rsa.PublicKey:
+		return &jwk{Kty: "RSA", N: b64(k.N.Bytes()), E: b64(big.NewInt(int64(k.E)).Bytes())}
+	default:
+		return nil
+	}
+}
+
+// creates a proof signed with key, with the public key of jwkKey in its
+// header
+func testDPoPProof(t *testing.T, key, jwkKey crypto.Signer, claims dpopClaims) string {
+	alg := "ES256"
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		alg = "RS256"
+	}
+
+	h, err := json.Marshal(dpopHeader{Typ: dpopProofType, Alg: alg, JWK: testJWK(jwkKey)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := b64(h) + "." + b64(c)
+	digest := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case *rsa.PrivateKey:
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return input + "." + b64(sig)
+}
+
+func TestDPoP(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cnf string
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token, err := getToken(r); err != nil || token != testToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Write([]byte(`{"uid": "jdoe", "realm": "/immortals"` + cnf + `}`))
+	}))
+	defer authServer.Close()
+
+	const htu = "https://www.example.org/orders"
+	now := time.Now().Unix()
+	valid := dpopClaims{Jti: "proof-1", Htm: "GET", Htu: htu, Iat: now, Ath: tokenHashClaim(testToken)}
+	with := func(modify func(*dpopClaims)) dpopClaims {
+		c := valid
+		modify(&c)
+		return c
+	}
+
+	for _, ti := range []struct {
+		msg     string
+		method  string
+		url     string
+		scheme  string
+		noProof bool
+		key     crypto.Signer
+		jwkKey  crypto.Signer
+		claims  dpopClaims
+		cnf     string
+		reason  rejectReason
+	}{{
+		msg:    "valid proof",
+		claims: valid,
+	}, {
+		msg:    "valid RSA proof",
+		key:    rsaKey,
+		claims: valid,
+	}, {
+		msg:    "query ignored",
+		url:    htu + "?page=2",
+		claims: valid,
+	}, {
+		msg:    "DPoP scheme",
+		scheme: dpopScheme,
+		claims: valid,
+	}, {
+		msg:     "missing proof",
+		noProof: true,
+		reason:  invalidDPoP,
+	}, {
+		msg:    "wrong method",
+		method: "POST",
+		claims: valid,
+		reason: invalidDPoP,
+	}, {
+		msg:    "wrong url",
+		claims: with(func(c *dpopClaims) { c.Htu = "https://www.example.org/users" }),
+		reason: invalidDPoP,
+	}, {
+		msg:    "wrong scheme",
+		claims: with(func(c *dpopClaims) { c.Htu = "http://www.example.org/orders" }),
+		reason: invalidDPoP,
+	}, {
+		msg:    "bound to another token",
+		claims: with(func(c *dpopClaims) { c.Ath = tokenHashClaim("other-token") }),
+		reason: invalidDPoP,
+	}, {
+		msg:    "expired",
+		claims: with(func(c *dpopClaims) { c.Iat = now - 3600 }),
+		reason: invalidDPoP,
+	}, {
+		msg:    "missing jti",
+		claims: with(func(c *dpopClaims) { c.Jti = "" }),
+		reason: invalidDPoP,
+	}, {
+		msg:    "signed with another key",
+		jwkKey: otherKey,
+		claims: valid,
+		reason: invalidDPoP,
+	}, {
+		msg:    "confirmation matching",
+		claims: valid,
+		cnf:    testJWK(ecKey).thumbprint(),
+	}, {
+		msg:    "confirmation not matching",
+		claims: valid,
+		cnf:    testJWK(otherKey).thumbprint(),
+		reason: invalidDPoP,
+	}} {
+		if ti.method == "" {
+			ti.method = "GET"
+		}
+
+		if ti.url == "" {
+			ti.url = htu
+		}
+
+		if ti.scheme == "" {
+			ti.scheme = "Bearer "
+		}
+
+		if ti.key == nil {
+			ti.key = ecKey
+		}
+
+		if ti.jwkKey == nil {
+			ti.jwkKey = ti.key
+		}
+
+		cnf = ""
+		if ti.cnf != "" {
+			cnf = `, "cnf": {"jkt": "` + ti.cnf + `"}`
+		}
+
+		f, err := NewAuthWithOptions(Options{AuthUrlBase: authServer.URL, DPoP: true}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the client side url is https, while the request is received
+		// over http behind a load balancer
+		req, err := http.NewRequest(ti.method, ti.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set(authHeaderName, ti.scheme+testToken)
+		if !ti.noProof {
+			req.Header.Set(dpopHeaderName, testDPoPProof(t, ti.key, ti.jwkKey, ti.claims))
+		}
+
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+	}
+}
+
+func TestDPoPSchemeDisabled(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}})
+	defer authServer.Close()
+
+	req, err := http.NewRequest("GET", "https://www.example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set(authHeaderName, dpopScheme+testToken)
+	f, err := NewAuthWithOptions(Options{AuthUrlBase: authServer.URL}).CreateFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := newTestContext(req, nil)
+	f.Request(ctx)
+	if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(missingBearerToken) {
+		t.Error("failed to reject the DPoP scheme", ctx.StateBag()[authRejectReasonKey])
+	}
+}
@@ -0,0 +1,116 @@
+package skoap
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fileCheckInterval = time.Second
+
+// watchedFile holds the non-empty, non-comment lines of a file, and
+// reloads them when the modification time or the size of the file
+// changes. The file is checked for changes at most once per check
+// interval. When the file cannot be read, the last successfully loaded
+// content is kept.
+type watchedFile struct {
+	mu            sync.Mutex
+	path          string
+	checkInterval time.Duration
+	lastCheck     time.Time
+	modTime       time.Time
+	size          int64
+	lines         []string
+	set           map[string]bool
+}
+
+func newWatchedFile(path string, checkInterval time.Duration) *watchedFile {
+	return &watchedFile{path: path, checkInterval: checkInterval}
+}
+
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var lines []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		lines = append(lines, l)
+	}
+
+	return lines, s.Err()
+}
+
+func (wf *watchedFile) refresh() {
+	now := time.Now()
+	if !wf.lastCheck.IsZero() && now.Sub(wf.lastCheck) < wf.checkInterval {
+		return
+	}
+
+	wf.lastCheck = now
+
+	fi, err := os.Stat(wf.path)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if wf.set != nil && fi.ModTime().Equal(wf.modTime) && fi.Size() == wf.size {
+		return
+	}
+
+	lines, err := readLines(wf.path)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	set := make(map[string]bool)
+	for _, l := range lines {
+		set[l] = true
+	}
+
+	wf.modTime, wf.size, wf.lines, wf.set = fi.ModTime(), fi.Size(), lines, set
+}
+
+func (wf *watchedFile) list() []string {
+	wf.mu.Lock()
+	defer wf.mu.Unlock()
+	wf.refresh()
+	return wf.lines
+}
+
+func (wf *watchedFile) contains(l string) bool {
+	wf.mu.Lock()
+	defer wf.mu.Unlock()
+	wf.refresh()
+	return wf.set[l]
+}
+
+// FileDenylist returns a function that can be used as
+// Options.RevokedTokens. The file is expected to contain a token hash
+// or a jti on each line. Empty lines and lines starting with # are
+// ignored. Changes to the file are picked up without restarting.
+func FileDenylist(path string) func(id string) bool {
+	return newWatchedFile(path, fileCheckInterval).contains
+}
+
+// FileList returns a function that can be used as Options.AllowedTeams.
+// The file is expected to contain an item on each line. Empty lines and
+// lines starting with # are ignored. Changes to the file are picked up
+// without restarting.
+func FileList(path string) func() []string {
+	return newWatchedFile(path, fileCheckInterval).list
+}
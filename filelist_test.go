@@ -0,0 +1,158 @@
+package skoap
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zalando/skipper/eskip"
+	"github.com/zalando/skipper/filters"
+	"github.com/zalando/skipper/proxy/proxytest"
+)
+
+func writeTestFile(t *testing.T, path, content string, modTime time.Time) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skoap")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "list")
+	now := time.Now()
+	writeTestFile(t, path, "# comment\nfoo\n\n  bar  \n", now)
+
+	wf := newWatchedFile(path, 0)
+	if !wf.contains("foo") || !wf.contains("bar") || wf.contains("# comment") || wf.contains("") {
+		t.Error("failed to load the file")
+	}
+
+	writeTestFile(t, path, "baz\n", now.Add(time.Second))
+	if wf.contains("foo") || !wf.contains("baz") {
+		t.Error("failed to reload the file")
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if !wf.contains("baz") {
+		t.Error("failed to keep the last content")
+	}
+}
+
+func TestDenylist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skoap")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "denylist")
+	now := time.Now()
+	writeTestFile(t, path, "", now)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}, Jti: "test-jti"})
+	defer authServer.Close()
+
+	s := NewAuthWithOptions(Options{
+		AuthUrlBase:   authServer.URL,
+		RevokedTokens: newWatchedFile(path, 0).contains})
+
+	fr := make(filters.Registry)
+	fr.Register(s)
+	r := &eskip.Route{Filters: []*eskip.Filter{{Name: s.Name()}}, Backend: backend.URL}
+	proxy := proxytest.New(fr, r)
+	defer proxy.Close()
+
+	rsp := testRequest(t, proxy.URL, testToken)
+	if rsp.StatusCode != http.StatusOK {
+		t.Error("failed to authenticate", rsp.StatusCode)
+	}
+
+	writeTestFile(t, path, tokenHash(testToken)+"\n", now.Add(time.Second))
+	rsp = testRequest(t, proxy.URL, testToken)
+	if rsp.StatusCode != http.StatusUnauthorized {
+		t.Error("failed to reject revoked token hash", rsp.StatusCode)
+	}
+
+	writeTestFile(t, path, "test-jti\n", now.Add(2*time.Second))
+	rsp = testRequest(t, proxy.URL, testToken)
+	if rsp.StatusCode != http.StatusUnauthorized {
+		t.Error("failed to reject revoked jti", rsp.StatusCode)
+	}
+}
+
+func TestAllowedTeamsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skoap")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "teams")
+	now := time.Now()
+	writeTestFile(t, path, "# allowed teams\nother-team\n", now)
+
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}})
+	defer authServer.Close()
+
+	teamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id": "test-team"}]`))
+	}))
+	defer teamServer.Close()
+
+	wf := newWatchedFile(path, 0)
+	f, err := NewAuthTeamWithOptions(Options{
+		AuthUrlBase:  authServer.URL,
+		TeamUrlBase:  teamServer.URL + "/?uid=",
+		AllowedTeams: wf.list}).CreateFilter([]interface{}{testRealm, "test-team"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func() *testContext {
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, "Bearer "+testToken)
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		return ctx
+	}
+
+	if ctx := request(); !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(invalidTeam) {
+		t.Error("failed to ignore the filter arguments", ctx.StateBag()[authRejectReasonKey])
+	}
+
+	writeTestFile(t, path, "other-team\ntest-team\n", now.Add(time.Second))
+	if ctx := request(); ctx.FServedWithResponse {
+		t.Error("failed to pick up the new teams", ctx.StateBag()[authRejectReasonKey])
+	}
+
+	writeTestFile(t, path, "", now.Add(2*time.Second))
+	if ctx := request(); !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(invalidTeam) {
+		t.Error("failed to reject with no allowed teams", ctx.StateBag()[authRejectReasonKey])
+	}
+}
@@ -0,0 +1,47 @@
+package skoap
+
+import "sync"
+
+type (
+	flightCall struct {
+		done chan struct{}
+		a    *authDoc
+		err  error
+	}
+
+	// flightGroup coalesces the concurrent token validations with the
+	// same key into a single call
+	flightGroup struct {
+		mu    sync.Mutex
+		calls map[string]*flightCall
+	}
+)
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*flightCall)}
+}
+
+// calls fn, unless a call with the same key is in flight. In that case,
+// it waits for the result of the pending call.
+func (g *flightGroup) do(key string, fn func() (*authDoc, error)) (*authDoc, error) {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.a, c.err
+	}
+
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+
+	c.a, c.err = fn()
+	return c.a, c.err
+}
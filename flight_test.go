@@ -0,0 +1,47 @@
+package skoap
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroup(t *testing.T) {
+	g := newFlightGroup()
+	release := make(chan struct{})
+	var calls int32
+	fn := func() (*authDoc, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return &authDoc{Uid: testUid}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a, err := g.do("foo", fn)
+			if err != nil || a.Uid != testUid {
+				t.Error("invalid result", a, err)
+			}
+		}()
+	}
+
+	// let the calls join the pending one
+	time.Sleep(60 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Error("failed to coalesce the calls", calls)
+	}
+
+	// once completed, the next call is made again
+	testErr := errors.New("test error")
+	if _, err := g.do("foo", func() (*authDoc, error) { return nil, testErr }); err != testErr {
+		t.Error("failed to call again", err)
+	}
+}
@@ -0,0 +1,204 @@
+package skoap
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/zalando/skipper/filters"
+)
+
+// HMACAuthName is the name of the hmacAuth filter.
+const HMACAuthName = "hmacAuth"
+
+const (
+	hmacScheme = "HMAC "
+
+	invalidSignature rejectReason = "invalid-signature"
+)
+
+// DefaultMaxHMACBodyBytes is the default value of
+// HMACAuthOptions.MaxBodyBytes.
+const DefaultMaxHMACBodyBytes = 1 << 20
+
+var errHMACBodyTooLarge = errors.New("request body too large for the signature check")
+
+// HMACAuthOptions is used to create the hmacAuth filter specification.
+type HMACAuthOptions struct {
+
+	// KeyLookup returns the secret of a key id.
+	KeyLookup func(keyId string) (secret string, err error)
+
+	// MaxBodyBytes is the maximum size of the request body read for
+	// the signature check. Requests with a larger body are rejected
+	// with the request-too-large reason. Defaults to
+	// DefaultMaxHMACBodyBytes.
+	MaxBodyBytes int64
+}
+
+type (
+	hmacAuthSpec struct {
+		options HMACAuthOptions
+	}
+
+	hmacAuth struct {
+		options HMACAuthOptions
+	}
+)
+
+// NewHMACAuth creates a filter specification that checks the HMAC
+// signature of the incoming requests, as an alternative to the bearer
+// tokens, e.g. for receiving webhooks. The requests need to have an
+// Authorization header in the format of:
+//
+//     Authorization: HMAC keyId=webhooks,signature=<base64 signature>
+//
+// The signature is the HMAC-SHA256 of the method, the path with the
+// query, and the hex encoded SHA256 digest of the body, separated by
+// newlines:
+//
+//     POST
+//     /hooks/orders?source=shop
+//     e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855
+//
+// The secret of the key is returned by keyLookup. Requests with a
+// missing or wrong signature, or an unknown key, are rejected with the
+// invalid-signature reason. Requests with a body larger than
+// DefaultMaxHMACBodyBytes are rejected with the request-too-large
+// reason. The filter doesn't take arguments:
+//
+//     hmacAuth()
+//
+func NewHMACAuth(keyLookup func(keyId string) (secret string, err error)) filters.Spec {
+	return NewHMACAuthWithOptions(HMACAuthOptions{KeyLookup: keyLookup})
+}
+
+// NewHMACAuthWithOptions creates a filter specification like
+// NewHMACAuth, with the settings in the options.
+func NewHMACAuthWithOptions(o HMACAuthOptions) filters.Spec {
+	if o.MaxBodyBytes <= 0 {
+		o.MaxBodyBytes = DefaultMaxHMACBodyBytes
+	}
+
+	return &hmacAuthSpec{options: o}
+}
+
+func (s *hmacAuthSpec) Name() string { return HMACAuthName }
+
+func (s *hmacAuthSpec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	if len(args) != 0 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	return &hmacAuth{options: s.options}, nil
+}
+
+// parses the key id and the signature from the Authorization header
+func hmacParams(r *http.Request) (string, []byte, bool) {
+	h := r.Header.Get(authHeaderName)
+	if !strings.HasPrefix(h, hmacScheme) {
+		return "", nil, false
+	}
+
+	var keyId, signature string
+	for _, p := range strings.Split(h[len(hmacScheme):], ",") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) != 2 {
+			return "", nil, false
+		}
+
+		switch kv[0] {
+		case "keyId":
+			keyId = kv[1]
+		case "signature":
+			signature = kv[1]
+		}
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if keyId == "" || err != nil || len(sig) == 0 {
+		return "", nil, false
+	}
+
+	return keyId, sig, true
+}
+
+// reads the body up to max bytes, and replaces it with a copy for the
+// backend
+func bodyDigest(r *http.Request, max int64) (string, error) {
+	if r.ContentLength > max {
+		return "", errHMACBodyTooLarge
+	}
+
+	var b []byte
+	if r.Body != nil {
+		var err error
+		if b, err = ioutil.ReadAll(io.LimitReader(r.Body, max+1)); err != nil {
+			return "", err
+		}
+
+		if int64(len(b)) > max {
+			return "", errHMACBodyTooLarge
+		}
+
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	}
+
+	d := sha256.Sum256(b)
+	return hex.EncodeToString(d[:]), nil
+}
+
+func hmacSignature(secret string, r *http.Request, digest string) []byte {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(r.Method + "\n" + r.URL.RequestURI() + "\n" + digest))
+	return m.Sum(nil)
+}
+
+func (f *hmacAuth) Request(ctx filters.FilterContext) {
+	r := ctx.Request()
+	keyId, sig, ok := hmacParams(r)
+	if !ok {
+		unauthorized(ctx, "", invalidSignature)
+		return
+	}
+
+	secret, err := f.options.KeyLookup(keyId)
+	if err != nil || secret == "" {
+		if err != nil {
+			log.Println(err)
+		}
+
+		unauthorized(ctx, keyId, invalidSignature)
+		return
+	}
+
+	digest, err := bodyDigest(r, f.options.MaxBodyBytes)
+	if err == errHMACBodyTooLarge {
+		reject(ctx, keyId, requestTooLarge, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err != nil {
+		log.Println(err)
+		unauthorized(ctx, keyId, invalidSignature)
+		return
+	}
+
+	if !hmac.Equal(sig, hmacSignature(secret, r, digest)) {
+		unauthorized(ctx, keyId, invalidSignature)
+		return
+	}
+
+	authorized(ctx, keyId)
+}
+
+func (f *hmacAuth) Response(_ filters.FilterContext) {}
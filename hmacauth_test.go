@@ -0,0 +1,193 @@
+package skoap
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func testKeyLookup(keyId string) (string, error) {
+	switch keyId {
+	case "webhooks":
+		return "secret", nil
+	case "broken":
+		return "", errors.New("key store unavailable")
+	default:
+		return "", nil
+	}
+}
+
+func testSign(t *testing.T, req *http.Request, keyId, secret string) {
+	digest, err := bodyDigest(req, DefaultMaxHMACBodyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig := base64.StdEncoding.EncodeToString(hmacSignature(secret, req, digest))
+	req.Header.Set(authHeaderName, "HMAC keyId="+keyId+",signature="+sig)
+}
+
+func TestHMACAuthArgs(t *testing.T) {
+	if _, err := NewHMACAuth(testKeyLookup).CreateFilter([]interface{}{"foo"}); err == nil {
+		t.Error("failed to fail")
+	}
+}
+
+func TestHMACAuth(t *testing.T) {
+	const body = `{"order": 42}`
+	for _, ti := range []struct {
+		msg      string
+		keyId    string
+		secret   string
+		tamper   func(*http.Request)
+		unsigned bool
+		header   string
+		valid    bool
+	}{{
+		msg:    "valid",
+		keyId:  "webhooks",
+		secret: "secret",
+		valid:  true,
+	}, {
+		msg:      "missing signature",
+		unsigned: true,
+	}, {
+		msg:      "bearer token",
+		unsigned: true,
+		header:   "Bearer " + testToken,
+	}, {
+		msg:      "malformed header",
+		unsigned: true,
+		header:   "HMAC keyId=webhooks",
+	}, {
+		msg:    "wrong secret",
+		keyId:  "webhooks",
+		secret: "other-secret",
+	}, {
+		msg:    "unknown key",
+		keyId:  "unknown",
+		secret: "secret",
+	}, {
+		msg:    "key lookup failure",
+		keyId:  "broken",
+		secret: "secret",
+	}, {
+		msg:    "tampered method",
+		keyId:  "webhooks",
+		secret: "secret",
+		tamper: func(r *http.Request) { r.Method = "PUT" },
+	}, {
+		msg:    "tampered path",
+		keyId:  "webhooks",
+		secret: "secret",
+		tamper: func(r *http.Request) { r.URL.Path = "/hooks/users" },
+	}, {
+		msg:    "tampered query",
+		keyId:  "webhooks",
+		secret: "secret",
+		tamper: func(r *http.Request) { r.URL.RawQuery = "source=other" },
+	}, {
+		msg:    "tampered body",
+		keyId:  "webhooks",
+		secret: "secret",
+		tamper: func(r *http.Request) { r.Body = ioutil.NopCloser(strings.NewReader(`{"order": 43}`)) },
+	}} {
+		req, err := http.NewRequest("POST", "https://www.example.org/hooks/orders?source=shop", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !ti.unsigned {
+			testSign(t, req, ti.keyId, ti.secret)
+		} else if ti.header != "" {
+			req.Header.Set(authHeaderName, ti.header)
+		}
+
+		if ti.tamper != nil {
+			ti.tamper(req)
+		}
+
+		f, err := NewHMACAuth(testKeyLookup).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if ti.valid {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+				continue
+			}
+
+			if ctx.StateBag()[authUserKey] != ti.keyId {
+				t.Error(ti.msg, "failed to set the key id as the user", ctx.StateBag()[authUserKey])
+			}
+
+			b, err := ioutil.ReadAll(req.Body)
+			if err != nil || string(b) != body {
+				t.Error(ti.msg, "failed to forward the body", string(b), err)
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(invalidSignature) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+	}
+}
+
+func TestHMACAuthMaxBody(t *testing.T) {
+	const body = `{"order": 42}`
+	for _, ti := range []struct {
+		msg           string
+		maxBodyBytes  int64
+		unknownLength bool
+		valid         bool
+	}{{
+		msg:          "within the limit",
+		maxBodyBytes: int64(len(body)),
+		valid:        true,
+	}, {
+		msg:          "known length over the limit",
+		maxBodyBytes: int64(len(body)) - 1,
+	}, {
+		msg:           "unknown length within the limit",
+		maxBodyBytes:  int64(len(body)),
+		unknownLength: true,
+		valid:         true,
+	}, {
+		msg:           "unknown length over the limit",
+		maxBodyBytes:  int64(len(body)) - 1,
+		unknownLength: true,
+	}} {
+		req, err := http.NewRequest("POST", "https://www.example.org/hooks/orders", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testSign(t, req, "webhooks", "secret")
+		if ti.unknownLength {
+			req.ContentLength = -1
+		}
+
+		f, err := NewHMACAuthWithOptions(HMACAuthOptions{
+			KeyLookup:    testKeyLookup,
+			MaxBodyBytes: ti.maxBodyBytes}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if ti.valid {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse ||
+			ctx.FResponse.StatusCode != http.StatusRequestEntityTooLarge ||
+			ctx.StateBag()[authRejectReasonKey] != string(requestTooLarge) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+	}
+}
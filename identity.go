@@ -0,0 +1,59 @@
+package skoap
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	userHeaderName      = "X-Authenticated-User"
+	scopesHeaderName    = "X-Authenticated-Scopes"
+	realmHeaderName     = "X-Authenticated-Realm"
+	signatureHeaderName = "X-Auth-Signature"
+	timestampHeaderName = "X-Auth-Timestamp"
+)
+
+var identityHeaders = []string{
+	userHeaderName,
+	scopesHeaderName,
+	realmHeaderName,
+	signatureHeaderName,
+	timestampHeaderName,
+}
+
+// IdentitySignature returns the hex encoded HMAC-SHA256 signature of
+// the forwarded identity, as set by the auth filters in the
+// X-Auth-Signature header, when Options.IdentitySecret is set. The
+// arguments are the values of the X-Authenticated-User,
+// X-Authenticated-Scopes and X-Auth-Timestamp headers. Backends can
+// use it to verify the forwarded identity, and should reject old
+// timestamps to prevent replay. The X-Authenticated-Realm header is not
+// covered by the signature, backends relying on it need to make sure
+// that the requests can reach them only through the proxy.
+func IdentitySignature(secret []byte, user, scopes, timestamp string) string {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(user + "\n" + scopes + "\n" + timestamp))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+func forwardIdentity(r *http.Request, a *authDoc, secret []byte, now time.Time) {
+	user, scopes := a.Uid, strings.Join(a.Scopes, ",")
+	r.Header.Set(userHeaderName, user)
+	r.Header.Set(scopesHeaderName, scopes)
+	if a.hasRealmField() {
+		r.Header.Set(realmHeaderName, strings.Join(a.Realm, ","))
+	}
+
+	if len(secret) == 0 {
+		return
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	r.Header.Set(timestampHeaderName, timestamp)
+	r.Header.Set(signatureHeaderName, IdentitySignature(secret, user, scopes, timestamp))
+}
@@ -0,0 +1,161 @@
+package skoap
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestForwardIdentity(t *testing.T) {
+	secret := []byte("shared-secret")
+	for _, ti := range []struct {
+		msg    string
+		doc    *authDoc
+		secret []byte
+		scopes string
+	}{{
+		msg:    "unsigned",
+		doc:    &authDoc{Uid: testUid, Realm: realms{testRealm}, Scopes: []string{"read", "write"}},
+		scopes: "read,write",
+	}, {
+		msg:    "signed",
+		doc:    &authDoc{Uid: testUid, Realm: realms{testRealm}, Scopes: []string{"read", "write"}},
+		secret: secret,
+		scopes: "read,write",
+	}, {
+		msg:    "signed, no scopes",
+		doc:    &authDoc{Uid: testUid, Realm: realms{testRealm}},
+		secret: secret,
+	}} {
+		authServer := testAuthServer(t, ti.doc)
+		s := NewAuthWithOptions(Options{
+			AuthUrlBase:     authServer.URL,
+			ForwardIdentity: true,
+			IdentitySecret:  ti.secret})
+
+		f, err := s.CreateFilter([]interface{}{testRealm})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, "Bearer "+testToken)
+		req.Header.Set(userHeaderName, "mallory")
+		req.Header.Set(signatureHeaderName, "forged")
+		req.Header.Set(timestampHeaderName, "0")
+
+		ctx := newTestContext(req, nil)
+		before := time.Now().Unix()
+		f.Request(ctx)
+		authServer.Close()
+
+		if ctx.FServedWithResponse {
+			t.Error(ti.msg, "failed to authorize")
+			continue
+		}
+
+		h := req.Header
+		if h.Get(userHeaderName) != testUid || h.Get(scopesHeaderName) != ti.scopes {
+			t.Error(ti.msg, "invalid identity headers", h.Get(userHeaderName), h.Get(scopesHeaderName))
+		}
+
+		if len(ti.secret) == 0 {
+			if h.Get(signatureHeaderName) != "" || h.Get(timestampHeaderName) != "" {
+				t.Error(ti.msg, "unexpected signature")
+			}
+
+			continue
+		}
+
+		ts, err := strconv.ParseInt(h.Get(timestampHeaderName), 10, 64)
+		if err != nil || ts < before || ts > time.Now().Unix() {
+			t.Error(ti.msg, "invalid timestamp", h.Get(timestampHeaderName))
+		}
+
+		signature := h.Get(signatureHeaderName)
+		if signature != IdentitySignature(ti.secret, testUid, ti.scopes, h.Get(timestampHeaderName)) {
+			t.Error(ti.msg, "invalid signature")
+		}
+
+		if signature == IdentitySignature(ti.secret, "jane", ti.scopes, h.Get(timestampHeaderName)) ||
+			signature == IdentitySignature(ti.secret, testUid, ti.scopes+",admin", h.Get(timestampHeaderName)) ||
+			signature == IdentitySignature(ti.secret, testUid, ti.scopes, "0") ||
+			signature == IdentitySignature([]byte("other-secret"), testUid, ti.scopes, h.Get(timestampHeaderName)) {
+			t.Error(ti.msg, "signature doesn't change with the identity")
+		}
+	}
+}
+
+func TestStripHeaders(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}})
+	defer authServer.Close()
+
+	for _, ti := range []struct {
+		msg      string
+		options  Options
+		stripped []string
+		kept     []string
+	}{{
+		msg:      "default",
+		stripped: []string{userHeaderName, scopesHeaderName, teamsHeaderName, signatureHeaderName},
+		kept:     []string{"X-Custom"},
+	}, {
+		msg:      "custom",
+		options:  Options{StripHeaders: []string{"X-Custom"}},
+		stripped: []string{"X-Custom"},
+		kept:     []string{userHeaderName},
+	}, {
+		msg:     "disabled",
+		options: Options{StripHeaders: []string{}},
+		kept:    []string{userHeaderName, "X-Custom"},
+	}, {
+		msg:      "forwarded identity overrides",
+		options:  Options{StripHeaders: []string{}, ForwardIdentity: true},
+		stripped: []string{signatureHeaderName},
+		kept:     []string{"X-Custom"},
+	}} {
+		ti.options.AuthUrlBase = authServer.URL
+		f, err := NewAuthWithOptions(ti.options).CreateFilter([]interface{}{testRealm})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, "Bearer "+testToken)
+		for _, h := range append(ti.stripped, ti.kept...) {
+			req.Header.Set(h, "mallory")
+		}
+
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if ctx.FServedWithResponse {
+			t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			continue
+		}
+
+		for _, h := range ti.stripped {
+			if _, ok := req.Header[h]; ok {
+				t.Error(ti.msg, "failed to strip header", h)
+			}
+		}
+
+		for _, h := range ti.kept {
+			if req.Header.Get(h) != "mallory" {
+				t.Error(ti.msg, "unexpectedly stripped header", h)
+			}
+		}
+
+		if req.Header.Get(userHeaderName) == "mallory" && ti.options.ForwardIdentity {
+			t.Error(ti.msg, "spoofed user forwarded")
+		}
+	}
+}
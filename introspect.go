@@ -0,0 +1,92 @@
+package skoap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// the response of an RFC 7662 token introspection endpoint
+type introspectionDoc struct {
+	Active   bool    `json:"active"`
+	Scope    *string `json:"scope"`
+	Sub      string  `json:"sub"`
+	Username string  `json:"username"`
+	Realm    realms  `json:"realm"`
+}
+
+// posts the token to the introspection endpoint, authenticating with
+// the client credentials, when set, as in RFC 6749, section 2.3.1
+func (ac *authClient) introspect(token string, a *authDoc) (http.Header, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest("POST", ac.urlBase, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if ac.clientId != "" {
+		req.SetBasicAuth(url.QueryEscape(ac.clientId), url.QueryEscape(ac.clientSecret))
+	}
+
+	rsp, err := ac.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rsp.Body.Close()
+
+	// the introspection endpoint responds with 200 for the invalid
+	// tokens, too, any other status means that it rejected the client
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token introspection failed with status %d", rsp.StatusCode)
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(rsp.Body).Decode(&raw); err != nil {
+		return nil, errMalformedResponse
+	}
+
+	var d introspectionDoc
+	if err := json.Unmarshal(raw, &d); err != nil {
+		return nil, errMalformedResponse
+	}
+
+	if !d.Active {
+		return nil, errInvalidToken
+	}
+
+	a.Uid = d.Username
+	if a.Uid == "" {
+		a.Uid = d.Sub
+	}
+
+	a.Realm = d.Realm
+	if d.Scope != nil {
+		a.Scopes = append([]string{}, strings.Fields(*d.Scope)...)
+	}
+
+	if len(ac.claims) == 0 {
+		return rsp.Header, nil
+	}
+
+	var claims map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return nil, errMalformedResponse
+	}
+
+	for _, c := range ac.claims {
+		if v, ok := claims[c]; ok {
+			if a.Claims == nil {
+				a.Claims = make(map[string]json.RawMessage)
+			}
+
+			a.Claims[c] = v
+		}
+	}
+
+	return rsp.Header, nil
+}
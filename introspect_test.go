@@ -0,0 +1,135 @@
+package skoap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestIntrospection(t *testing.T) {
+	var (
+		response   string
+		status     int
+		method     string
+		authHeader string
+		user, pass string
+		hasBasic   bool
+		formToken  string
+	)
+
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		authHeader = r.Header.Get(authHeaderName)
+		user, pass, hasBasic = r.BasicAuth()
+		user, _ = url.QueryUnescape(user)
+		pass, _ = url.QueryUnescape(pass)
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+
+		formToken = r.PostForm.Get("token")
+		if status != 0 {
+			w.WriteHeader(status)
+		}
+
+		w.Write([]byte(response))
+	}))
+	defer authServer.Close()
+
+	for _, ti := range []struct {
+		msg      string
+		options  Options
+		response string
+		status   int
+		args     []interface{}
+		reason   rejectReason
+		uid      string
+	}{{
+		msg:      "active, with client credentials",
+		options:  Options{ClientId: "skoap", ClientSecret: "s3cr:t"},
+		response: `{"active": true, "sub": "jdoe", "scope": "read write", "realm": "/employees"}`,
+		args:     []interface{}{"/employees", "write"},
+		uid:      "jdoe",
+	}, {
+		msg:      "active, without client credentials",
+		response: `{"active": true, "sub": "jdoe", "username": "john.doe"}`,
+		uid:      "john.doe",
+	}, {
+		msg:      "inactive",
+		options:  Options{ClientId: "skoap", ClientSecret: "secret"},
+		response: `{"active": false}`,
+		reason:   invalidToken,
+	}, {
+		msg:      "missing scope",
+		options:  Options{ClientId: "skoap", ClientSecret: "secret"},
+		response: `{"active": true, "sub": "jdoe", "scope": "read"}`,
+		args:     []interface{}{"", "write"},
+		reason:   invalidScope,
+	}, {
+		msg:      "client rejected",
+		options:  Options{ClientId: "skoap", ClientSecret: "wrong"},
+		response: `{"error": "invalid_client"}`,
+		status:   http.StatusUnauthorized,
+		reason:   authServiceAccess,
+	}, {
+		msg:      "malformed response",
+		options:  Options{ClientId: "skoap", ClientSecret: "secret"},
+		response: `{"active": "yes"`,
+		reason:   authServiceFormat,
+	}} {
+		response, status = ti.response, ti.status
+		method, authHeader, user, pass, hasBasic, formToken = "", "", "", "", false, ""
+
+		ti.options.AuthUrlBase = authServer.URL
+		ti.options.Introspection = true
+		ctx := testAuthFilter(t, NewAuthWithOptions(ti.options), ti.args, testToken)
+
+		if method != "POST" || formToken != testToken {
+			t.Error(ti.msg, "invalid introspection request", method, formToken)
+		}
+
+		if ti.options.ClientId == "" {
+			if authHeader != "" {
+				t.Error(ti.msg, "unexpected authorization header", authHeader)
+			}
+		} else if !hasBasic || user != ti.options.ClientId || pass != ti.options.ClientSecret {
+			t.Error(ti.msg, "invalid client credentials", user, pass)
+		}
+
+		if ti.reason != "" {
+			if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+				t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+			}
+
+			continue
+		}
+
+		if ctx.FServedWithResponse {
+			t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			continue
+		}
+
+		if ctx.StateBag()[authUserKey] != ti.uid {
+			t.Error(ti.msg, "invalid user", ctx.StateBag()[authUserKey])
+		}
+	}
+}
+
+func TestIntrospectionScopes(t *testing.T) {
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"active": true, "sub": "jdoe", "scope": ""}`))
+	}))
+	defer authServer.Close()
+
+	ac := &authClient{client: http.DefaultClient, urlBase: authServer.URL, introspection: true}
+	a, err := ac.validate(testToken, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !a.hasScopeField() || !reflect.DeepEqual(a.Scopes, []string{}) {
+		t.Error("invalid scopes", a.Scopes)
+	}
+}
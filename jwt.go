@@ -0,0 +1,44 @@
+package skoap
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// the scope claims of a JWT access token: scope, as defined by RFC
+// 9068, with the scopes separated by spaces, or scp, as a list
+type jwtScopeClaims struct {
+	Scope json.RawMessage `json:"scope"`
+	Scp   []string        `json:"scp"`
+}
+
+// takes the scopes from the claims of a JWT access token, without
+// verifying its signature. Used only for the tokens validated by the
+// token validation service.
+func jwtScopes(token string) ([]string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	var c jwtScopeClaims
+	if err := decodeSegment(strings.TrimRight(parts[1], "="), &c); err != nil {
+		return nil, errInvalidToken
+	}
+
+	if len(c.Scope) == 0 {
+		return c.Scp, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(c.Scope, &s); err == nil {
+		return strings.Fields(s), nil
+	}
+
+	var l []string
+	if err := json.Unmarshal(c.Scope, &l); err != nil {
+		return nil, errInvalidToken
+	}
+
+	return l, nil
+}
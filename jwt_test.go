@@ -0,0 +1,122 @@
+package skoap
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testJWT(claims string) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	return enc([]byte(`{"alg":"RS256","typ":"at+jwt"}`)) + "." + enc([]byte(claims)) + ".c2lnbmF0dXJl"
+}
+
+func TestJWTScopes(t *testing.T) {
+	for _, ti := range []struct {
+		msg    string
+		token  string
+		scopes []string
+		fail   bool
+	}{{
+		msg:    "scope claim",
+		token:  testJWT(`{"sub": "jdoe", "scope": "read write"}`),
+		scopes: []string{"read", "write"},
+	}, {
+		msg:    "scope claim as list",
+		token:  testJWT(`{"sub": "jdoe", "scope": ["read", "write"]}`),
+		scopes: []string{"read", "write"},
+	}, {
+		msg:    "scp claim",
+		token:  testJWT(`{"sub": "jdoe", "scp": ["read"]}`),
+		scopes: []string{"read"},
+	}, {
+		msg:   "no scopes",
+		token: testJWT(`{"sub": "jdoe"}`),
+	}, {
+		msg:   "opaque token",
+		token: testToken,
+		fail:  true,
+	}, {
+		msg:   "invalid claims",
+		token: testJWT(`{"scope": 42}`),
+		fail:  true,
+	}} {
+		scopes, err := jwtScopes(ti.token)
+		if ti.fail {
+			if err == nil {
+				t.Error(ti.msg, "failed to fail")
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Error(ti.msg, err)
+			continue
+		}
+
+		if strings.Join(scopes, " ") != strings.Join(ti.scopes, " ") {
+			t.Error(ti.msg, "invalid scopes", scopes)
+		}
+	}
+}
+
+func TestScopesFromToken(t *testing.T) {
+	token := testJWT(`{"sub": "jdoe", "scope": "read write"}`)
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, err := getToken(r); err != nil || got != token && got != testToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// the introspection doesn't return the scopes
+		w.Write([]byte(`{"uid": "jdoe", "realm": "/immortals"}`))
+	}))
+	defer authServer.Close()
+
+	for _, ti := range []struct {
+		msg    string
+		token  string
+		scope  string
+		reason rejectReason
+	}{{
+		msg:   "scope from the token",
+		token: token,
+		scope: "write",
+	}, {
+		msg:    "scope missing from the token",
+		token:  token,
+		scope:  "admin",
+		reason: invalidScope,
+	}, {
+		msg:    "opaque token",
+		token:  testToken,
+		scope:  "write",
+		reason: invalidToken,
+	}} {
+		f, err := NewAuthWithOptions(Options{
+			AuthUrlBase:     authServer.URL,
+			ScopesFromToken: true}).CreateFilter([]interface{}{"/immortals", ti.scope})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, "Bearer "+ti.token)
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package skoap
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const latencySamples = 1024
+
+// LatencyStats contains the percentiles of the recent call durations of
+// the token validation service. They are computed from the last 1024
+// calls. Cached validations are not included.
+type LatencyStats struct {
+	Count int
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+}
+
+// latencyRing keeps the most recent durations in a fixed size ring
+// buffer.
+type latencyRing struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func newLatencyRing(size int) *latencyRing {
+	return &latencyRing{samples: make([]time.Duration, 0, size)}
+}
+
+func (lr *latencyRing) add(d time.Duration) {
+	if lr == nil {
+		return
+	}
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	if len(lr.samples) < cap(lr.samples) {
+		lr.samples = append(lr.samples, d)
+		return
+	}
+
+	lr.samples[lr.next] = d
+	lr.next = (lr.next + 1) % len(lr.samples)
+}
+
+// nearest-rank percentile of sorted samples
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	return sorted[i]
+}
+
+func (lr *latencyRing) stats() LatencyStats {
+	lr.mu.Lock()
+	sorted := make([]time.Duration, len(lr.samples))
+	copy(sorted, lr.samples)
+	lr.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return LatencyStats{}
+	}
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return LatencyStats{
+		Count: len(sorted),
+		P50:   percentile(sorted, .5),
+		P95:   percentile(sorted, .95),
+		P99:   percentile(sorted, .99)}
+}
@@ -0,0 +1,48 @@
+package skoap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyRing(t *testing.T) {
+	lr := newLatencyRing(100)
+	if st := lr.stats(); st != (LatencyStats{}) {
+		t.Error("unexpected stats", st)
+	}
+
+	// 1ms..100ms, in reverse order
+	for i := 100; i > 0; i-- {
+		lr.add(time.Duration(i) * time.Millisecond)
+	}
+
+	st := lr.stats()
+	if st.Count != 100 || st.P50 != 50*time.Millisecond || st.P95 != 95*time.Millisecond || st.P99 != 99*time.Millisecond {
+		t.Error("invalid percentiles", st)
+	}
+
+	// overwrite the oldest half with the slow calls
+	for i := 0; i < 50; i++ {
+		lr.add(time.Second)
+	}
+
+	st = lr.stats()
+	if st.Count != 100 || st.P50 != 50*time.Millisecond || st.P95 != time.Second || st.P99 != time.Second {
+		t.Error("invalid percentiles after overwrite", st)
+	}
+}
+
+func TestLatencyStats(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}})
+	defer authServer.Close()
+
+	s := NewAuthWithOptions(Options{AuthUrlBase: authServer.URL, AuthCacheTTL: time.Minute})
+	for i := 0; i < 3; i++ {
+		testAuthFilter(t, s, []interface{}{testRealm}, testToken)
+	}
+
+	st := s.LatencyStats()
+	if st.Count != 1 || st.P50 <= 0 || st.P50 != st.P99 {
+		t.Error("invalid latency stats", st)
+	}
+}
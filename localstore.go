@@ -0,0 +1,50 @@
+package skoap
+
+import "time"
+
+// AuthInfo is the validation result of a token, as stored in a
+// LocalTokenStore.
+type AuthInfo struct {
+	Uid    string
+	Realms []string
+	Scopes []string
+	Roles  []string
+}
+
+// LocalTokenStore holds the validation results of the tokens pushed to
+// the proxy, e.g. by a subscription to the token issuer. When set as
+// Options.LocalTokenStore, the auth filters validate the tokens from the
+// store, without calling the token validation service. It is safe to use
+// from multiple goroutines.
+type LocalTokenStore struct {
+	cache *cache
+}
+
+// NewLocalTokenStore creates an empty token store.
+func NewLocalTokenStore() *LocalTokenStore {
+	return &LocalTokenStore{cache: newCache(0, nil)}
+}
+
+// Set stores the validation result of a token, valid for ttl.
+func (s *LocalTokenStore) Set(token string, info AuthInfo, ttl time.Duration) {
+	a := &authDoc{
+		Uid:    info.Uid,
+		Realm:  realms(info.Realms),
+		Scopes: info.Scopes,
+		Roles:  info.Roles}
+	s.cache.setTTL(tokenHash(token), a, ttl)
+}
+
+// Delete removes a token from the store.
+func (s *LocalTokenStore) Delete(token string) {
+	s.cache.del(tokenHash(token))
+}
+
+func (s *LocalTokenStore) lookup(token string) (*authDoc, bool) {
+	a, ok := s.cache.get(tokenHash(token))
+	if !ok {
+		return nil, false
+	}
+
+	return a.(*authDoc), true
+}
@@ -0,0 +1,87 @@
+package skoap
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLocalTokenStore(t *testing.T) {
+	store := NewLocalTokenStore()
+	store.Set("stored-token", AuthInfo{Uid: "jdoe", Realms: []string{testRealm}, Scopes: []string{"read"}}, time.Hour)
+	store.Set("expired-token", AuthInfo{Uid: "jdoe", Realms: []string{testRealm}}, -time.Second)
+	store.Set("deleted-token", AuthInfo{Uid: "jdoe", Realms: []string{testRealm}}, time.Hour)
+	store.Delete("deleted-token")
+
+	authServer := testAuthServer(t, &authDoc{Uid: "jane", Realm: realms{testRealm}, Scopes: []string{"read"}})
+	defer authServer.Close()
+
+	for _, ti := range []struct {
+		msg      string
+		token    string
+		fallback bool
+		args     []interface{}
+		uid      string
+	}{{
+		msg:   "store hit",
+		token: "stored-token",
+		args:  []interface{}{testRealm, "read"},
+		uid:   "jdoe",
+	}, {
+		msg:   "store hit, missing scope",
+		token: "stored-token",
+		args:  []interface{}{testRealm, "write"},
+	}, {
+		msg:   "store miss, rejected",
+		token: testToken,
+	}, {
+		msg:   "expired, rejected",
+		token: "expired-token",
+	}, {
+		msg:   "deleted, rejected",
+		token: "deleted-token",
+	}, {
+		msg:      "store miss, fallback",
+		token:    testToken,
+		fallback: true,
+		uid:      "jane",
+	}, {
+		msg:      "store hit, no fallback needed",
+		token:    "stored-token",
+		fallback: true,
+		uid:      "jdoe",
+	}} {
+		f, err := NewAuthWithOptions(Options{
+			AuthUrlBase:        authServer.URL,
+			LocalTokenStore:    store,
+			LocalStoreFallback: ti.fallback}).CreateFilter(ti.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, "Bearer "+ti.token)
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if ti.uid == "" {
+			if !ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to reject")
+			}
+
+			continue
+		}
+
+		if ctx.FServedWithResponse {
+			t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			continue
+		}
+
+		if ctx.StateBag()[authUserKey] != ti.uid {
+			t.Error(ti.msg, "invalid user", ctx.StateBag()[authUserKey])
+		}
+	}
+}
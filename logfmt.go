@@ -0,0 +1,92 @@
+package skoap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+func logfmtField(b *bytes.Buffer, key, value string) {
+	if value == "" {
+		return
+	}
+
+	if b.Len() > 0 {
+		b.WriteByte(' ')
+	}
+
+	b.WriteString(key)
+	b.WriteByte('=')
+	if strings.ContainsAny(value, " =") || strconv.Quote(value) != `"`+value+`"` {
+		b.WriteString(strconv.Quote(value))
+		return
+	}
+
+	b.WriteString(value)
+}
+
+// writes a single audit entry as key=value pairs on a single line,
+// e.g.:
+//
+//     time=2017-01-01T00:00:00Z method=GET path=/foo status=401 user=jdoe rejected=true reason=invalid-scope
+//
+// Empty fields are omitted, and the values containing spaces or
+// special characters are quoted.
+func writeLogfmt(w io.Writer, doc *auditDoc) error {
+	var b bytes.Buffer
+	logfmtField(&b, "time", doc.Timestamp)
+	if doc.Seq != 0 {
+		logfmtField(&b, "seq", fmt.Sprint(doc.Seq))
+	}
+
+	logfmtField(&b, "phase", doc.Phase)
+	logfmtField(&b, "method", doc.Method)
+	logfmtField(&b, "path", doc.Path)
+	if doc.Status != 0 {
+		logfmtField(&b, "status", fmt.Sprint(doc.Status))
+	}
+
+	logfmtField(&b, "clientIP", doc.ClientIP)
+	if doc.RequestBytes != nil {
+		logfmtField(&b, "requestBytes", fmt.Sprint(*doc.RequestBytes))
+	}
+
+	if doc.ResponseBytes != nil {
+		logfmtField(&b, "responseBytes", fmt.Sprint(*doc.ResponseBytes))
+	}
+
+	for _, t := range []struct {
+		key string
+		ms  float64
+	}{{"authMs", doc.AuthMs}, {"teamMs", doc.TeamMs}, {"serviceMs", doc.ServiceMs}} {
+		if t.ms != 0 {
+			logfmtField(&b, t.key, strconv.FormatFloat(t.ms, 'f', 3, 64))
+		}
+	}
+
+	if s := doc.AuthStatus; s != nil {
+		logfmtField(&b, "user", s.User)
+		logfmtField(&b, "rejected", fmt.Sprint(s.Rejected))
+		logfmtField(&b, "reason", s.Reason)
+		if s.TrustedNetwork {
+			logfmtField(&b, "trustedNetwork", "true")
+		}
+
+		if s.GraceAllowed {
+			logfmtField(&b, "graceAllowed", "true")
+		}
+
+		logfmtField(&b, "matchedScopes", strings.Join(s.MatchedScopes, ","))
+		logfmtField(&b, "matchedTeams", strings.Join(s.MatchedTeams, ","))
+		logfmtField(&b, "observedScopes", strings.Join(s.ObservedScopes, ","))
+	}
+
+	logfmtField(&b, "severity", doc.Severity.String())
+	logfmtField(&b, "tokenFingerprint", doc.TokenFingerprint)
+	logfmtField(&b, "requestBody", doc.RequestBody)
+	b.WriteByte('\n')
+	_, err := w.Write(b.Bytes())
+	return err
+}
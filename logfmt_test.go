@@ -0,0 +1,49 @@
+package skoap
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLogfmt(t *testing.T) {
+	for _, ti := range []struct {
+		msg      string
+		doc      *auditDoc
+		expected string
+	}{{
+		msg:      "request",
+		doc:      &auditDoc{Timestamp: "2017-01-01T00:00:00Z", Method: "GET", Path: "/foo", Status: 200, ClientIP: "10.0.0.1"},
+		expected: "time=2017-01-01T00:00:00Z method=GET path=/foo status=200 clientIP=10.0.0.1\n",
+	}, {
+		msg: "rejected",
+		doc: &auditDoc{
+			Method:     "GET",
+			Path:       "/foo",
+			Status:     401,
+			AuthStatus: &authStatusDoc{User: testUid, Rejected: true, Reason: string(invalidScope)},
+			Severity:   SeverityWarning},
+		expected: "method=GET path=/foo status=401 user=jdoe rejected=true reason=invalid-scope severity=WARNING\n",
+	}, {
+		msg: "authorized with scopes",
+		doc: &auditDoc{
+			Phase:      "end",
+			Method:     "GET",
+			Path:       "/foo",
+			AuthStatus: &authStatusDoc{User: testUid, MatchedScopes: []string{"read", "write"}}},
+		expected: "phase=end method=GET path=/foo user=jdoe rejected=false matchedScopes=read,write\n",
+	}, {
+		msg:      "quoting",
+		doc:      &auditDoc{Method: "POST", Path: "/foo=bar", RequestBody: "a \"b\"\nc"},
+		expected: `method=POST path="/foo=bar" requestBody="a \"b\"\nc"` + "\n",
+	}} {
+		var b bytes.Buffer
+		if err := writeLogfmt(&b, ti.doc); err != nil {
+			t.Error(ti.msg, err)
+			continue
+		}
+
+		if b.String() != ti.expected {
+			t.Errorf("%s: invalid entry: %q, expected: %q", ti.msg, b.String(), ti.expected)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package skoap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type (
+	policyClient struct {
+		client *http.Client
+		url    string
+		cache  *cache
+	}
+
+	policyRequestDoc struct {
+		Uid    string   `json:"uid"`
+		Scopes []string `json:"scopes"`
+		Method string   `json:"method"`
+		Path   string   `json:"path"`
+	}
+
+	policyResponseDoc struct {
+		Allow bool `json:"allow"`
+	}
+)
+
+func newPolicyClient(client *http.Client, url string, ttl time.Duration, now func() time.Time) *policyClient {
+	pc := &policyClient{client: client, url: url}
+	if ttl > 0 {
+		pc.cache = newCache(ttl, now)
+	}
+
+	return pc
+}
+
+// asks the policy service whether the user is allowed to make the
+// request. The decisions are cached by the user, the method and the
+// path, when caching is enabled.
+func (pc *policyClient) allowed(a *authDoc, method, path string) (bool, error) {
+	var key string
+	if pc.cache != nil {
+		key = fmt.Sprintf("%s %s %s", a.Uid, method, path)
+		if allow, ok := pc.cache.get(key); ok {
+			return allow.(bool), nil
+		}
+	}
+
+	b, err := json.Marshal(policyRequestDoc{
+		Uid:    a.Uid,
+		Scopes: a.Scopes,
+		Method: method,
+		Path:   path})
+	if err != nil {
+		return false, err
+	}
+
+	rsp, err := pc.client.Post(pc.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return false, err
+	}
+
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("policy service responded with status %d", rsp.StatusCode)
+	}
+
+	var p policyResponseDoc
+	if err := json.NewDecoder(rsp.Body).Decode(&p); err != nil {
+		return false, err
+	}
+
+	if pc.cache != nil {
+		pc.cache.set(key, p.Allow)
+	}
+
+	return p.Allow, nil
+}
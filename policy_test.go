@@ -0,0 +1,103 @@
+package skoap
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthPolicy(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}, Scopes: []string{"read"}})
+	defer authServer.Close()
+
+	var policyReqs int
+	policyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policyReqs++
+		var p policyRequestDoc
+		if r.Method != "POST" || json.NewDecoder(r.Body).Decode(&p) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case p.Path == "/fail":
+			w.WriteHeader(http.StatusInternalServerError)
+		case p.Uid == testUid && p.Path == "/public" && len(p.Scopes) == 1 && p.Scopes[0] == "read":
+			w.Write([]byte(`{"allow": true}`))
+		default:
+			w.Write([]byte(`{"allow": false}`))
+		}
+	}))
+	defer policyServer.Close()
+
+	if _, err := NewAuthPolicy(authServer.URL, policyServer.URL).CreateFilter([]interface{}{testRealm, "read"}); err == nil {
+		t.Error("failed to fail on invalid args")
+	}
+
+	for _, ti := range []struct {
+		msg        string
+		cacheTTL   time.Duration
+		path       string
+		reason     rejectReason
+		policyReqs int
+	}{{
+		msg:        "allow",
+		path:       "/public",
+		policyReqs: 2,
+	}, {
+		msg:        "deny",
+		path:       "/admin",
+		reason:     policyDenied,
+		policyReqs: 2,
+	}, {
+		msg:        "policy service failure",
+		path:       "/fail",
+		reason:     policyAccess,
+		policyReqs: 2,
+	}, {
+		msg:        "cached allow",
+		cacheTTL:   time.Minute,
+		path:       "/public",
+		policyReqs: 1,
+	}, {
+		msg:        "cached deny",
+		cacheTTL:   time.Minute,
+		path:       "/admin",
+		reason:     policyDenied,
+		policyReqs: 1,
+	}} {
+		policyReqs = 0
+		f, err := NewAuthPolicyWithOptions(Options{
+			AuthUrlBase:    authServer.URL,
+			PolicyUrl:      policyServer.URL,
+			PolicyCacheTTL: ti.cacheTTL}).CreateFilter([]interface{}{testRealm})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			req, err := http.NewRequest("GET", "https://www.example.org"+ti.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Set(authHeaderName, "Bearer "+testToken)
+			ctx := newTestContext(req, nil)
+			f.Request(ctx)
+
+			if ti.reason == "" {
+				if ctx.FServedWithResponse || ctx.StateBag()[authUserKey] != testUid {
+					t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+				}
+			} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+				t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+			}
+		}
+
+		if policyReqs != ti.policyReqs {
+			t.Error(ti.msg, "invalid number of policy requests", policyReqs)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package skoap
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/zalando/skipper/filters"
+)
+
+// QuotaName is the name of the quota filter.
+const QuotaName = "quota"
+
+const (
+	quotaExceeded      rejectReason = "quota-exceeded"
+	quotaServiceAccess rejectReason = "quota-service-access"
+	missingUser        rejectReason = "missing-user"
+)
+
+// QuotaChecker is used by the quota filter to meter the requests of the
+// users. Allowed is called once for every request of an authenticated
+// user, and it is expected to count the request when it is allowed.
+type QuotaChecker interface {
+	Allowed(uid string) (bool, error)
+}
+
+type quota struct {
+	checker QuotaChecker
+}
+
+// NewQuota creates a quota filter specification. The filter needs to be
+// placed after an auth filter in the route, and it checks the quota of
+// the authenticated user with the checker. When the quota is exhausted,
+// the request is rejected with 429 and the quota-exceeded reason. When
+// the checker fails, the request is rejected with 503. Requests without
+// an authenticated user are rejected with 401.
+//
+//     * -> auth("/employees") -> quota() -> "https://www.example.org"
+//
+func NewQuota(c QuotaChecker) filters.Spec {
+	return &quota{checker: c}
+}
+
+func (q *quota) Name() string { return QuotaName }
+
+func (q *quota) CreateFilter(args []interface{}) (filters.Filter, error) {
+	if len(args) != 0 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	return q, nil
+}
+
+func rejectQuota(ctx filters.FilterContext, reason rejectReason, status int) {
+	ctx.StateBag()[authRejectReasonKey] = string(reason)
+	ctx.Serve(&http.Response{StatusCode: status})
+}
+
+func (q *quota) Request(ctx filters.FilterContext) {
+	uid, _ := ctx.StateBag()[authUserKey].(string)
+	if uid == "" {
+		rejectQuota(ctx, missingUser, http.StatusUnauthorized)
+		return
+	}
+
+	allowed, err := q.checker.Allowed(uid)
+	if err != nil {
+		log.Println(err)
+		rejectQuota(ctx, quotaServiceAccess, http.StatusServiceUnavailable)
+		return
+	}
+
+	if !allowed {
+		rejectQuota(ctx, quotaExceeded, http.StatusTooManyRequests)
+	}
+}
+
+func (q *quota) Response(_ filters.FilterContext) {}
@@ -0,0 +1,106 @@
+package skoap
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+type testQuota struct {
+	limit int
+	usage map[string]int
+	err   error
+}
+
+func (q *testQuota) Allowed(uid string) (bool, error) {
+	if q.err != nil {
+		return false, q.err
+	}
+
+	if q.usage[uid] >= q.limit {
+		return false, nil
+	}
+
+	q.usage[uid]++
+	return true, nil
+}
+
+func TestQuota(t *testing.T) {
+	if _, err := NewQuota(&testQuota{}).CreateFilter([]interface{}{"foo"}); err == nil {
+		t.Error("failed to fail on invalid args")
+	}
+
+	for _, ti := range []struct {
+		msg      string
+		checker  *testQuota
+		user     string
+		requests int
+		allowed  int
+		status   int
+		reason   rejectReason
+	}{{
+		msg:      "within quota",
+		checker:  &testQuota{limit: 3, usage: make(map[string]int)},
+		user:     testUid,
+		requests: 3,
+		allowed:  3,
+	}, {
+		msg:      "quota exceeded",
+		checker:  &testQuota{limit: 3, usage: make(map[string]int)},
+		user:     testUid,
+		requests: 5,
+		allowed:  3,
+		status:   http.StatusTooManyRequests,
+		reason:   quotaExceeded,
+	}, {
+		msg:      "no user",
+		checker:  &testQuota{limit: 3, usage: make(map[string]int)},
+		requests: 1,
+		status:   http.StatusUnauthorized,
+		reason:   missingUser,
+	}, {
+		msg:      "checker failure",
+		checker:  &testQuota{err: errors.New("quota service down")},
+		user:     testUid,
+		requests: 1,
+		status:   http.StatusServiceUnavailable,
+		reason:   quotaServiceAccess,
+	}} {
+		f, err := NewQuota(ti.checker).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < ti.requests; i++ {
+			req, err := http.NewRequest("GET", "https://www.example.org", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := newTestContext(req, nil)
+			if ti.user != "" {
+				authorized(ctx, ti.user)
+			}
+
+			f.Request(ctx)
+
+			if i < ti.allowed {
+				if ctx.FServedWithResponse {
+					t.Error(ti.msg, "failed to allow request", i)
+				}
+
+				continue
+			}
+
+			if !ctx.FServedWithResponse ||
+				ctx.FResponse.StatusCode != ti.status ||
+				ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+				t.Error(ti.msg, "failed to reject request", i, ctx.StateBag()[authRejectReasonKey])
+			}
+		}
+
+		if ti.checker.usage[ti.user] != ti.allowed {
+			t.Error(ti.msg, "invalid usage", ti.checker.usage[ti.user])
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package skoap
+
+import "github.com/zalando/skipper/filters"
+
+// Config contains the settings for RegisterAll.
+type Config struct {
+
+	// Auth contains the options shared by the auth, authTeam and
+	// authRole filters. The Name field is ignored, the filters are
+	// registered with their default names.
+	Auth Options
+
+	// AuditLog contains the options of the auditLog filter.
+	AuditLog AuditLogOptions
+
+	// BasicAuthCheck contains the options of the basicAuthCheck
+	// filter.
+	BasicAuthCheck BasicAuthCheckOptions
+}
+
+// RegisterAll creates the auth, authTeam, authRole, basicAuth,
+// basicAuthCheck and auditLog filter specifications from a single
+// configuration, and registers them in the registry. When the policy
+// url is set, it registers the authPolicy filter, too:
+//
+//     RegisterAll(registry, Config{
+//         Auth:     Options{AuthUrlBase: authUrl, TeamUrlBase: teamUrl},
+//         AuditLog: AuditLogOptions{Writer: os.Stderr}})
+//
+// On shutdown, the registered specifications can be closed by passing
+// them to CloseAll.
+func RegisterAll(registry filters.Registry, cfg Config) {
+	o := cfg.Auth
+	o.Name = ""
+
+	registry.Register(NewAuthWithOptions(o))
+	registry.Register(NewAuthTeamWithOptions(o))
+	registry.Register(NewAuthRoleWithOptions(o))
+	if o.PolicyUrl != "" {
+		registry.Register(NewAuthPolicyWithOptions(o))
+	}
+
+	registry.Register(NewBasicAuth())
+	registry.Register(NewBasicAuthCheckWithOptions(cfg.BasicAuthCheck))
+	registry.Register(NewAuditLogWithOptions(cfg.AuditLog))
+}
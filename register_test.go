@@ -0,0 +1,47 @@
+package skoap
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/zalando/skipper/filters"
+)
+
+func TestRegisterAll(t *testing.T) {
+	var b bytes.Buffer
+	fr := make(filters.Registry)
+	RegisterAll(fr, Config{
+		Auth: Options{
+			Name:        "customAuth",
+			AuthUrlBase: "https://auth.example.org",
+			TeamUrlBase: "https://teams.example.org/?uid=",
+			PolicyUrl:   "https://policy.example.org"},
+		AuditLog: AuditLogOptions{Writer: &b}})
+
+	for _, name := range []string{
+		AuthName,
+		AuthTeamName,
+		AuthRoleName,
+		AuthPolicyName,
+		BasicAuthName,
+		BasicAuthCheckName,
+		AuditLogName,
+	} {
+		if _, ok := fr[name]; !ok {
+			t.Error("filter not registered", name)
+		}
+	}
+
+	if len(fr) != 7 {
+		t.Error("unexpected filters registered", len(fr))
+	}
+
+	s, ok := fr[AuthTeamName].(*spec)
+	if !ok {
+		t.Fatal("invalid spec")
+	}
+
+	if s.options.AuthUrlBase != "https://auth.example.org" || s.teamClient.urlBase != "https://teams.example.org/?uid=" {
+		t.Error("failed to apply the options")
+	}
+}
@@ -0,0 +1,67 @@
+package skoap
+
+import "fmt"
+
+// AuditSeverity is the severity of an audit log entry. See
+// AuditLogOptions.Severities.
+type AuditSeverity int
+
+// The severities of the audit log entries, in increasing order.
+const (
+	severityNone AuditSeverity = iota
+	SeverityDebug
+	SeverityInfo
+	SeverityWarning
+	SeverityError
+	SeverityCritical
+)
+
+var severityNames = map[AuditSeverity]string{
+	SeverityDebug:    "DEBUG",
+	SeverityInfo:     "INFO",
+	SeverityWarning:  "WARNING",
+	SeverityError:    "ERROR",
+	SeverityCritical: "CRITICAL",
+}
+
+// the severity in the CEF header, 0-10
+var cefSeverities = map[AuditSeverity]int{
+	SeverityDebug:    1,
+	SeverityInfo:     3,
+	SeverityWarning:  6,
+	SeverityError:    8,
+	SeverityCritical: 10,
+}
+
+func (s AuditSeverity) String() string {
+	return severityNames[s]
+}
+
+func (s AuditSeverity) MarshalText() ([]byte, error) {
+	n, ok := severityNames[s]
+	if !ok {
+		return nil, fmt.Errorf("invalid audit severity: %d", int(s))
+	}
+
+	return []byte(n), nil
+}
+
+func (s *AuditSeverity) UnmarshalText(b []byte) error {
+	for si, n := range severityNames {
+		if n == string(b) {
+			*s = si
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid audit severity: %s", string(b))
+}
+
+// returns the severity of an entry, or severityNone when not configured
+func (o *AuditLogOptions) severity(reason string) AuditSeverity {
+	if s, ok := o.Severities[reason]; ok && reason != "" {
+		return s
+	}
+
+	return o.DefaultSeverity
+}
@@ -0,0 +1,137 @@
+package skoap
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAuditSeverity(t *testing.T) {
+	severities := map[string]AuditSeverity{
+		string(invalidToken):      SeverityInfo,
+		string(authServiceAccess): SeverityError,
+	}
+
+	for _, ti := range []struct {
+		msg             string
+		format          AuditFormat
+		severities      map[string]AuditSeverity
+		defaultSeverity AuditSeverity
+		reason          rejectReason
+		expected        string
+	}{{
+		msg:      "not configured",
+		reason:   invalidToken,
+		expected: "",
+	}, {
+		msg:             "success",
+		severities:      severities,
+		defaultSeverity: SeverityWarning,
+		expected:        "WARNING",
+	}, {
+		msg:             "user error",
+		severities:      severities,
+		defaultSeverity: SeverityWarning,
+		reason:          invalidToken,
+		expected:        "INFO",
+	}, {
+		msg:             "infrastructure error",
+		severities:      severities,
+		defaultSeverity: SeverityWarning,
+		reason:          authServiceAccess,
+		expected:        "ERROR",
+	}, {
+		msg:             "unmapped reason",
+		severities:      severities,
+		defaultSeverity: SeverityWarning,
+		reason:          invalidScope,
+		expected:        "WARNING",
+	}, {
+		msg:        "unmapped reason, no default",
+		severities: severities,
+		reason:     invalidScope,
+		expected:   "",
+	}, {
+		msg:      "CEF, not configured",
+		format:   AuditCEF,
+		reason:   invalidToken,
+		expected: "|6|",
+	}, {
+		msg:        "CEF, mapped",
+		format:     AuditCEF,
+		severities: severities,
+		reason:     authServiceAccess,
+		expected:   "|8|",
+	}, {
+		msg:             "CEF, default",
+		format:          AuditCEF,
+		severities:      severities,
+		defaultSeverity: SeverityCritical,
+		reason:          invalidScope,
+		expected:        "|10|",
+	}} {
+		var b bytes.Buffer
+		f, err := NewAuditLogWithOptions(AuditLogOptions{
+			Writer:          &b,
+			Format:          ti.format,
+			Severities:      ti.severities,
+			DefaultSeverity: ti.defaultSeverity}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org/foo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := newTestContext(req, &http.Response{StatusCode: http.StatusOK})
+		if ti.reason != "" {
+			ctx.StateBag()[authRejectReasonKey] = string(ti.reason)
+		}
+
+		f.Request(ctx)
+		f.Response(ctx)
+
+		if ti.format == AuditCEF {
+			if !strings.Contains(b.String(), ti.expected) {
+				t.Error(ti.msg, "invalid severity", b.String())
+			}
+
+			continue
+		}
+
+		var doc map[string]interface{}
+		if err := json.Unmarshal(b.Bytes(), &doc); err != nil {
+			t.Error(ti.msg, err)
+			continue
+		}
+
+		severity, _ := doc["severity"].(string)
+		if severity != ti.expected {
+			t.Error(ti.msg, "invalid severity", b.String())
+		}
+	}
+}
+
+func TestAuditSeverityText(t *testing.T) {
+	for _, s := range []AuditSeverity{SeverityDebug, SeverityInfo, SeverityWarning, SeverityError, SeverityCritical} {
+		b, err := s.MarshalText()
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		var u AuditSeverity
+		if err := u.UnmarshalText(b); err != nil || u != s {
+			t.Error("failed to unmarshal severity", string(b), u)
+		}
+	}
+
+	var u AuditSeverity
+	if err := u.UnmarshalText([]byte("FATAL")); err == nil {
+		t.Error("failed to fail on invalid severity")
+	}
+}
@@ -1,8 +1,8 @@
 /*
 Package skoap implements authentication extensions for Skipper.
 
-The package contains four filters: auth, authTeam, auditLog and
-basicAuth. For details on how to extend Skipper with additional
+The package contains five filters: auth, authTeam, authRole, auditLog
+and basicAuth. For details on how to extend Skipper with additional
 filters, please see the main Skipper documentation:
 
 https://godoc.org/github.com/zalando/skipper
@@ -14,7 +14,11 @@ assuming that it is a Bearer token, and validates it against the
 configured token validation service.
 
 If the OAuth2 realm is set for the filter, then it checks if the
-user of the token belongs to that realm.
+user of the token belongs to that realm. Further realms can be
+accepted by listing them after the first argument. These need to start
+with a '/'. The token validation service can return either a single
+realm or a list of realms for the user. The realm check succeeds if any
+of the realms of the user is accepted.
 
 If the OAuth2 scopes are set for the filter, then it checks if the
 user of the token has at least one of the configured scopes assigned.
@@ -27,6 +31,25 @@ get the teams of the user, the filter makes an additional request,
 with the available authorization token, to a configured team API
 endpoint.
 
+Filter authRole
+
+The authRole filter works exactly the same as the auth filter, but
+instead of the scopes, it checks the roles of the user returned by the
+token validation service in the 'roles' field. This is useful when the
+identity provider carries the authorization in roles, or when it
+carries both scopes and roles, and a route needs to check the roles.
+
+	* -> authRole("/employees", "admin", "operator") -> "https://www.example.org"
+
+Filter authPolicy
+
+The authPolicy filter validates the token and the realm the same way as
+the auth filter, but instead of static scopes, it sends the user id, the
+scopes, and the method and the path of the request to a policy service,
+and forwards the request only if the policy service allows it.
+
+	* -> authPolicy("/employees") -> "https://www.example.org"
+
 Authentication examples
 
 To check only the scopes or the teams, the first argument of the
@@ -47,6 +70,11 @@ assigned:
 
 	* -> auth("/employees", "read-zmon", "read-stups") -> "https://www.example.org"
 
+Check if the request has a valid authentication token, and the user of
+the token belongs to one of the realms:
+
+	* -> auth("/employees", "/contractors", "read-zmon") -> "https://www.example.org"
+
 Check if the request has a valid authentication token, the user of
 the token belongs to a realm and belongs to one of the specified teams:
 
@@ -72,6 +100,26 @@ Example:
 
 	* -> basicAuth("username", "pwd") -> "https://www.example.org"
 
+Quota
+
+The quota filter rejects the requests of the authenticated users, whose
+quota is exhausted, with 429 Too Many Requests. The quota is checked
+with a QuotaChecker provided by the application. See NewQuota.
+
+Example:
+
+	* -> auth() -> quota() -> "https://www.example.org"
+
+Concurrency limit
+
+The concurrencyLimit filter limits the number of the in-flight requests
+of an authenticated user, and rejects the requests above the limit with
+429 Too Many Requests.
+
+Example:
+
+	* -> auth() -> concurrencyLimit(3) -> "https://www.example.org"
+
 Audit log
 
 The auditLog filter prints the request method and path, and the response
@@ -87,6 +135,13 @@ Since the body is logged withing the same log entry as the other values,
 the logged part of the body is buffered until it is written to the output.
 With large or infinite limit, this can have performance implications.
 
+The filter can be configured to log only the requests rejected by an
+auth filter. See AuditLogOptions.
+
+Besides JSON, the audit log entries can be written in the Common Event
+Format (CEF), when the filter specification is created with the
+AuditCEF format. See NewAuditLogWithOptions.
+
 Example:
 
 	* -> auditLog(1024) -> auth() -> "https://www.example.org"
@@ -95,25 +150,55 @@ package skoap
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/linki/ttlcache"
-
 	"github.com/zalando/skipper/filters"
 )
 
 const (
-	authHeaderName      = "Authorization"
-	authUserKey         = "auth-user"
-	authRejectReasonKey = "auth-reject-reason"
+	authHeaderName       = "Authorization"
+	teamsHeaderName      = "X-Authenticated-Teams"
+	authUserKey          = "auth-user"
+	authRejectReasonKey  = "auth-reject-reason"
+	authTrustedKey       = "auth-trusted-network"
+	authMatchedScopesKey = "auth-matched-scopes"
+	authMatchedTeamsKey  = "auth-matched-teams"
+	authObservedKey      = "auth-observed-scopes"
+	auditFingerprintKey  = "audit-token-fingerprint"
+	authGraceReasonKey   = "auth-grace-reason"
+	authSourceKey        = "auth-source"
+	authRealmKey         = "auth-realm"
+	issuedAtClaim        = "iat"
+
+	debugAuditHeaderName       = "X-Debug-Audit"
+	debugAuditSecretHeaderName = "X-Debug-Audit-Secret"
+	debugAuditFull             = "full"
+
+	auditPhaseStart = "start"
+	auditPhaseEnd   = "end"
+
+	// separates the realms from the rest of the filter arguments
+	argsSeparator = "--"
 )
 
 type roleCheckType int
@@ -121,403 +206,3151 @@ type roleCheckType int
 const (
 	checkScope roleCheckType = iota
 	checkTeam
+	checkRole
+	checkPolicy
 )
 
 type rejectReason string
 
 const (
-	missingBearerToken rejectReason = "missing-bearer-token"
-	authServiceAccess  rejectReason = "auth-service-access"
-	invalidToken       rejectReason = "invalid-token"
-	invalidRealm       rejectReason = "invalid-realm"
-	invalidScope       rejectReason = "invalid-scope"
-	teamServiceAccess  rejectReason = "team-service-access"
-	invalidTeam        rejectReason = "invalid-team"
+	missingBearerToken  rejectReason = "missing-bearer-token"
+	authServiceAccess   rejectReason = "auth-service-access"
+	invalidToken        rejectReason = "invalid-token"
+	invalidRealm        rejectReason = "invalid-realm"
+	invalidScope        rejectReason = "invalid-scope"
+	teamServiceAccess   rejectReason = "team-service-access"
+	invalidTeam         rejectReason = "invalid-team"
+	tokenRevoked        rejectReason = "token-revoked"
+	invalidRole         rejectReason = "invalid-role"
+	certIdentity        rejectReason = "cert-identity-mismatch"
+	authServiceFormat   rejectReason = "auth-service-malformed-response"
+	wrongTokenType      rejectReason = "wrong-token-type"
+	deniedScope         rejectReason = "denied-scope"
+	policyDenied        rejectReason = "policy-denied"
+	policyAccess        rejectReason = "policy-service-access"
+	missingUid          rejectReason = "missing-uid"
+	blockedRealm        rejectReason = "blocked-realm"
+	missingClaim        rejectReason = "missing-claim"
+	csrfCheck           rejectReason = "csrf-check-failed"
+	untrustedProxy      rejectReason = "untrusted-proxy"
+	geoBlocked          rejectReason = "geo-blocked"
+	requestTooLarge     rejectReason = "request-too-large"
+	originNotAllowed    rejectReason = "origin-not-allowed"
+	missingScopeField   rejectReason = "missing-scope-field"
+	tenantMismatch      rejectReason = "tenant-mismatch"
+	notResourceOwner    rejectReason = "not-resource-owner"
+	bindingMismatch     rejectReason = "token-binding-mismatch"
+	tokenTooOld         rejectReason = "token-too-old"
+	scopeRealmViolation rejectReason = "scope-realm-violation"
+	impersonation       rejectReason = "impersonation-not-allowed"
+	methodNotPermitted  rejectReason = "method-not-permitted"
 )
 
+// the messages used in the JSON error responses, when not overridden
+// by Options.RejectMessages
+var defaultRejectMessages = map[rejectReason]string{
+	missingBearerToken:  "The request doesn't contain a bearer token.",
+	authServiceAccess:   "The token could not be validated.",
+	invalidToken:        "The token is invalid.",
+	invalidRealm:        "The user of the token doesn't belong to an accepted realm.",
+	invalidScope:        "The token doesn't have the required scopes.",
+	teamServiceAccess:   "The teams of the user could not be checked.",
+	invalidTeam:         "The user of the token isn't a member of the required teams.",
+	tokenRevoked:        "The token was revoked.",
+	invalidRole:         "The user of the token doesn't have the required roles.",
+	certIdentity:        "The client certificate doesn't match the user of the token.",
+	authServiceFormat:   "The token could not be validated.",
+	wrongTokenType:      "The token is of the wrong type.",
+	deniedScope:         "The token has a scope that denies the access.",
+	policyDenied:        "The request was denied by the policy.",
+	policyAccess:        "The policy could not be checked.",
+	missingUid:          "The token doesn't identify a user.",
+	blockedRealm:        "The realm of the token is blocked.",
+	missingClaim:        "The token doesn't have the required claims.",
+	csrfCheck:           "The request doesn't have the required headers.",
+	untrustedProxy:      "The request was not forwarded by a trusted proxy.",
+	geoBlocked:          "The request is not allowed from this location.",
+	requestTooLarge:     "The request body is too large.",
+	originNotAllowed:    "The origin of the request is not allowed.",
+	missingScopeField:   "The token validation didn't return the scopes.",
+	tenantMismatch:      "The token doesn't have the required scopes for this host.",
+	notResourceOwner:    "The user of the token doesn't own the requested resource.",
+	bindingMismatch:     "The token is not bound to the session.",
+	tokenTooOld:         "The token needs to be issued again.",
+	scopeRealmViolation: "The token has scopes that its realm can't grant.",
+	impersonation:       "The token doesn't allow acting on behalf of another user.",
+	methodNotPermitted:  "The scopes of the token don't permit the request method.",
+}
+
 const (
-	AuthName      = "auth"
-	AuthTeamName  = "authTeam"
-	BasicAuthName = "basicAuth"
-	AuditLogName  = "auditLog"
+	AuthName       = "auth"
+	AuthTeamName   = "authTeam"
+	AuthRoleName   = "authRole"
+	AuthPolicyName = "authPolicy"
+	BasicAuthName  = "basicAuth"
+	AuditLogName   = "auditLog"
 )
 
 type (
-	authClient struct{ urlBase string }
+	authClient struct {
+		client         *http.Client
+		urlBase        string
+		strict         bool
+		scopeClaim     string
+		claims         []string
+		noClaimsStatus int
+		cache          *cache
+		slowCall       time.Duration
+		latency        *latencyRing
+		flights        *flightGroup
+		errorField     string
+		errorValue     string
+		local          *LocalTokenStore
+		localFallback  bool
+		introspection  bool
+		clientId       string
+		clientSecret   string
+
+		// the host of the token validation service, when recorded
+		source string
+
+		// called when a cached validation result is replaced
+		refreshed func(previous, current *authDoc)
+	}
 	teamClient struct {
-		urlBase string
-		cache   *ttlcache.Cache
+		client          *http.Client
+		urlBase         string
+		cache           *cache
+		slowCall        time.Duration
+		maxPages        int
+		failOnPageLimit bool
 	}
 
 	authDoc struct {
 		Uid    string   `json:"uid"`
-		Realm  string   `json:"realm"`
+		Realm  realms   `json:"realm"`
 		Scopes []string `json:"scope"` // TODO: verify this with service2service authentication
+		Jti    string   `json:"jti"`
+		Roles  []string `json:"roles"`
+
+		TokenType string `json:"token_type"`
+		Typ       string `json:"typ"`
+
+		// the custom claims used by the filters, when configured
+		Claims map[string]json.RawMessage `json:"-"`
 	}
 
+	// the token validation service can return a single realm as a
+	// string, or multiple realms as a list
+	realms []string
+
 	teamDoc struct {
 		Id string `json:"id"`
 	}
 
 	spec struct {
-		typ        roleCheckType
-		authClient *authClient
-		teamClient *teamClient
+		typ          roleCheckType
+		options      Options
+		authClient   *authClient
+		teamClient   *teamClient
+		policyClient *policyClient
+		userInfo     *userInfoClient
+		trustedNets  []*net.IPNet
+		proxyNets    []*net.IPNet
+		ownerPath    *regexp.Regexp
+		optionsErr   error
+		reaper       *reaper
 	}
 
 	filter struct {
-		typ        roleCheckType
-		authClient *authClient
-		teamClient *teamClient
-		realm      string
-		args       []string
+		typ          roleCheckType
+		options      *Options
+		authClient   *authClient
+		teamClient   *teamClient
+		policyClient *policyClient
+		userInfo     *userInfoClient
+		realms       []string
+		args         []string
+
+		trustedNets []*net.IPNet
+		proxyNets   []*net.IPNet
+		ownerPath   *regexp.Regexp
+
+		// set when there is nothing else to check than the validity of
+		// the token
+		validateOnly bool
 	}
 
 	basic string
 
 	auditLog struct {
-		writer     io.Writer
+		options    *AuditLogOptions
 		maxBodyLog int
+		async      *asyncAudit
 	}
 
 	teeBody struct {
-		body      io.ReadCloser
-		buffer    *bytes.Buffer
-		teeReader io.Reader
-		maxTee    int
+		mu     sync.Mutex
+		body   io.ReadCloser
+		buffer *bytes.Buffer
+		maxTee int
+		read   bool
+		closed bool
 	}
 
 	authStatusDoc struct {
 		User     string `json:"user,omitempty"`
 		Rejected bool   `json:"rejected"`
 		Reason   string `json:"reason,omitempty"`
+
+		// set when the request was authorized based on its source
+		// network, without token validation
+		TrustedNetwork bool `json:"trustedNetwork,omitempty"`
+
+		// the scopes of the filter that the token was authorized with
+		MatchedScopes []string `json:"matchedScopes,omitempty"`
+
+		// the teams of the filter that the user was authorized with
+		MatchedTeams []string `json:"matchedTeams,omitempty"`
+
+		// the Options.ObservedScopes that the token has
+		ObservedScopes []string `json:"observedScopes,omitempty"`
+
+		// set when the request would have been rejected with Reason,
+		// but was let through, because of its user agent
+		GraceAllowed bool `json:"graceAllowed,omitempty"`
+
+		// the host of the token validation service that validated the
+		// token, when Options.RecordAuthSource is set
+		AuthSource string `json:"authSource,omitempty"`
+
+		// the comma separated realms of the token. Nil when the token
+		// validation service didn't return the realm field, and empty
+		// when it returned an empty realm.
+		Realm *string `json:"realm,omitempty"`
+	}
+
+	errorDoc struct {
+		Error   string `json:"error"`
+		Message string `json:"message,omitempty"`
+	}
+
+	problemDoc struct {
+		Type   string `json:"type"`
+		Title  string `json:"title"`
+		Status int    `json:"status"`
+		Detail string `json:"detail,omitempty"`
 	}
 
 	auditDoc struct {
+		Timestamp   string         `json:"timestamp,omitempty"`
+		Seq         uint64         `json:"seq,omitempty"`
+		Phase       string         `json:"phase,omitempty"`
 		Method      string         `json:"method"`
 		Path        string         `json:"path"`
-		Status      int            `json:"status"`
+		Status      int            `json:"status,omitempty"`
 		AuthStatus  *authStatusDoc `json:"authStatus,omitempty"`
 		RequestBody string         `json:"requestBody,omitempty"`
+		Severity    AuditSeverity  `json:"severity,omitempty"`
+
+		TokenFingerprint string `json:"tokenFingerprint,omitempty"`
+
+		// the bytes read from the request body, and written to the
+		// response, when AuditLogOptions.RecordSizes is set
+		RequestBytes  *int64 `json:"requestBytes,omitempty"`
+		ResponseBytes *int64 `json:"responseBytes,omitempty"`
+
+		// the durations of the upstream calls in milliseconds, when
+		// AuditLogOptions.RecordTimings is set
+		AuthMs    float64 `json:"authMs,omitempty"`
+		TeamMs    float64 `json:"teamMs,omitempty"`
+		ServiceMs float64 `json:"serviceMs,omitempty"`
+
+		// used only by the CEF and the logfmt formats
+		ClientIP string `json:"-"`
 	}
 )
 
-var (
-	errInvalidAuthorizationHeader = errors.New("invalid authorization header")
-	errInvalidToken               = errors.New("invalid token")
-)
+// AuditFormat tells the output format of the audit log entries.
+type AuditFormat int
 
-func getToken(r *http.Request) (string, error) {
-	const b = "Bearer "
-	h := r.Header.Get(authHeaderName)
-	if !strings.HasPrefix(h, b) {
-		return "", errInvalidAuthorizationHeader
-	}
+const (
 
-	return h[len(b):], nil
+	// AuditJSON writes the audit log entries as JSON documents, one
+	// per line. This is the default.
+	AuditJSON AuditFormat = iota
+
+	// AuditCEF writes the audit log entries in the Common Event Format
+	// (CEF), one per line, e.g. for feeding them into a SIEM.
+	AuditCEF
+
+	// AuditLogfmt writes the audit log entries as key=value pairs, one
+	// per line, e.g. for reading them on the console.
+	AuditLogfmt
+)
+
+// AuditSink is an additional destination of the audit log entries,
+// with its own format.
+type AuditSink struct {
+	Writer io.Writer
+	Format AuditFormat
 }
 
-func unauthorized(ctx filters.FilterContext, uname string, reason rejectReason) {
-	ctx.StateBag()[authUserKey] = uname
-	ctx.StateBag()[authRejectReasonKey] = string(reason)
-	ctx.Serve(&http.Response{StatusCode: http.StatusUnauthorized})
+// AuditLogOptions contains the settings of the auditLog filter
+// specification created with NewAuditLogWithOptions.
+type AuditLogOptions struct {
+
+	// Writer receives the audit log entries.
+	Writer io.Writer
+
+	// Format of the audit log entries. Defaults to AuditJSON.
+	Format AuditFormat
+
+	// Sinks, when set, lists additional writers receiving the same
+	// audit log entries, each in its own format, e.g. logfmt to
+	// stderr and JSON to a file. When Writer is not set, the entries
+	// are written only to the sinks.
+	Sinks []AuditSink
+
+	// FieldNames, when set, renames the top level fields of the JSON
+	// entries, e.g. method: http_method, to match the schema of the
+	// log processing. The fields not in the map keep their default
+	// names. When set, the fields of the entries are written in
+	// alphabetical order.
+	FieldNames map[string]string
+
+	// RejectedOnly, when set, makes the filter write entries only for
+	// the requests rejected by an auth filter, including the ones let
+	// through for the Options.GraceUserAgents.
+	RejectedOnly bool
+
+	// DebugSecret, when set, allows trusted clients to log the
+	// complete body of a single request, regardless of the configured
+	// limit, by sending the X-Debug-Audit: full header together with
+	// the secret in the X-Debug-Audit-Secret header. Both headers are
+	// removed from the request before it is forwarded.
+	DebugSecret string
+
+	// LogCurrentRequest, when set, makes the filter log the method and
+	// the path of the request as forwarded to the backend, instead of
+	// the original incoming request. When the original request is not
+	// available, e.g. with shadow traffic, the current request is
+	// logged regardless of this setting.
+	LogCurrentRequest bool
+
+	// Severities, when set, maps the reject reasons, e.g.
+	// auth-service-access, to the severity written in the severity
+	// field of the entries. In the CEF format, it sets the severity
+	// in the header. The entries of the requests that were not
+	// rejected, or rejected with an unmapped reason, get the
+	// DefaultSeverity.
+	Severities map[string]AuditSeverity
+
+	// DefaultSeverity is the severity of the entries not covered by
+	// Severities. When neither is set, the entries don't have a
+	// severity field.
+	DefaultSeverity AuditSeverity
+
+	// TokenFingerprint, when set, makes the filter log the first 8 hex
+	// digits of the SHA-256 hash of the bearer token, in the
+	// tokenFingerprint field, to correlate the requests made with the
+	// same token. The token itself is never logged. Only in the JSON
+	// format.
+	TokenFingerprint bool
+
+	// Sequence, when set, makes the filter number the entries in the
+	// seq field, with a counter increasing monotonically in the
+	// process, shared by all the auditLog filters. Together with the
+	// timestamp field, it allows to reconstruct the exact order of
+	// the entries.
+	Sequence bool
+
+	// PhaseEntries, when set, makes the filter write an entry when the
+	// request arrives, marked with the start phase, and another one,
+	// marked with the end phase, when the response is handled. This
+	// way the long running requests, e.g. long polling or streaming
+	// ones, are visible in the audit log while in progress. The start
+	// entries contain only the request, because the auth filters
+	// haven't run yet. They are not written with RejectedOnly.
+	PhaseEntries bool
+
+	// NormalizePath, when set, makes the filter log the request paths
+	// cleaned, without the trailing slash and with the dot segments
+	// resolved, e.g. /orders/ and /orders/./ are both logged as
+	// /orders, to make aggregating the entries easier. It doesn't
+	// change the path of the forwarded request.
+	NormalizePath bool
+
+	// AsyncBuffer, when set, makes the filter queue the entries in a
+	// buffer of this size, and write them from a background goroutine,
+	// instead of writing them on the request path. The queued entries
+	// are written when the specification is closed. See
+	// NewAuditLogWithOptions.
+	AsyncBuffer int
+
+	// DropWhenFull, when set, makes the filter drop the entries when
+	// the AsyncBuffer is full, instead of waiting for free space. The
+	// number of the dropped entries is logged when the specification
+	// is closed.
+	DropWhenFull bool
+
+	// RecordSizes, when set, makes the filter record the number of
+	// bytes read from the request body and written to the response
+	// body, independent of the logged body. To count the response
+	// bytes, the entry is written only when the response body was
+	// copied to the client. The start entries of PhaseEntries don't
+	// contain the sizes.
+	RecordSizes bool
+
+	// RecordTimings, when set, makes the filter record the durations of
+	// the calls made for the request, in milliseconds: authMs for the
+	// token validation, teamMs for the team service, and serviceMs for
+	// the backend, measured from when the auth filter let the request
+	// through until the response arrived. The calls served from the
+	// caches are recorded, too. The auditLog filter needs to be placed
+	// before the auth filter in the route.
+	RecordTimings bool
 }
 
-func authorized(ctx filters.FilterContext, uname string) {
-	ctx.StateBag()["auth-user"] = uname
+// Options contains the settings of the auth, authTeam and authRole
+// filter specifications created with NewAuthWithOptions,
+// NewAuthTeamWithOptions and NewAuthRoleWithOptions.
+type Options struct {
+
+	// Name, when set, overrides the name of the filter. It can be used
+	// to register variants of the same filter with different options,
+	// e.g. a variant with BypassCache for the sensitive routes.
+	Name string
+
+	// AuthUrlBase is the url of the token validation service. See
+	// NewAuth.
+	AuthUrlBase string
+
+	// TeamUrlBase is the url of the team service. It is used only by
+	// the authTeam filter. See NewAuthTeam.
+	TeamUrlBase string
+
+	// PathScopes defines the required scopes based on the path of the
+	// incoming request. The rules are evaluated in order, and the first
+	// one matching the path wins. When no rule matches, the scopes
+	// from the filter arguments are checked. Used only by the auth
+	// and the authRole filter, where the rules define the required
+	// roles.
+	PathScopes []PathScope
+
+	// HostScopes, when set, qualifies the required scopes with a
+	// tenant prefix based on the Host header of the request, e.g. on
+	// a.example.org, the read scope is granted only by the
+	// tenant-a.read scope of the token. The rules are evaluated in
+	// order, and the first one matching the host, without the port,
+	// wins. When no rule matches, the scopes are checked unqualified.
+	// Tokens without the qualified scopes are rejected with the
+	// tenant-mismatch reason. Used only by the auth filter, and not
+	// together with ScopeRealmSeparator.
+	HostScopes []HostScope
+
+	// OwnerPath, when set, is a path template with a single
+	// placeholder, e.g. /users/{id}, that restricts the access to the
+	// owner of the resource: the requests with a matching path, or
+	// with a path under it, are allowed only when the user id of the
+	// token equals the path segment of the placeholder. Otherwise,
+	// they are rejected with the not-resource-owner reason. Requests
+	// with other paths are not affected. See OwnerBypassScopes.
+	OwnerPath string
+
+	// OwnerBypassScopes, when set, lists the scopes that grant access
+	// to the resources of any user, e.g. admin. Used only with
+	// OwnerPath.
+	OwnerBypassScopes []string
+
+	// BindingCookie, when set, is the name of the session cookie that
+	// the tokens can be bound to. When the response of the token
+	// validation service contains the BindingClaim, the request needs
+	// to have the cookie, and the base64url encoded SHA-256 hash of
+	// its value needs to equal the claim. Otherwise, the request is
+	// rejected with the token-binding-mismatch reason. Tokens without
+	// the claim are not checked.
+	BindingCookie string
+
+	// BindingClaim is the name of the claim containing the hash of the
+	// session cookie. Defaults to DefaultBindingClaim.
+	BindingClaim string
+
+	// RevokedTokens, when set, is used as a denylist of tokens. It is
+	// called before the validation with the hex encoded SHA-256 hash
+	// of the incoming token, and after the validation with the jti
+	// claim of the token, when the token validation service returns
+	// one. When it returns true, the request is rejected. See
+	// FileDenylist.
+	RevokedTokens func(id string) bool
+
+	// RequireCertIdentity, when set, requires that the incoming
+	// connection uses a TLS client certificate, whose subject common
+	// name, or one of its DNS or email subject alternative names
+	// matches the user id of the token. Otherwise, the request is
+	// rejected.
+	RequireCertIdentity bool
+
+	// CertIdentity, when set, maps the user id of the token to the
+	// identity expected in the client certificate. Used only with
+	// RequireCertIdentity.
+	CertIdentity func(uid string) string
+
+	// DefaultScopes, when set, are checked on every route, in addition
+	// to the scopes configured for the filter. The token needs to have
+	// at least one of them assigned. See DefaultScopePolicy.
+	DefaultScopes []string
+
+	// DefaultScopePolicy tells how the default scopes are combined
+	// with the scopes of the auth filter. With the authTeam and
+	// authRole filters, the default scopes are always required in
+	// addition to the teams or roles.
+	DefaultScopePolicy DefaultScopePolicy
+
+	// BodyToken, when set, is used to extract the token from the
+	// request body, when the request doesn't have a bearer token in
+	// the Authorization header. When the expression has a
+	// parenthesized subexpression, the first one is used as the token,
+	// otherwise the whole match. The body is buffered only up to
+	// MaxBodyTokenBytes, and it is passed on to the backend intact.
+	BodyToken *regexp.Regexp
+
+	// BodyTokenContentTypes limits the token extraction from the body
+	// to the requests with the listed media types, e.g. text/xml. When
+	// empty, the token is looked up in the body regardless of the
+	// content type.
+	BodyTokenContentTypes []string
+
+	// MaxBodyTokenBytes is the maximum number of bytes of the body
+	// searched for the token. Defaults to DefaultMaxBodyTokenBytes.
+	MaxBodyTokenBytes int
+
+	// TokenCookie, when set, is the name of the cookie that the token
+	// is taken from, when the request doesn't have a bearer token in
+	// the Authorization header. Used for browser-facing routes. See
+	// TokenSources.
+	TokenCookie string
+
+	// TokenQueryParam, when set, is the name of the query parameter
+	// that the token is taken from, when the request doesn't have a
+	// bearer token in the Authorization header. See TokenSources.
+	TokenQueryParam string
+
+	// TokenSources, when set, is the order in which the token is
+	// looked up in its sources, e.g. header, then cookie, then query.
+	// Only the listed sources are used, and from them, only the ones
+	// that are configured. Defaults to DefaultTokenSources.
+	TokenSources []TokenSource
+
+	// RequireHeader, when set, lists the headers that the requests
+	// with the token taken from the TokenCookie need to have, with the
+	// specified values, e.g. X-Requested-With: XMLHttpRequest. An
+	// empty value accepts any non-empty header. Since browsers don't
+	// set custom headers on cross-origin requests without a CORS
+	// preflight, this protects the cookie authenticated routes against
+	// CSRF. Requests without them are rejected with the
+	// csrf-check-failed reason, before the token is validated.
+	RequireHeader map[string]string
+
+	// StrictDecoding, when set, makes the filters reject the responses
+	// of the token validation service that contain unknown fields or
+	// trailing data after the JSON document. These requests are
+	// rejected with the auth-service-malformed-response reason.
+	StrictDecoding bool
+
+	// RequireTokenType, when set, requires that the token validation
+	// service returns the token type in the token_type or the typ
+	// field, and it matches the configured value, e.g. access. The
+	// comparison is case insensitive. Tokens of other types are
+	// rejected with the wrong-token-type reason.
+	RequireTokenType string
+
+	// ForwardTeams, when set, makes the authTeam filter set the
+	// X-Authenticated-Teams header of the outgoing request to the
+	// comma separated list of the configured teams that the user is a
+	// member of. The teams are listed in the order of the filter
+	// arguments, this way the arguments can express priority. The
+	// header received from the client is always dropped.
+	ForwardTeams bool
+
+	// AuthCacheTTL, when set, enables caching the successful token
+	// validations for the configured duration. The cache is keyed by
+	// the hash of the token. Rejected tokens are not cached. When the
+	// token validation service responds with a Cache-Control header,
+	// its max-age is used when shorter than AuthCacheTTL, and the
+	// responses with no-store or no-cache are not cached.
+	AuthCacheTTL time.Duration
+
+	// MaxCacheAge, when set, is the maximum age of the cached token
+	// validations, regardless of their TTL. Older entries are treated
+	// as misses, and the token is validated again. Meant as an upper
+	// bound of the staleness for sensitive deployments.
+	MaxCacheAge time.Duration
+
+	// CacheReapInterval, when set, starts a background goroutine that
+	// evicts the expired entries of the caches at the configured
+	// interval, instead of only when they are accessed, to release the
+	// memory held by the entries not accessed anymore. The evictions
+	// are counted in the cache statistics. The goroutine is stopped by
+	// closing the specification.
+	CacheReapInterval time.Duration
+
+	// RecordAuthSource, when set, makes the filters record the host of
+	// the token validation service that validated the token, without
+	// the path and the query, and the audit log contains it in the
+	// authSource field, e.g. for debugging federated setups.
+	RecordAuthSource bool
+
+	// MaxTokenLifetime, when set, is the maximum age of the tokens,
+	// based on the iat claim returned by the token validation service,
+	// regardless of their expiry. Older tokens are rejected with the
+	// token-too-old reason, to enforce that they are issued again.
+	// Tokens without the iat claim are not checked.
+	MaxTokenLifetime time.Duration
+
+	// DecisionLogger, when set, receives the authorization decision
+	// of every request, allowed or rejected, independent of whether
+	// the route has an auditLog filter. It is called synchronously,
+	// from the request path.
+	DecisionLogger DecisionLogger
+
+	// RealmScopes, when set, lists the scopes that each realm is
+	// allowed to grant, e.g. /services: [read, write], as a defense
+	// against a misconfigured identity provider. Tokens with a scope
+	// that none of their realms allows are rejected with the
+	// scope-realm-violation reason. The realms not in the map are
+	// ignored, and the tokens without any realm in the map are not
+	// checked.
+	RealmScopes map[string][]string
+
+	// OnBehalfOfHeader, when set, is the name of a request header, e.g.
+	// X-On-Behalf-Of, in which the callers can tell the user that they
+	// act for. When the request has the header, its value needs to
+	// equal the user id of the token, unless the token has one of the
+	// ImpersonationScopes. Otherwise, the request is rejected with the
+	// impersonation-not-allowed reason.
+	OnBehalfOfHeader string
+
+	// ImpersonationScopes lists the scopes that allow acting on behalf
+	// of any user. Used only with OnBehalfOfHeader.
+	ImpersonationScopes []string
+
+	// LocalTokenStore, when set, is used to validate the tokens without
+	// calling the token validation service. The tokens missing from the
+	// store are rejected as invalid, unless LocalStoreFallback is set.
+	LocalTokenStore *LocalTokenStore
+
+	// LocalStoreFallback tells to validate the tokens missing from the
+	// LocalTokenStore with the token validation service.
+	LocalStoreFallback bool
+
+	// StripHeaders lists the request headers that the auth filters drop
+	// from every request, before setting their own headers, so that the
+	// clients can't spoof the headers that the backends may trust.
+	// Defaults to DefaultStripHeaders. To disable stripping, set it to
+	// an empty, non-nil list.
+	StripHeaders []string
+
+	// Introspection, when set, makes the filters validate the tokens
+	// with an RFC 7662 token introspection endpoint at AuthUrlBase. The
+	// token is posted in the request body, and it is accepted when the
+	// response has the active field set. The user id is taken from the
+	// username or the sub field, the scopes from the space separated
+	// scope field, and the realms from the non-standard realm field.
+	// ScopeClaim and StrictDecoding are not used in this mode.
+	Introspection bool
+
+	// ClientId and ClientSecret are the credentials that the filters
+	// authenticate with to the introspection endpoint, using basic
+	// authorization. Used only with Introspection.
+	ClientId     string
+	ClientSecret string
+
+	// UserInfoUrl, when set, is the url of an OIDC userinfo endpoint.
+	// When the token validation service returns no scopes for a token,
+	// the filters fetch them from this endpoint, with the token set as
+	// the Authorization Bearer header. The scope field of the response
+	// can be a space separated string or a list.
+	UserInfoUrl string
+
+	// UserInfoCacheTTL is the time for which the scopes received from
+	// the userinfo endpoint are cached. Defaults to
+	// DefaultUserInfoCacheTTL.
+	UserInfoCacheTTL time.Duration
+
+	// ScopeMethods, when set, maps scopes to the request methods that
+	// they permit, e.g. reader to GET and HEAD, while * permits every
+	// method. The method of the request needs to be permitted by at
+	// least one scope of the token, otherwise the request is rejected
+	// with the method-not-permitted reason. It is checked in addition
+	// to the scopes in the filter arguments.
+	ScopeMethods map[string][]string
+
+	// CoalesceValidations, when set, makes the concurrent validations
+	// of the same token share a single call to the token validation
+	// service, e.g. during a burst of requests when the cache is cold.
+	// The requests waiting for the pending call receive its result.
+	CoalesceValidations bool
+
+	// ErrorField, when set, is a field in the successful responses of
+	// the token validation service that signals an invalid token, e.g.
+	// error, for the services that respond with 200 and an error
+	// document. When the response contains the field, the request is
+	// rejected with the invalid-token reason, and the response is not
+	// cached. See ErrorValue.
+	ErrorField string
+
+	// ErrorValue, when set, is the value of the ErrorField that
+	// signals an invalid token, e.g. invalid_token. String values are
+	// compared by their value, other values by their JSON
+	// representation. When not set, any value other than null or an
+	// empty string is treated as an error.
+	ErrorValue string
+
+	// BypassCache, when set, makes the filters validate the token with
+	// the token validation service on every request, ignoring the
+	// cached validation results. Useful for the sensitive routes that
+	// need to pick up revocations immediately.
+	BypassCache bool
+
+	// ScopeClaim, when set, tells the name of the field in the
+	// response of the token validation service, that contains the
+	// scopes of the token, as a JSON array. It can be any key,
+	// including namespaced claims like https://example.org/scopes.
+	// When the response doesn't contain the claim, the scopes are
+	// taken from the scope field.
+	ScopeClaim string
+
+	// TrustedCIDRs, when set, lists the networks, e.g. 10.0.0.0/8,
+	// from which the requests are authorized without a token. These
+	// requests skip the token validation and all the other checks, and
+	// they are authorized as TrustedIdentity. The client address is
+	// taken from the connection, not from the request headers. The
+	// audit log marks these requests with trustedNetwork. Disabled by
+	// default, and should be used only when the network layer already
+	// authenticates the clients.
+	TrustedCIDRs []string
+
+	// TrustedIdentity is the user name set for the requests from the
+	// TrustedCIDRs.
+	TrustedIdentity string
+
+	// JSONErrors, when set, makes the filters respond to the rejected
+	// requests with a JSON body, containing the reject reason in the
+	// error field, and a human readable message in the message field,
+	// e.g. {"error":"invalid-scope","message":"..."}.
+	JSONErrors bool
+
+	// RejectMessages overrides the messages of the JSON error
+	// responses, keyed by the reject reason, e.g. invalid-scope. The
+	// reasons without an entry use the default message. Used only
+	// with JSONErrors and ProblemJSON.
+	RejectMessages map[string]string
+
+	// RejectStatus overrides the status code of the rejected requests,
+	// keyed by the reject reason, e.g. invalid-scope: 403, to match
+	// the contract of the API. The reasons without an entry use their
+	// default status, 401 for most of them. It takes precedence over
+	// GeoBlockedStatus.
+	RejectStatus map[string]int
+
+	// AuthServiceErrorStatus is the status code of the responses to the
+	// requests rejected with auth-service-access, when the token
+	// validation service can't be reached, so that the clients retry
+	// the request instead of acquiring a new token. Defaults to
+	// DefaultAuthServiceErrorStatus. RejectStatus takes precedence.
+	AuthServiceErrorStatus int
+
+	// ProblemJSON, when set, makes the filters respond to the rejected
+	// requests with an RFC 7807 Problem Details body, with the
+	// application/problem+json content type. The type field is the
+	// reject reason appended to ProblemTypeBase, and the detail field
+	// is the same message as with JSONErrors. Takes precedence over
+	// JSONErrors.
+	ProblemJSON bool
+
+	// ProblemTypeBase is the prefix of the type URIs of the Problem
+	// Details responses. Defaults to DefaultProblemTypeBase.
+	ProblemTypeBase string
+
+	// NoClaimsStatus, when set, is the status code, e.g. 204, with
+	// which the token validation service responds to a valid token
+	// without returning its claims. These responses are accepted
+	// without a body, and since the user, realm and scopes of the
+	// token are unknown, they pass only the filters that don't check
+	// any of them, e.g. auth().
+	NoClaimsStatus int
+
+	// SlowCallThreshold, when set, makes the filters log the calls to
+	// the token validation and the team service that take longer than
+	// the threshold, with the url and the elapsed time.
+	SlowCallThreshold time.Duration
+
+	// DeniedScopes, when set, are the scopes that deny the access. The
+	// tokens having any of them are rejected with the denied-scope
+	// reason, regardless of their other scopes.
+	DeniedScopes []string
+
+	// PolicyUrl is the url of the policy service. It is used only by
+	// the authPolicy filter. See NewAuthPolicy.
+	PolicyUrl string
+
+	// PolicyCacheTTL, when set, enables caching the decisions of the
+	// policy service, by the user id, the method and the path of the
+	// request.
+	PolicyCacheTTL time.Duration
+
+	// AllowedTeams, when set, is called on every request by the
+	// authTeam filter to get the allowed teams, instead of taking them
+	// from the filter arguments. When it returns no teams, all
+	// requests are rejected. See FileList.
+	AllowedTeams func() []string
+
+	// ForwardIdentity, when set, makes the filters set the
+	// X-Authenticated-User, X-Authenticated-Scopes and
+	// X-Authenticated-Realm headers of the outgoing request to the user
+	// id, the comma separated scopes and the comma separated realms of
+	// the token. The realm header is omitted when the token validation
+	// service didn't return the realm field. The same headers received
+	// from the client are always dropped.
+	ForwardIdentity bool
+
+	// IdentitySecret, when set together with ForwardIdentity, is used
+	// to sign the forwarded identity. The signature is set in the
+	// X-Auth-Signature header, and the signing time in the
+	// X-Auth-Timestamp header. The realm header is not signed. See
+	// IdentitySignature.
+	IdentitySecret []byte
+
+	// RequireUid, when set, makes the filters reject the valid tokens
+	// for which the token validation service doesn't return a user id,
+	// with the missing-uid reason.
+	RequireUid bool
+
+	// MaxArgs, when set, limits the number of the filter arguments,
+	// including the realms, the scopes, the teams and the roles.
+	// Filters with more arguments fail to be created.
+	MaxArgs int
+
+	// Transport, when set, is used for the outgoing requests to the
+	// token validation, the team and the policy services. Defaults to
+	// http.DefaultTransport.
+	Transport http.RoundTripper
+
+	// ScopeRealmSeparator, when set, makes the auth filter qualify the
+	// required scopes with the realm of the token before checking
+	// them, joined by the separator. E.g. with the separator ":", the
+	// scope orders.read is accepted for a token in the /tenant-a realm
+	// only if the token has the /tenant-a:orders.read scope. When the
+	// filter has realms configured, only the realms of the token that
+	// the filter accepts are used. This way, a scope granted in one
+	// tenant doesn't satisfy the routes of another one.
+	ScopeRealmSeparator string
+
+	// BlockedRealms, when set, are the realms that are denied on every
+	// route, regardless of the realms configured for the filters. The
+	// tokens in any of them are rejected with the blocked-realm
+	// reason.
+	BlockedRealms []string
+
+	// RequiredClaims, when set, lists the claims that the response of
+	// the token validation service needs to contain, with the
+	// specified values, e.g. plan: enterprise. String claims are
+	// compared by their value, other claims by their JSON
+	// representation, e.g. true or 42. Tokens without any of them are
+	// rejected with the missing-claim reason.
+	RequiredClaims map[string]string
+
+	// DecodeToken, when set, makes the filters URL decode the token
+	// before validating it, for the clients that send the token URL
+	// encoded, e.g. abc%2Bdef instead of abc+def. Tokens with invalid
+	// escape sequences are rejected with the invalid-token reason.
+	// Should not be used when the tokens can contain the % character.
+	DecodeToken bool
+
+	// RealmAliases, when set, maps a realm to its former names, e.g.
+	// /staff: [/immortals]. A filter requiring the realm also accepts
+	// tokens in any of its aliases. Meant for the migration window
+	// after renaming a realm, while tokens with the old realm are
+	// still in use.
+	RealmAliases map[string][]string
+
+	// GraceUserAgents, when set, lists the User-Agent patterns of the
+	// clients that are not rejected by the authorization checks, e.g.
+	// invalid-scope or invalid-team. The requests that would be
+	// rejected are let through instead, and the audit log records them
+	// with the graceAllowed flag and the reject reason. Meant for
+	// migrating old clients, while enforcing the checks for everyone
+	// else. The token validation and the request guards, e.g.
+	// untrusted-proxy, geo-blocked or csrf-check-failed, reject these
+	// clients, too.
+	GraceUserAgents []*regexp.Regexp
+
+	// ObservedScopes, when set, lists the scopes that are recorded for
+	// the authorized requests when the token has them, without
+	// affecting the decision, e.g. to measure the adoption of
+	// features. The audit log contains them in the observedScopes
+	// field.
+	ObservedScopes []string
+
+	// TrustedProxies, when set, lists the networks of the proxies,
+	// e.g. the ingress, that the requests need to come through. The
+	// requests need to have the X-Forwarded-For header, and they need
+	// to be received from an address in one of the networks. Otherwise
+	// they are rejected with the untrusted-proxy reason. This prevents
+	// bypassing the ingress by connecting directly. The immediate
+	// upstream is taken from the connection, because the entries of
+	// the X-Forwarded-For header can be set by any client.
+	TrustedProxies []string
+
+	// ScopeThreshold, when set, is the number of the scopes required
+	// by the auth filter that the token needs to have, for tiered
+	// access, e.g. any 2 of read, write and admin. Defaults to 1, when
+	// any of the scopes is enough. When larger than the number of the
+	// required scopes, all of them are needed. Used only by the auth
+	// filters.
+	ScopeThreshold int
+
+	// DPoP, when set, makes the filters require a DPoP proof (RFC
+	// 9449) in the DPoP header of the requests. The proof needs to be
+	// signed with the key in its header, with ES256 or RS256, and it
+	// needs to match the method and the url of the request, and the
+	// hash of the access token. The url is compared without the query,
+	// with the scheme taken from the X-Forwarded-Proto header, when
+	// set. When the token validation service returns the cnf claim
+	// with a key thumbprint (jkt), the proof needs to be signed with
+	// that key. The token is accepted in the Authorization header with
+	// the DPoP scheme, too. Requests without a valid proof are
+	// rejected with the invalid-dpop-proof reason. The jti of the
+	// proofs is not checked for replays.
+	DPoP bool
+
+	// DPoPMaxAge is the maximum age of the DPoP proofs, based on their
+	// iat claim. Defaults to DefaultDPoPMaxAge.
+	DPoPMaxAge time.Duration
+
+	// BlockedCountries, when set, lists the country codes that the
+	// requests are rejected from with the geo-blocked reason, even
+	// when the token would be accepted. The country code is taken from
+	// the CountryHeader, set by the CDN or the ingress, and it is
+	// compared case-insensitively. Requests without the header are not
+	// blocked. To block only some routes, use a separate filter
+	// specification with a custom name.
+	BlockedCountries []string
+
+	// CountryHeader is the name of the request header containing the
+	// country code of the client. Defaults to DefaultCountryHeader.
+	CountryHeader string
+
+	// GeoBlockedStatus is the status code of the responses to the
+	// geo-blocked requests. Defaults to 451 (Unavailable For Legal
+	// Reasons).
+	GeoBlockedStatus int
+
+	// MaxRequestBytes, when set, is the maximum size of the request
+	// bodies. Requests with a larger Content-Length are rejected with
+	// 413 and the request-too-large reason, before any other check.
+	// When the length is not known in advance, e.g. with chunked
+	// uploads, reading the body fails after the limit, and when the
+	// token is taken from the body, the request is rejected the same
+	// way.
+	MaxRequestBytes int64
+
+	// PassPreflight, when set, lets the CORS preflight requests
+	// through without a token. These are the OPTIONS requests with
+	// the Origin and the Access-Control-Request-Method headers, that
+	// browsers send without credentials.
+	PassPreflight bool
+
+	// AllowedOrigins, when set, lists the origins that the preflight
+	// requests are let through from, when PassPreflight is set, e.g.
+	// https://app.example.org. The preflight requests from other
+	// origins are rejected with the origin-not-allowed reason, to not
+	// reveal the route to them.
+	AllowedOrigins []string
+
+	// Now, when set, is used as the clock of the caches and the time
+	// based checks of the filters, instead of time.Now. Meant for
+	// testing the expiry without waiting.
+	Now func() time.Time
+
+	// ScopesFromToken, when set, makes the filters take the scopes
+	// from the claims of the access token, when it is a JWT, instead
+	// of the response of the token validation service, e.g. when the
+	// introspection returns only whether the token is active. The
+	// scopes are taken from the scope claim, separated by spaces, or
+	// from the scp claim. The signature of the token is not verified,
+	// the validity of the token is still decided by the token
+	// validation service. Tokens that are not JWTs are rejected with
+	// the invalid-token reason.
+	ScopesFromToken bool
+
+	// MaxTeamPages is the maximum number of pages requested from the
+	// team service for a user. The team service can return the teams
+	// in multiple pages, with the url of the next page in the Link
+	// header, e.g. <https://teams.example.org/?page=2>; rel="next".
+	// When the limit is reached, the teams of the requested pages are
+	// used. Defaults to DefaultMaxTeamPages.
+	MaxTeamPages int
+
+	// FailOnTeamPageLimit, when set, makes the filters reject the
+	// requests with the team-service-access reason, when the team
+	// service returns more pages than MaxTeamPages, instead of using
+	// the teams of the requested pages.
+	FailOnTeamPageLimit bool
+
+	// RequireScopeField, when set, makes the filters reject the tokens
+	// when the response of the token validation service doesn't
+	// contain the scope field, or the ScopeClaim, with the
+	// missing-scope-field reason. A present but empty list of scopes
+	// is accepted. Null values are treated as absent.
+	RequireScopeField bool
 }
 
-func getStrings(args []interface{}) ([]string, error) {
-	s := make([]string, len(args))
-	var ok bool
-	for i, a := range args {
-		s[i], ok = a.(string)
-		if !ok {
-			return nil, filters.ErrInvalidFilterParameters
-		}
+// DefaultMaxTeamPages is the default value of Options.MaxTeamPages.
+const DefaultMaxTeamPages = 10
+
+func (o *Options) now() time.Time {
+	if o.Now == nil {
+		return time.Now()
 	}
 
-	return s, nil
+	return o.Now()
 }
 
-func intersect(left, right []string) bool {
-	for _, l := range left {
-		for _, r := range right {
-			if l == r {
-				return true
-			}
-		}
-	}
-
-	return false
+// DefaultBindingClaim is the default value of Options.BindingClaim.
+const DefaultBindingClaim = "binding"
+
+// DefaultAuthServiceErrorStatus is the default value of
+// Options.AuthServiceErrorStatus.
+const DefaultAuthServiceErrorStatus = http.StatusServiceUnavailable
+
+// DefaultCountryHeader is the default value of Options.CountryHeader.
+const DefaultCountryHeader = "CF-IPCountry"
+
+// DefaultStripHeaders is the default value of Options.StripHeaders, the
+// headers set by the auth filters.
+var DefaultStripHeaders = []string{
+	userHeaderName,
+	scopesHeaderName,
+	realmHeaderName,
+	teamsHeaderName,
+	signatureHeaderName,
+	timestampHeaderName,
 }
 
-func jsonGet(url, auth string, doc interface{}) error {
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return err
+func (o *Options) stripHeaders() []string {
+	if o.StripHeaders == nil {
+		return DefaultStripHeaders
 	}
 
-	if auth != "" {
-		req.Header.Set(authHeaderName, "Bearer "+auth)
-	}
+	return o.StripHeaders
+}
 
-	rsp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
+// the sequence number of the last audit log entry
+var auditSeq uint64
 
-	defer rsp.Body.Close()
-	if rsp.StatusCode != 200 {
-		return errInvalidToken
-	}
+// DefaultProblemTypeBase is the default value of
+// Options.ProblemTypeBase, e.g. urn:skoap:problem:invalid-scope.
+const DefaultProblemTypeBase = "urn:skoap:problem:"
 
-	d := json.NewDecoder(rsp.Body)
-	return d.Decode(doc)
-}
+// TokenSource is a part of the request that the token can be taken
+// from.
+type TokenSource int
 
-func (ac *authClient) validate(token string) (*authDoc, error) {
-	var a authDoc
-	err := jsonGet(ac.urlBase, token, &a)
-	return &a, err
-}
+const (
 
-func (tc *teamClient) getTeams(uid, token string) ([]string, error) {
-	if teams, ok := tc.cache.Get(uid); ok {
-		return teams, nil
-	}
+	// TokenFromHeader takes the token from the Authorization header.
+	TokenFromHeader TokenSource = iota
 
-	var t []teamDoc
-	fmt.Printf("HIT TEAM SERVICE for '%s'\n", uid)
-	err := jsonGet(tc.urlBase+uid, token, &t)
-	if err != nil {
-		return nil, err
-	}
+	// TokenFromCookie takes the token from the Options.TokenCookie.
+	TokenFromCookie
 
-	ts := make([]string, len(t))
-	for i, ti := range t {
-		ts[i] = ti.Id
-	}
+	// TokenFromQuery takes the token from the
+	// Options.TokenQueryParam.
+	TokenFromQuery
 
-	tc.cache.Set(uid, ts)
+	// TokenFromBody takes the token from the body, with the
+	// Options.BodyToken.
+	TokenFromBody
+)
 
-	return ts, nil
+// DefaultTokenSources is the default value of Options.TokenSources.
+var DefaultTokenSources = []TokenSource{
+	TokenFromHeader,
+	TokenFromCookie,
+	TokenFromQuery,
+	TokenFromBody,
 }
 
-func newSpec(typ roleCheckType, authUrlBase, teamUrlBase string) filters.Spec {
-	s := &spec{typ: typ, authClient: &authClient{authUrlBase}}
-	if typ == checkTeam {
-		s.teamClient = &teamClient{teamUrlBase, ttlcache.NewCache(1 * time.Second)}
-	}
+// DefaultMaxBodyTokenBytes is the default value of
+// Options.MaxBodyTokenBytes.
+const DefaultMaxBodyTokenBytes = 1 << 16
 
-	return s
-}
+// DefaultScopePolicy tells how Options.DefaultScopes are combined with
+// the scopes configured for an auth filter.
+type DefaultScopePolicy int
 
-// Creates a new auth filter specification to validate authorization
-// tokens, optionally check realms and optionally check scopes.
-//
-// authUrlBase: the url of the token validation service.
-// The filter expects the service to validate the token found in the
-// Authorization header and in case of a valid token, it expects it
-// to return the user id and the realm of the user associated with
-// the token ('uid' and 'realm' fields in the returned json document).
-// The token is set as the Authorization Bearer header.
-//
-func NewAuth(authUrlBase string) filters.Spec {
-	return newSpec(checkScope, authUrlBase, "")
-}
+const (
 
-// Creates a new auth filter specification to validate authorization
-// tokens, optionally check realms and optionally check teams.
-//
-// authUrlBase: the url of the token validation service. The filter
-// expects the service to validate the token found in the Authorization
-// header and in case of a valid token, it expects it to return the
-// user id and the realm of the user associated with the token ('uid'
-// and 'realm' fields in the returned json document). The token is set
-// as the Authorization Bearer header.
-//
-// teamUrlBase: this service is queried for the team ids, that the
-// user is a member of ('id' field of the returned json document's
-// items). The user id of the user is appended at the end of the url.
-//
-func NewAuthTeam(authUrlBase, teamUrlBase string) filters.Spec {
-	return newSpec(checkTeam, authUrlBase, teamUrlBase)
+	// DefaultScopesAnd requires one of the default scopes and one of
+	// the filter scopes.
+	DefaultScopesAnd DefaultScopePolicy = iota
+
+	// DefaultScopesOr requires one of the default scopes or one of the
+	// filter scopes.
+	DefaultScopesOr
+)
+
+// PathScope defines the scopes required for the requests whose path
+// matches Path. When Scopes is empty, no scope is required for the
+// matching paths.
+type PathScope struct {
+	Path   *regexp.Regexp
+	Scopes []string
 }
 
-func (s *spec) Name() string {
-	if s.typ == checkScope {
-		return AuthName
-	} else {
-		return AuthTeamName
-	}
+// HostScope defines the prefix of the scopes that are accepted for the
+// requests whose host matches Host, e.g. tenant-a. for a.example.org.
+type HostScope struct {
+	Host   *regexp.Regexp
+	Prefix string
 }
 
-func (s *spec) CreateFilter(args []interface{}) (filters.Filter, error) {
-	sargs, err := getStrings(args)
-	if err != nil {
-		return nil, err
+// an empty string is decoded as empty, non-nil realms, while null
+// leaves them nil, as when the field is absent
+func (r *realms) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*r = nil
+		return nil
 	}
 
-	f := &filter{typ: s.typ, authClient: s.authClient, teamClient: s.teamClient}
-	if len(sargs) > 0 {
-		f.realm, f.args = sargs[0], sargs[1:]
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*r = realms{}
+		if single != "" {
+			*r = realms{single}
+		}
+
+		return nil
 	}
 
-	return f, nil
+	var multiple []string
+	if err := json.Unmarshal(b, &multiple); err != nil {
+		return err
+	}
 
+	*r = realms(multiple)
+	return nil
 }
 
-func (f *filter) validateRealm(a *authDoc) bool {
-	if f.realm == "" {
-		return true
+func (r realms) MarshalJSON() ([]byte, error) {
+	if len(r) == 1 {
+		return json.Marshal(r[0])
 	}
 
-	return a.Realm == f.realm
+	return json.Marshal([]string(r))
 }
 
-func (f *filter) validateScope(a *authDoc) bool {
-	if len(f.args) == 0 {
-		return true
+var (
+	errInvalidAuthorizationHeader = errors.New("invalid authorization header")
+	errInvalidToken               = errors.New("invalid token")
+	errMalformedResponse          = errors.New("malformed response")
+	errNoTeamCache                = errors.New("no team cache")
+	errRequestTooLarge            = errors.New("request body too large")
+	errTeamPageLimit              = errors.New("team page limit reached")
+	errInvalidOwnerPath           = errors.New("invalid owner path template")
+)
+
+func getToken(r *http.Request) (string, error) {
+	const b = "Bearer "
+	h := r.Header.Get(authHeaderName)
+	if !strings.HasPrefix(h, b) || strings.TrimSpace(h[len(b):]) == "" {
+		return "", errInvalidAuthorizationHeader
 	}
 
-	return intersect(f.args, a.Scopes)
+	return h[len(b):], nil
 }
 
-func (f *filter) validateTeam(token string, a *authDoc) (bool, error) {
-	if len(f.args) == 0 {
-		return true, nil
+func cookieToken(r *http.Request, name string) (string, error) {
+	c, err := r.Cookie(name)
+	if err != nil || c.Value == "" {
+		return "", errInvalidAuthorizationHeader
 	}
 
-	teams, err := f.teamClient.getTeams(a.Uid, token)
-	return intersect(f.args, teams), err
+	return c.Value, nil
 }
 
-func (f *filter) Request(ctx filters.FilterContext) {
-	r := ctx.Request()
-
-	token, err := getToken(r)
-	if err != nil {
-		unauthorized(ctx, "", missingBearerToken)
-		return
+func queryToken(r *http.Request, name string) (string, error) {
+	token := r.URL.Query().Get(name)
+	if token == "" {
+		return "", errInvalidAuthorizationHeader
 	}
 
-	a, err := f.authClient.validate(token)
-	if err != nil {
-		reason := authServiceAccess
-		if err == errInvalidToken {
-			reason = invalidToken
-		} else {
-			log.Println(err)
-		}
+	return token, nil
+}
 
-		unauthorized(ctx, "", reason)
-		return
+// looks up the token in the configured sources, in the configured
+// order, and returns the first one found, with its source
+func (f *filter) token(r *http.Request) (string, TokenSource, error) {
+	sources := f.options.TokenSources
+	if len(sources) == 0 {
+		sources = DefaultTokenSources
 	}
 
-	if !f.validateRealm(a) {
-		unauthorized(ctx, a.Uid, invalidRealm)
-		return
-	}
+	for _, src := range sources {
+		var (
+			token string
+			err   error
+		)
+
+		switch {
+		case src == TokenFromHeader:
+			token, err = getToken(r)
+			if err != nil && f.options.DPoP {
+				token, err = dpopToken(r)
+			}
+		case src == TokenFromCookie && f.options.TokenCookie != "":
+			token, err = cookieToken(r, f.options.TokenCookie)
+		case src == TokenFromQuery && f.options.TokenQueryParam != "":
+			token, err = queryToken(r, f.options.TokenQueryParam)
+		case src == TokenFromBody && f.options.BodyToken != nil:
+			token, err = f.bodyToken(r)
+		default:
+			continue
+		}
 
-	if f.typ == checkScope {
-		if !f.validateScope(a) {
-			unauthorized(ctx, a.Uid, invalidScope)
-			return
+		if err == nil {
+			return token, src, nil
 		}
 
-		authorized(ctx, a.Uid)
-		return
+		if err == errRequestTooLarge {
+			return "", 0, err
+		}
 	}
 
-	if valid, err := f.validateTeam(token, a); err != nil {
-		unauthorized(ctx, a.Uid, teamServiceAccess)
-		log.Println(err)
-	} else if !valid {
-		unauthorized(ctx, a.Uid, invalidTeam)
-	} else {
-		authorized(ctx, a.Uid)
+	return "", 0, errInvalidAuthorizationHeader
+}
+
+func (f *filter) requiredHeaders(r *http.Request) bool {
+	for name, value := range f.options.RequireHeader {
+		h := r.Header.Get(name)
+		if h == "" || value != "" && h != value {
+			return false
+		}
 	}
+
+	return true
 }
 
-func (f *filter) Response(_ filters.FilterContext) {}
+type prefixedBody struct {
+	io.Reader
+	body io.ReadCloser
+}
 
-// Creates basicAuth filter specification.
-func NewBasicAuth() filters.Spec { return basic(BasicAuthName) }
+func (pb *prefixedBody) Close() error { return pb.body.Close() }
 
-func (b basic) Name() string { return BasicAuthName }
+// fails reading the body after the limit
+type limitedBody struct {
+	body      io.ReadCloser
+	remaining int64
+}
 
-func (b basic) CreateFilter(args []interface{}) (filters.Filter, error) {
-	var (
-		uname, pwd string
-		ok         bool
-	)
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	if lb.remaining < 0 {
+		return 0, errRequestTooLarge
+	}
 
-	if len(args) > 0 {
-		if uname, ok = args[0].(string); !ok {
-			return nil, filters.ErrInvalidFilterParameters
-		}
+	if int64(len(p)) > lb.remaining+1 {
+		p = p[:lb.remaining+1]
 	}
 
-	if len(args) > 1 {
-		if pwd, ok = args[1].(string); !ok {
-			return nil, filters.ErrInvalidFilterParameters
-		}
+	n, err := lb.body.Read(p)
+	if int64(n) > lb.remaining {
+		n = int(lb.remaining)
+		lb.remaining = -1
+		return n, errRequestTooLarge
 	}
 
-	v := base64.StdEncoding.EncodeToString([]byte(uname + ":" + pwd))
-	return basic("Basic " + v), nil
+	lb.remaining -= int64(n)
+	return n, err
 }
 
-func (b basic) Request(ctx filters.FilterContext) {
-	ctx.Request().Header.Set(authHeaderName, string(b))
-}
+func (lb *limitedBody) Close() error { return lb.body.Close() }
 
-func (b basic) Response(_ filters.FilterContext) {}
+// rejects the requests with a known length over the limit, and limits
+// the bodies of unknown length
+func (f *filter) limitBody(r *http.Request) bool {
+	max := f.options.MaxRequestBytes
+	if max <= 0 {
+		return true
+	}
 
-func newTeeBody(rc io.ReadCloser, maxTee int) io.ReadCloser {
-	b := bytes.NewBuffer(nil)
-	tb := &teeBody{
-		body:   rc,
-		buffer: b,
-		maxTee: maxTee}
-	tb.teeReader = io.TeeReader(rc, tb)
-	return tb
+	if r.ContentLength > max {
+		return false
+	}
+
+	if r.ContentLength < 0 && r.Body != nil {
+		r.Body = &limitedBody{body: r.Body, remaining: max}
+	}
+
+	return true
 }
 
-func (tb *teeBody) Read(b []byte) (int, error) { return tb.teeReader.Read(b) }
-func (tb *teeBody) Close() error               { return tb.body.Close() }
+func (f *filter) bodyToken(r *http.Request) (string, error) {
+	if r.Body == nil {
+		return "", errInvalidAuthorizationHeader
+	}
 
-func (tb *teeBody) Write(b []byte) (int, error) {
-	if tb.maxTee < 0 {
-		return tb.buffer.Write(b)
+	if len(f.options.BodyTokenContentTypes) > 0 {
+		mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || !intersect([]string{mt}, f.options.BodyTokenContentTypes) {
+			return "", errInvalidAuthorizationHeader
+		}
 	}
 
-	wl := len(b)
-	if wl >= tb.maxTee {
-		wl = tb.maxTee
+	max := f.options.MaxBodyTokenBytes
+	if max <= 0 {
+		max = DefaultMaxBodyTokenBytes
 	}
 
-	n, err := tb.buffer.Write(b[:wl])
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(max)))
+	r.Body = &prefixedBody{io.MultiReader(bytes.NewReader(b), r.Body), r.Body}
 	if err != nil {
-		return n, err
+		return "", err
+	}
+
+	m := f.options.BodyToken.FindSubmatch(b)
+	if len(m) == 0 {
+		return "", errInvalidAuthorizationHeader
+	}
+
+	token := m[0]
+	if len(m) > 1 {
+		token = m[1]
 	}
 
-	tb.maxTee -= n
+	if len(token) == 0 {
+		return "", errInvalidAuthorizationHeader
+	}
 
-	// lie to avoid short write
-	return len(b), nil
+	return string(token), nil
 }
 
-// Creates an auditLog filter specification. It expects a writer for
-// the output of the log entries.
-//
-//     spec := NewAuditLog(os.Stderr)
-func NewAuditLog(w io.Writer) filters.Spec {
-	return &auditLog{writer: w}
+func unauthorized(ctx filters.FilterContext, uname string, reason rejectReason) {
+	reject(ctx, uname, reason, http.StatusUnauthorized)
 }
 
-func (al *auditLog) Name() string { return AuditLogName }
+func reject(ctx filters.FilterContext, uname string, reason rejectReason, status int) {
+	ctx.StateBag()[authUserKey] = uname
+	ctx.StateBag()[authRejectReasonKey] = string(reason)
+	ctx.Serve(&http.Response{StatusCode: status})
+}
+
+func (o *Options) rejectMessage(reason rejectReason) string {
+	if m, ok := o.RejectMessages[string(reason)]; ok {
+		return m
+	}
+
+	return defaultRejectMessages[reason]
+}
+
+func (o *Options) problemType(reason rejectReason) string {
+	base := o.ProblemTypeBase
+	if base == "" {
+		base = DefaultProblemTypeBase
+	}
+
+	return base + string(reason)
+}
+
+// returns the body and the content type of the error response
+func (f *filter) errorBody(reason rejectReason, status int) ([]byte, string, error) {
+	if f.options.ProblemJSON {
+		b, err := json.Marshal(problemDoc{
+			Type:   f.options.problemType(reason),
+			Title:  http.StatusText(status),
+			Status: status,
+			Detail: f.options.rejectMessage(reason)})
+		return b, "application/problem+json", err
+	}
+
+	b, err := json.Marshal(errorDoc{
+		Error:   string(reason),
+		Message: f.options.rejectMessage(reason)})
+	return b, "application/json", err
+}
+
+func (f *filter) geoBlocked(r *http.Request) bool {
+	if len(f.options.BlockedCountries) == 0 {
+		return false
+	}
+
+	h := f.options.CountryHeader
+	if h == "" {
+		h = DefaultCountryHeader
+	}
+
+	country := strings.TrimSpace(r.Header.Get(h))
+	if country == "" {
+		return false
+	}
+
+	for _, c := range f.options.BlockedCountries {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isPreflight(r *http.Request) bool {
+	return r.Method == "OPTIONS" &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+func (f *filter) originAllowed(r *http.Request) bool {
+	if len(f.options.AllowedOrigins) == 0 {
+		return true
+	}
+
+	origin := r.Header.Get("Origin")
+	for _, o := range f.options.AllowedOrigins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// the authorization reasons that the GraceUserAgents can be let through
+// with. The User-Agent header is set by the client, so it must not
+// bypass the token validation and the request guards.
+var graceReasons = map[rejectReason]bool{
+	invalidRealm:       true,
+	invalidScope:       true,
+	invalidTeam:        true,
+	invalidRole:        true,
+	deniedScope:        true,
+	policyDenied:       true,
+	missingClaim:       true,
+	methodNotPermitted: true,
+}
+
+func (f *filter) graceAllowed(r *http.Request, reason rejectReason) bool {
+	if !graceReasons[reason] {
+		return false
+	}
+
+	ua := r.Header.Get("User-Agent")
+	for _, rx := range f.options.GraceUserAgents {
+		if rx.MatchString(ua) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *filter) unauthorized(ctx filters.FilterContext, uname string, reason rejectReason) {
+	f.reject(ctx, uname, reason, http.StatusUnauthorized)
+}
+
+func (f *filter) reject(ctx filters.FilterContext, uname string, reason rejectReason, status int) {
+	if s, ok := f.options.RejectStatus[string(reason)]; ok && s != 0 {
+		status = s
+	}
+
+	if f.graceAllowed(ctx.Request(), reason) {
+		ctx.StateBag()[authUserKey] = uname
+		ctx.StateBag()[authGraceReasonKey] = string(reason)
+		f.logDecision(ctx, Decision{Allowed: true, Reason: string(reason), GraceAllowed: true, User: uname})
+		return
+	}
+
+	f.logDecision(ctx, Decision{Reason: string(reason), User: uname})
+
+	if !f.options.JSONErrors && !f.options.ProblemJSON {
+		reject(ctx, uname, reason, status)
+		return
+	}
+
+	b, contentType, err := f.errorBody(reason, status)
+	if err != nil {
+		log.Println(err)
+		reject(ctx, uname, reason, status)
+		return
+	}
+
+	ctx.StateBag()[authUserKey] = uname
+	ctx.StateBag()[authRejectReasonKey] = string(reason)
+	ctx.Serve(&http.Response{
+		StatusCode:    status,
+		Header:        http.Header{"Content-Type": []string{contentType}},
+		ContentLength: int64(len(b)),
+		Body:          ioutil.NopCloser(bytes.NewReader(b))})
+}
+
+func authorized(ctx filters.FilterContext, uname string) {
+	ctx.StateBag()["auth-user"] = uname
+}
+
+func (f *filter) authorized(ctx filters.FilterContext, a *authDoc) {
+	if observed := matching(f.options.ObservedScopes, a.Scopes); len(observed) > 0 {
+		ctx.StateBag()[authObservedKey] = observed
+	}
+
+	if a.hasRealmField() {
+		ctx.StateBag()[authRealmKey] = strings.Join(a.Realm, ",")
+	}
+
+	if f.options.ForwardIdentity {
+		forwardIdentity(ctx.Request(), a, f.options.IdentitySecret, f.options.now())
+	}
+
+	authorized(ctx, a.Uid)
+	ctx.StateBag()[authForwardedKey] = time.Now()
+	f.logDecision(ctx, Decision{Allowed: true, User: a.Uid})
+}
+
+func getStrings(args []interface{}) ([]string, error) {
+	s := make([]string, len(args))
+	var ok bool
+	for i, a := range args {
+		s[i], ok = a.(string)
+		if !ok {
+			return nil, filters.ErrInvalidFilterParameters
+		}
+	}
+
+	return s, nil
+}
+
+// returns the items of left that are also in right, in the order of
+// left
+func matching(left, right []string) []string {
+	var m []string
+	for _, l := range left {
+		for _, r := range right {
+			if l == r {
+				m = append(m, l)
+				break
+			}
+		}
+	}
+
+	return m
+}
+
+func intersect(left, right []string) bool {
+	for _, l := range left {
+		for _, r := range right {
+			if l == r {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func decodeStrict(r io.Reader, doc interface{}) error {
+	d := json.NewDecoder(r)
+	d.DisallowUnknownFields()
+	if err := d.Decode(doc); err != nil {
+		return errMalformedResponse
+	}
+
+	if _, err := d.Token(); err != io.EOF {
+		return errMalformedResponse
+	}
+
+	return nil
+}
+
+// when emptyStatus is set, responses with this status code are accepted
+// without a body, leaving doc unchanged. Returns the response header.
+func jsonGet(client *http.Client, url, auth string, doc interface{}, strict bool, emptyStatus int) (http.Header, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if auth != "" {
+		req.Header.Set(authHeaderName, "Bearer "+auth)
+	}
+
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rsp.Body.Close()
+	if emptyStatus != 0 && rsp.StatusCode == emptyStatus {
+		return rsp.Header, nil
+	}
+
+	if rsp.StatusCode != 200 {
+		return nil, errInvalidToken
+	}
+
+	if strict {
+		return rsp.Header, decodeStrict(rsp.Body, doc)
+	}
+
+	d := json.NewDecoder(rsp.Body)
+	return rsp.Header, d.Decode(doc)
+}
+
+func tokenHash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// the first 8 hex digits of the token hash
+func tokenFingerprint(token string) string {
+	return tokenHash(token)[:8]
+}
+
+// tells whether the scope field was present in the response of the
+// token validation service. When decoding JSON, the scopes are left
+// nil when the field is absent or null, while an empty list sets them
+// to an empty slice.
+func (a *authDoc) hasScopeField() bool {
+	return a.Scopes != nil
+}
+
+// tells whether the realm field was present in the response of the
+// token validation service, similar to hasScopeField
+func (a *authDoc) hasRealmField() bool {
+	return a.Realm != nil
+}
+
+// tells whether the response contains the configured error field
+func (ac *authClient) tokenError(a *authDoc) bool {
+	if ac.errorField == "" {
+		return false
+	}
+
+	raw, ok := a.Claims[ac.errorField]
+	if !ok {
+		return false
+	}
+
+	v := claimValue(raw)
+	if ac.errorValue != "" {
+		return v == ac.errorValue
+	}
+
+	return v != ""
+}
+
+// decodes the auth document, taking the scopes from the configured
+// claim, and keeping the custom claims. In strict mode, these claims are
+// not treated as unknown fields.
+func (ac *authClient) decodeClaims(raw json.RawMessage, a *authDoc) error {
+	var claims map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		if ac.strict {
+			return errMalformedResponse
+		}
+
+		return err
+	}
+
+	for _, c := range ac.claims {
+		if v, ok := claims[c]; ok {
+			if a.Claims == nil {
+				a.Claims = make(map[string]json.RawMessage)
+			}
+
+			a.Claims[c] = v
+			delete(claims, c)
+		}
+	}
+
+	var (
+		scopes   json.RawMessage
+		hasClaim bool
+	)
+
+	if ac.scopeClaim != "" {
+		scopes, hasClaim = claims[ac.scopeClaim]
+		delete(claims, ac.scopeClaim)
+	}
+
+	rest, err := json.Marshal(claims)
+	if err != nil {
+		return err
+	}
+
+	if ac.strict {
+		err = decodeStrict(bytes.NewReader(rest), a)
+	} else {
+		err = json.Unmarshal(rest, a)
+	}
+
+	if err != nil || !hasClaim {
+		return err
+	}
+
+	if err := json.Unmarshal(scopes, &a.Scopes); err != nil {
+		if ac.strict {
+			return errMalformedResponse
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// returns the max-age from the Cache-Control header. The no-store and
+// no-cache directives are returned as zero max-age.
+func cacheMaxAge(h http.Header) (time.Duration, bool) {
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		switch {
+		case d == "no-store" || d == "no-cache":
+			return 0, true
+		case strings.HasPrefix(d, "max-age="):
+			seconds, err := strconv.Atoi(strings.TrimPrefix(d, "max-age="))
+			if err != nil || seconds < 0 {
+				return 0, true
+			}
+
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+
+	return 0, false
+}
+
+func logSlowCall(threshold time.Duration, url string, start time.Time) {
+	if threshold <= 0 {
+		return
+	}
+
+	if d := time.Since(start); d > threshold {
+		log.Printf("slow call to %s: %v", url, d)
+	}
+}
+
+func (ac *authClient) observe(start time.Time) {
+	ac.latency.add(time.Since(start))
+	logSlowCall(ac.slowCall, ac.urlBase, start)
+}
+
+// the returned document may be shared between requests, and must not
+// be modified
+func (ac *authClient) validate(token string, bypassCache bool) (*authDoc, error) {
+	var (
+		key      string
+		previous interface{}
+	)
+
+	if ac.local != nil {
+		if a, ok := ac.local.lookup(token); ok {
+			return a, nil
+		}
+
+		if !ac.localFallback {
+			return nil, errInvalidToken
+		}
+	}
+
+	if ac.cache != nil {
+		key = tokenHash(token)
+
+		// peeked first, because get evicts the expired entries
+		previous, _ = ac.cache.peek(key)
+		if !bypassCache {
+			if a, ok := ac.cache.get(key); ok {
+				return a.(*authDoc), nil
+			}
+		}
+	}
+
+	if ac.flights == nil {
+		return ac.fetch(token, key, previous)
+	}
+
+	return ac.flights.do(tokenHash(token), func() (*authDoc, error) {
+		return ac.fetch(token, key, previous)
+	})
+}
+
+// calls the token validation service, and caches the result
+func (ac *authClient) fetch(token, key string, previous interface{}) (*authDoc, error) {
+	var (
+		a   authDoc
+		h   http.Header
+		err error
+	)
+
+	defer ac.observe(time.Now())
+	if ac.introspection {
+		h, err = ac.introspect(token, &a)
+	} else if ac.scopeClaim == "" && len(ac.claims) == 0 {
+		h, err = jsonGet(ac.client, ac.urlBase, token, &a, ac.strict, ac.noClaimsStatus)
+	} else {
+		var raw json.RawMessage
+		h, err = jsonGet(ac.client, ac.urlBase, token, &raw, ac.strict, ac.noClaimsStatus)
+		if err == nil && len(raw) > 0 {
+			err = ac.decodeClaims(raw, &a)
+		}
+	}
+
+	if err == nil && ac.tokenError(&a) {
+		err = errInvalidToken
+	}
+
+	if err == nil && ac.cache != nil {
+		ttl := ac.cache.ttl
+		if maxAge, ok := cacheMaxAge(h); ok && maxAge < ttl {
+			ttl = maxAge
+		}
+
+		if previous != nil && ac.refreshed != nil {
+			ac.refreshed(previous.(*authDoc), &a)
+		}
+
+		if ttl > 0 {
+			ac.cache.setTTL(key, &a, ttl)
+		}
+	}
+
+	return &a, err
+}
+
+func (tc *teamClient) invalidate(previous, current *authDoc) {
+	tc.cache.del(previous.Uid)
+	tc.cache.del(current.Uid)
+}
+
+// returns the url of the next page from the Link header, resolved
+// against the url of the current page. Links pointing to a different
+// scheme or host are not followed, to avoid sending the token of the
+// user to a third party.
+func nextLink(h http.Header, current string) (string, bool) {
+	for _, l := range h["Link"] {
+		for _, link := range strings.Split(l, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+
+			for _, p := range parts[1:] {
+				p = strings.Replace(strings.TrimSpace(p), `"`, "", -1)
+				if !strings.EqualFold(p, "rel=next") {
+					continue
+				}
+
+				base, err := url.Parse(current)
+				if err != nil {
+					return "", false
+				}
+
+				next, err := base.Parse(target[1 : len(target)-1])
+				if err != nil {
+					return "", false
+				}
+
+				if next.Scheme != base.Scheme || next.Host != base.Host {
+					log.Println("team service next link ignored, different origin:", next.Host)
+					return "", false
+				}
+
+				return next.String(), true
+			}
+		}
+	}
+
+	return "", false
+}
+
+func (tc *teamClient) getTeams(uid, token string) ([]string, error) {
+	if teams, ok := tc.cache.get(uid); ok {
+		return teams.([]string), nil
+	}
+
+	maxPages := tc.maxPages
+	if maxPages <= 0 {
+		maxPages = DefaultMaxTeamPages
+	}
+
+	ts := make([]string, 0)
+	u := tc.urlBase + uid
+	for page := 0; ; page++ {
+		if page == maxPages {
+			if tc.failOnPageLimit {
+				return nil, errTeamPageLimit
+			}
+
+			log.Println("team pages limited to", maxPages)
+			break
+		}
+
+		var t []teamDoc
+		start := time.Now()
+		h, err := jsonGet(tc.client, u, token, &t, false, 0)
+		logSlowCall(tc.slowCall, u, start)
+		if err == io.EOF {
+			// empty response body, no teams
+			err = nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ti := range t {
+			ts = append(ts, ti.Id)
+		}
+
+		next, ok := nextLink(h, u)
+		if !ok {
+			break
+		}
+
+		u = next
+	}
+
+	tc.cache.set(uid, ts)
+
+	return ts, nil
+}
+
+// AuthSpec is implemented by the filter specifications returned by
+// NewAuthWithOptions, NewAuthTeamWithOptions and NewAuthRoleWithOptions.
+type AuthSpec interface {
+	filters.Spec
+
+	// Stats returns the statistics of the caches shared by the
+	// filters created from the specification.
+	Stats() Stats
+
+	// LatencyStats returns the percentiles of the recent call
+	// durations of the token validation service.
+	LatencyStats() LatencyStats
+
+	// WarmTeams seeds the team cache with the teams of the users in
+	// entries, keyed by user id, to avoid a burst of calls to the team
+	// service after a deployment. It fails for specifications that
+	// don't check teams.
+	WarmTeams(ctx context.Context, entries map[string][]string) error
+
+	// Close stops the background goroutines of the specification, if
+	// any. The filters created from it should not be used after
+	// closing. See CloseAll.
+	Close() error
+}
+
+func newSpec(typ roleCheckType, o Options) AuthSpec {
+	client := &http.Client{Transport: o.Transport}
+	s := &spec{
+		typ:     typ,
+		options: o,
+		authClient: &authClient{
+			client:         client,
+			urlBase:        o.AuthUrlBase,
+			strict:         o.StrictDecoding,
+			scopeClaim:     o.ScopeClaim,
+			claims:         requiredClaimNames(o.RequiredClaims),
+			noClaimsStatus: o.NoClaimsStatus,
+			slowCall:       o.SlowCallThreshold,
+			latency:        newLatencyRing(latencySamples),
+			errorField:     o.ErrorField,
+			errorValue:     o.ErrorValue,
+			local:          o.LocalTokenStore,
+			localFallback:  o.LocalStoreFallback,
+			introspection:  o.Introspection,
+			clientId:       o.ClientId,
+			clientSecret:   o.ClientSecret,
+		},
+	}
+
+	if o.BindingCookie != "" {
+		s.authClient.claims = append(s.authClient.claims, o.bindingClaim())
+	}
+
+	if o.MaxTokenLifetime > 0 {
+		s.authClient.claims = append(s.authClient.claims, issuedAtClaim)
+	}
+
+	// the error field is decoded as a custom claim
+	if o.ErrorField != "" {
+		s.authClient.claims = append(s.authClient.claims, o.ErrorField)
+	}
+
+	if o.AuthCacheTTL > 0 {
+		s.authClient.cache = newCache(o.AuthCacheTTL, o.Now)
+		s.authClient.cache.maxAge = o.MaxCacheAge
+	}
+
+	if o.CoalesceValidations {
+		s.authClient.flights = newFlightGroup()
+	}
+
+	if o.RecordAuthSource {
+		if u, err := url.Parse(o.AuthUrlBase); err == nil {
+			s.authClient.source = u.Host
+		}
+	}
+
+	// the key binding of the token is checked when returned
+	if o.DPoP {
+		s.authClient.claims = append(s.authClient.claims, dpopConfirmationClaim)
+	}
+
+	s.trustedNets, s.optionsErr = parseCIDRs(o.TrustedCIDRs)
+	if s.optionsErr == nil {
+		s.proxyNets, s.optionsErr = parseCIDRs(o.TrustedProxies)
+	}
+
+	if s.optionsErr == nil && o.OwnerPath != "" {
+		s.ownerPath, s.optionsErr = parseOwnerPath(o.OwnerPath)
+	}
+
+	if typ == checkPolicy {
+		s.policyClient = newPolicyClient(client, o.PolicyUrl, o.PolicyCacheTTL, o.Now)
+	}
+
+	if o.UserInfoUrl != "" {
+		s.userInfo = newUserInfoClient(client, o)
+	}
+
+	if typ == checkTeam {
+		s.teamClient = &teamClient{
+			client:          client,
+			urlBase:         o.TeamUrlBase,
+			cache:           newCache(1*time.Second, o.Now),
+			slowCall:        o.SlowCallThreshold,
+			maxPages:        o.MaxTeamPages,
+			failOnPageLimit: o.FailOnTeamPageLimit,
+		}
+
+		// the teams of the users of a token are fetched again, when
+		// the validation of the token is refreshed
+		s.authClient.refreshed = s.teamClient.invalidate
+	}
+
+	if o.CacheReapInterval > 0 {
+		caches := []*cache{s.authClient.cache}
+		if s.teamClient != nil {
+			caches = append(caches, s.teamClient.cache)
+		}
+
+		if s.policyClient != nil {
+			caches = append(caches, s.policyClient.cache)
+		}
+
+		if s.userInfo != nil {
+			caches = append(caches, s.userInfo.cache)
+		}
+
+		s.reaper = startReaper(o.CacheReapInterval, caches...)
+	}
+
+	return s
+}
+
+// Creates a new auth filter specification to validate authorization
+// tokens, optionally check realms and optionally check scopes.
+//
+// authUrlBase: the url of the token validation service.
+// The filter expects the service to validate the token found in the
+// Authorization header and in case of a valid token, it expects it
+// to return the user id and the realm of the user associated with
+// the token ('uid' and 'realm' fields in the returned json document).
+// The token is set as the Authorization Bearer header.
+//
+func NewAuth(authUrlBase string) filters.Spec {
+	return NewAuthWithOptions(Options{AuthUrlBase: authUrlBase})
+}
+
+// Creates a new auth filter specification with the settings in the
+// options. See Options and NewAuth.
+func NewAuthWithOptions(o Options) AuthSpec {
+	return newSpec(checkScope, o)
+}
+
+// Creates a new auth filter specification to validate authorization
+// tokens, optionally check realms and optionally check teams.
+//
+// authUrlBase: the url of the token validation service. The filter
+// expects the service to validate the token found in the Authorization
+// header and in case of a valid token, it expects it to return the
+// user id and the realm of the user associated with the token ('uid'
+// and 'realm' fields in the returned json document). The token is set
+// as the Authorization Bearer header.
+//
+// teamUrlBase: this service is queried for the team ids, that the
+// user is a member of ('id' field of the returned json document's
+// items). The user id of the user is appended at the end of the url.
+//
+func NewAuthTeam(authUrlBase, teamUrlBase string) filters.Spec {
+	return NewAuthTeamWithOptions(Options{AuthUrlBase: authUrlBase, TeamUrlBase: teamUrlBase})
+}
+
+// Creates a new authTeam filter specification with the settings in the
+// options. See Options and NewAuthTeam.
+func NewAuthTeamWithOptions(o Options) AuthSpec {
+	return newSpec(checkTeam, o)
+}
+
+// Creates a new authRole filter specification to validate
+// authorization tokens, optionally check realms and optionally check
+// the roles of the user ('roles' field in the json document returned
+// by the token validation service). See NewAuth.
+func NewAuthRole(authUrlBase string) filters.Spec {
+	return NewAuthRoleWithOptions(Options{AuthUrlBase: authUrlBase})
+}
+
+// Creates a new authRole filter specification with the settings in the
+// options. See Options and NewAuthRole.
+func NewAuthRoleWithOptions(o Options) AuthSpec {
+	return newSpec(checkRole, o)
+}
+
+// Creates a new authPolicy filter specification to validate
+// authorization tokens, optionally check realms, and check the request
+// against a policy service.
+//
+// policyUrl: the policy service receives a POST request with a JSON
+// document, containing the user id, the scopes of the token, and the
+// method and the path of the incoming request ('uid', 'scopes',
+// 'method' and 'path' fields). It is expected to respond with a JSON
+// document, with the 'allow' field set to true, when the request is
+// allowed. Denied requests are rejected with the policy-denied reason.
+//
+func NewAuthPolicy(authUrlBase, policyUrl string) filters.Spec {
+	return NewAuthPolicyWithOptions(Options{AuthUrlBase: authUrlBase, PolicyUrl: policyUrl})
+}
+
+// Creates a new authPolicy filter specification with the settings in
+// the options. See Options and NewAuthPolicy.
+func NewAuthPolicyWithOptions(o Options) AuthSpec {
+	return newSpec(checkPolicy, o)
+}
+
+func (s *spec) Name() string {
+	if s.options.Name != "" {
+		return s.options.Name
+	}
+
+	switch s.typ {
+	case checkTeam:
+		return AuthTeamName
+	case checkRole:
+		return AuthRoleName
+	case checkPolicy:
+		return AuthPolicyName
+	default:
+		return AuthName
+	}
+}
+
+func (s *spec) LatencyStats() LatencyStats {
+	return s.authClient.latency.stats()
+}
+
+func (s *spec) Stats() Stats {
+	st := Stats{Auth: s.authClient.cache.stats()}
+	if s.teamClient != nil {
+		st.Teams = s.teamClient.cache.stats()
+	}
+
+	if s.userInfo != nil {
+		st.UserInfo = s.userInfo.cache.stats()
+	}
+
+	return st
+}
+
+func (s *spec) Close() error {
+	s.reaper.stop()
+	return nil
+}
+
+func (s *spec) WarmTeams(ctx context.Context, entries map[string][]string) error {
+	if s.teamClient == nil {
+		return errNoTeamCache
+	}
+
+	for uid, teams := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		s.teamClient.cache.set(uid, append([]string(nil), teams...))
+	}
+
+	return nil
+}
+
+// The first argument is always the realm, when empty, the realm is not
+// checked. The subsequent arguments starting with a '/' are additional
+// realms. The rest of the arguments are the scopes, teams or roles.
+//
+// When the arguments contain the "--" separator, the arguments before
+// it are the realms, and the arguments after it are the scopes, teams
+// or roles, even if they start with a '/'.
+func parseRealms(args []string) ([]string, []string) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+
+	var r []string
+	for i, a := range args {
+		if a != argsSeparator {
+			continue
+		}
+
+		for _, ri := range args[:i] {
+			if ri != "" {
+				r = append(r, ri)
+			}
+		}
+
+		return r, args[i+1:]
+	}
+
+	if args[0] != "" {
+		r = append(r, args[0])
+	}
+
+	args = args[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "/") {
+		r, args = append(r, args[0]), args[1:]
+	}
+
+	return r, args
+}
+
+func (s *spec) CreateFilter(args []interface{}) (filters.Filter, error) {
+	if s.optionsErr != nil {
+		return nil, s.optionsErr
+	}
+
+	sargs, err := getStrings(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.options.MaxArgs > 0 && len(sargs) > s.options.MaxArgs {
+		log.Printf(
+			"%s: too many arguments: %d, the maximum is %d",
+			s.Name(), len(sargs), s.options.MaxArgs)
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	f := &filter{
+		typ:          s.typ,
+		options:      &s.options,
+		authClient:   s.authClient,
+		teamClient:   s.teamClient,
+		policyClient: s.policyClient,
+		userInfo:     s.userInfo,
+		trustedNets:  s.trustedNets,
+		proxyNets:    s.proxyNets,
+		ownerPath:    s.ownerPath}
+
+	f.realms, f.args = parseRealms(sargs)
+	if f.typ == checkPolicy && len(f.args) > 0 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	f.validateOnly = len(f.realms) == 0 &&
+		len(f.args) == 0 &&
+		len(f.options.PathScopes) == 0 &&
+		f.options.RevokedTokens == nil &&
+		!f.options.RequireCertIdentity &&
+		len(f.options.DefaultScopes) == 0 &&
+		f.options.RequireTokenType == "" &&
+		len(f.options.DeniedScopes) == 0 &&
+		f.options.AllowedTeams == nil &&
+		f.ownerPath == nil &&
+		f.typ != checkPolicy
+
+	return f, nil
+}
+
+func (a *authDoc) tokenType() string {
+	if a.TokenType != "" {
+		return a.TokenType
+	}
+
+	return a.Typ
+}
+
+func (f *filter) validateTokenType(a *authDoc) bool {
+	return f.options.RequireTokenType == "" ||
+		strings.EqualFold(a.tokenType(), f.options.RequireTokenType)
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *filter) trusted(r *http.Request) bool {
+	return len(f.trustedNets) > 0 && containsIP(f.trustedNets, clientIP(r))
+}
+
+// the request needs to be forwarded by a trusted proxy, that appended
+// to the X-Forwarded-For header
+func (f *filter) forwardedByTrustedProxy(r *http.Request) bool {
+	return len(f.proxyNets) == 0 ||
+		r.Header.Get("X-Forwarded-For") != "" && containsIP(f.proxyNets, clientIP(r))
+}
+
+func requiredClaimNames(claims map[string]string) []string {
+	var names []string
+	for n := range claims {
+		names = append(names, n)
+	}
+
+	return names
+}
+
+func claimValue(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+
+	return string(raw)
+}
+
+func (f *filter) validateClaims(a *authDoc) bool {
+	for n, v := range f.options.RequiredClaims {
+		raw, ok := a.Claims[n]
+		if !ok || claimValue(raw) != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *filter) revoked(id string) bool {
+	return f.options.RevokedTokens != nil && id != "" && f.options.RevokedTokens(id)
+}
+
+func (f *filter) validateCertIdentity(r *http.Request, a *authDoc) bool {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+
+	id := a.Uid
+	if f.options.CertIdentity != nil {
+		id = f.options.CertIdentity(id)
+	}
+
+	if id == "" {
+		return false
+	}
+
+	c := r.TLS.PeerCertificates[0]
+	return c.Subject.CommonName == id ||
+		intersect([]string{id}, c.DNSNames) ||
+		intersect([]string{id}, c.EmailAddresses)
+}
+
+// returns the realms of the filter, extended with their aliases
+func (f *filter) acceptedRealms() []string {
+	if len(f.options.RealmAliases) == 0 {
+		return f.realms
+	}
+
+	var realms []string
+	for _, r := range f.realms {
+		realms = append(realms, r)
+		realms = append(realms, f.options.RealmAliases[r]...)
+	}
+
+	return realms
+}
+
+func (f *filter) validateRealm(a *authDoc) bool {
+	if len(f.realms) == 0 {
+		return true
+	}
+
+	return intersect(f.acceptedRealms(), a.Realm)
+}
+
+func (f *filter) requiredScopes(r *http.Request) []string {
+	for _, ps := range f.options.PathScopes {
+		if ps.Path.MatchString(r.URL.Path) {
+			return ps.Scopes
+		}
+	}
+
+	return f.args
+}
+
+// returns the number of the required scopes that need to match
+func (f *filter) scopeThreshold(required int) int {
+	k := f.options.ScopeThreshold
+	if k < 1 || f.typ != checkScope {
+		return 1
+	}
+
+	if k > required {
+		return required
+	}
+
+	return k
+}
+
+// checks the scopes or the roles of the token
+// returns the required scopes that were granted
+func (f *filter) validateScope(r *http.Request, granted []string) (bool, []string) {
+	scopes := f.requiredScopes(r)
+	if len(scopes) == 0 {
+		return true, nil
+	}
+
+	m := matching(scopes, granted)
+	return len(m) >= f.scopeThreshold(len(scopes)), m
+}
+
+// converts a path template, e.g. /users/{id}, into an expression
+// matching the path and the paths under it, capturing the placeholder
+func parseOwnerPath(template string) (*regexp.Regexp, error) {
+	var (
+		expr         = "^"
+		placeholders int
+	)
+
+	for _, segment := range strings.Split(strings.Trim(template, "/"), "/") {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") && len(segment) > 2 {
+			expr += "/([^/]+)"
+			placeholders++
+		} else if segment != "" {
+			expr += "/" + regexp.QuoteMeta(segment)
+		}
+	}
+
+	if placeholders != 1 {
+		return nil, errInvalidOwnerPath
+	}
+
+	return regexp.Compile(expr + "(/|$)")
+}
+
+func (f *filter) validateOwner(r *http.Request, a *authDoc) bool {
+	if f.ownerPath == nil {
+		return true
+	}
+
+	m := f.ownerPath.FindStringSubmatch(r.URL.Path)
+	if len(m) == 0 {
+		return true
+	}
+
+	return a.Uid != "" && m[1] == a.Uid || intersect(f.options.OwnerBypassScopes, a.Scopes)
+}
+
+func (o *Options) bindingClaim() string {
+	if o.BindingClaim == "" {
+		return DefaultBindingClaim
+	}
+
+	return o.BindingClaim
+}
+
+// when the token has the binding claim, it needs to match the hash of
+// the session cookie
+func (f *filter) validateCookieBinding(r *http.Request, a *authDoc) bool {
+	if f.options.BindingCookie == "" {
+		return true
+	}
+
+	raw, ok := a.Claims[f.options.bindingClaim()]
+	if !ok {
+		return true
+	}
+
+	c, err := r.Cookie(f.options.BindingCookie)
+	if err != nil || c.Value == "" {
+		return false
+	}
+
+	binding := claimValue(raw)
+	return subtle.ConstantTimeCompare([]byte(binding), []byte(tokenHashClaim(c.Value))) == 1
+}
+
+// when the token has the iat claim, it needs to be younger than the
+// maximum lifetime
+func (f *filter) validateLifetime(a *authDoc) bool {
+	if f.options.MaxTokenLifetime <= 0 {
+		return true
+	}
+
+	raw, ok := a.Claims[issuedAtClaim]
+	if !ok {
+		return true
+	}
+
+	var iat float64
+	if err := json.Unmarshal(raw, &iat); err != nil {
+		return false
+	}
+
+	issued := time.Unix(int64(iat), 0)
+	return f.options.now().Sub(issued) <= f.options.MaxTokenLifetime
+}
+
+// the scopes of the token need to be allowed by its realms
+func (f *filter) validateRealmScopes(a *authDoc) bool {
+	if len(f.options.RealmScopes) == 0 || len(a.Realm) == 0 {
+		return true
+	}
+
+	var (
+		allowed []string
+		mapped  bool
+	)
+
+	for _, realm := range a.Realm {
+		if scopes, ok := f.options.RealmScopes[realm]; ok {
+			allowed = append(allowed, scopes...)
+			mapped = true
+		}
+	}
+
+	if !mapped {
+		return true
+	}
+
+	for _, s := range a.Scopes {
+		if !intersect(allowed, []string{s}) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// the request method needs to be permitted by a scope of the token
+func (f *filter) validateMethod(r *http.Request, a *authDoc) bool {
+	if len(f.options.ScopeMethods) == 0 {
+		return true
+	}
+
+	for _, s := range a.Scopes {
+		for _, m := range f.options.ScopeMethods[s] {
+			if m == "*" || strings.EqualFold(m, r.Method) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// when the request tells the user that the caller acts for, it needs to
+// be the user of the token, or the token needs to allow impersonation
+func (f *filter) validateOnBehalfOf(r *http.Request, a *authDoc) bool {
+	if f.options.OnBehalfOfHeader == "" {
+		return true
+	}
+
+	values, ok := r.Header[http.CanonicalHeaderKey(f.options.OnBehalfOfHeader)]
+	if !ok {
+		return true
+	}
+
+	if intersect(f.options.ImpersonationScopes, a.Scopes) {
+		return true
+	}
+
+	return len(values) == 1 && a.Uid != "" && values[0] == a.Uid
+}
+
+// returns the scope prefix of the first host rule matching the request
+func (f *filter) hostScopePrefix(r *http.Request) (string, bool) {
+	if len(f.options.HostScopes) == 0 {
+		return "", false
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	for _, hs := range f.options.HostScopes {
+		if hs.Host.MatchString(host) {
+			return hs.Prefix, true
+		}
+	}
+
+	return "", false
+}
+
+// returns the granted scopes qualified with the prefix, without the
+// prefix
+func tenantScopes(prefix string, granted []string) []string {
+	var scopes []string
+	for _, s := range granted {
+		if strings.HasPrefix(s, prefix) && len(s) > len(prefix) {
+			scopes = append(scopes, s[len(prefix):])
+		}
+	}
+
+	return scopes
+}
+
+// qualifies the required scopes with the realms of the token accepted
+// by the filter, and returns the qualified scopes that were granted
+func (f *filter) validateRealmScope(r *http.Request, a *authDoc) (bool, []string) {
+	scopes := f.requiredScopes(r)
+	if len(scopes) == 0 {
+		return true, nil
+	}
+
+	realms := []string(a.Realm)
+	if len(f.realms) > 0 {
+		realms = matching(f.acceptedRealms(), a.Realm)
+	}
+
+	var qualified, unqualified []string
+	for _, realm := range realms {
+		for _, s := range scopes {
+			qualified = append(qualified, realm+f.options.ScopeRealmSeparator+s)
+			unqualified = append(unqualified, s)
+		}
+	}
+
+	// the same scope granted in multiple realms counts once
+	m := matching(qualified, a.Scopes)
+	distinct := make(map[string]bool)
+	for i, q := range qualified {
+		if intersect([]string{q}, m) {
+			distinct[unqualified[i]] = true
+		}
+	}
+
+	return len(m) > 0 && len(distinct) >= f.scopeThreshold(len(scopes)), m
+}
+
+// with the OR policy, a default scope can replace the filter scopes
+func (f *filter) defaultScopeSufficient(a *authDoc) bool {
+	return f.options.DefaultScopePolicy == DefaultScopesOr &&
+		intersect(f.options.DefaultScopes, a.Scopes)
+}
+
+func (f *filter) validateDefaultScopes(r *http.Request, a *authDoc) bool {
+	if len(f.options.DefaultScopes) == 0 {
+		return true
+	}
+
+	if intersect(f.options.DefaultScopes, a.Scopes) {
+		return true
+	}
+
+	// with the OR policy, it is enough to match one of the scopes of
+	// the filter, but only when there are any
+	return f.typ == checkScope &&
+		f.options.DefaultScopePolicy == DefaultScopesOr &&
+		len(f.requiredScopes(r)) > 0 &&
+		intersect(f.requiredScopes(r), a.Scopes)
+}
+
+// returns the configured teams that the user is a member of
+func (f *filter) validateTeam(ctx filters.FilterContext, token string, a *authDoc) (bool, []string, error) {
+	allowed := f.args
+	if f.options.AllowedTeams != nil {
+		allowed = f.options.AllowedTeams()
+		if len(allowed) == 0 {
+			return false, nil, nil
+		}
+	}
+
+	if len(allowed) == 0 {
+		return true, nil, nil
+	}
+
+	start := time.Now()
+	teams, err := f.teamClient.getTeams(a.Uid, token)
+	ctx.StateBag()[teamDurationKey] = time.Since(start)
+	if err != nil {
+		return false, nil, err
+	}
+
+	m := matching(allowed, teams)
+	return len(m) > 0, m, nil
+}
+
+// the reject reason of a failed call to the token validation service
+func validationReason(err error) rejectReason {
+	switch err {
+	case errInvalidToken:
+		return invalidToken
+	case errMalformedResponse:
+		return authServiceFormat
+	default:
+		log.Println(err)
+		return authServiceAccess
+	}
+}
+
+// the failures to reach the token validation service are not reported
+// as invalid tokens
+func (f *filter) rejectValidation(ctx filters.FilterContext, uname string, err error) {
+	reason := validationReason(err)
+	if reason != authServiceAccess {
+		f.unauthorized(ctx, uname, reason)
+		return
+	}
+
+	status := f.options.AuthServiceErrorStatus
+	if status == 0 {
+		status = DefaultAuthServiceErrorStatus
+	}
+
+	f.reject(ctx, uname, reason, status)
+}
+
+func (f *filter) Request(ctx filters.FilterContext) {
+	r := ctx.Request()
+	if !f.limitBody(r) {
+		f.reject(ctx, "", requestTooLarge, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	for _, h := range f.options.stripHeaders() {
+		r.Header.Del(h)
+	}
+
+	if f.options.ForwardTeams {
+		r.Header.Del(teamsHeaderName)
+	}
+
+	if f.options.ForwardIdentity {
+		for _, h := range identityHeaders {
+			r.Header.Del(h)
+		}
+	}
+
+	if !f.forwardedByTrustedProxy(r) {
+		f.unauthorized(ctx, "", untrustedProxy)
+		return
+	}
+
+	if f.geoBlocked(r) {
+		status := f.options.GeoBlockedStatus
+		if status == 0 {
+			status = http.StatusUnavailableForLegalReasons
+		}
+
+		f.reject(ctx, "", geoBlocked, status)
+		return
+	}
+
+	if f.options.PassPreflight && isPreflight(r) {
+		if !f.originAllowed(r) {
+			f.unauthorized(ctx, "", originNotAllowed)
+		}
+
+		return
+	}
+
+	if f.trusted(r) {
+		ctx.StateBag()[authTrustedKey] = true
+		f.authorized(ctx, &authDoc{Uid: f.options.TrustedIdentity})
+		return
+	}
+
+	token, source, err := f.token(r)
+	if err == errRequestTooLarge {
+		f.reject(ctx, "", requestTooLarge, http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		f.unauthorized(ctx, "", missingBearerToken)
+		return
+	}
+
+	if source == TokenFromCookie && !f.requiredHeaders(r) {
+		f.unauthorized(ctx, "", csrfCheck)
+		return
+	}
+
+	var dpopThumbprint string
+	if f.options.DPoP {
+		if dpopThumbprint, err = verifyDPoP(r, token, f.options.now(), f.options.DPoPMaxAge); err != nil {
+			f.unauthorized(ctx, "", invalidDPoP)
+			return
+		}
+	}
+
+	if f.options.DecodeToken {
+		if token, err = url.PathUnescape(token); err != nil {
+			f.unauthorized(ctx, "", invalidToken)
+			return
+		}
+	}
+
+	if f.revoked(tokenHash(token)) {
+		f.unauthorized(ctx, "", tokenRevoked)
+		return
+	}
+
+	start := time.Now()
+	a, err := f.authClient.validate(token, f.options.BypassCache)
+	ctx.StateBag()[authDurationKey] = time.Since(start)
+	if f.authClient.source != "" {
+		ctx.StateBag()[authSourceKey] = f.authClient.source
+	}
+
+	if err != nil {
+		f.rejectValidation(ctx, "", err)
+		return
+	}
+
+	if f.userInfo != nil && len(a.Scopes) == 0 {
+		scopes, err := f.userInfo.getScopes(token)
+		if err != nil {
+			f.rejectValidation(ctx, a.Uid, err)
+			return
+		}
+
+		// the validation result may be cached, and shared
+		withScopes := *a
+		withScopes.Scopes = scopes
+		a = &withScopes
+	}
+
+	if f.options.ScopesFromToken {
+		scopes, err := jwtScopes(token)
+		if err != nil {
+			f.unauthorized(ctx, a.Uid, invalidToken)
+			return
+		}
+
+		// the validation result may be cached, and shared
+		withScopes := *a
+		withScopes.Scopes = scopes
+		a = &withScopes
+	}
+
+	if f.options.RequireUid && a.Uid == "" {
+		f.unauthorized(ctx, "", missingUid)
+		return
+	}
+
+	if f.options.RequireScopeField && !a.hasScopeField() {
+		f.unauthorized(ctx, a.Uid, missingScopeField)
+		return
+	}
+
+	if intersect(f.options.BlockedRealms, a.Realm) {
+		f.unauthorized(ctx, a.Uid, blockedRealm)
+		return
+	}
+
+	if !f.validateClaims(a) {
+		f.unauthorized(ctx, a.Uid, missingClaim)
+		return
+	}
+
+	if f.options.DPoP && !validateDPoPBinding(a, dpopThumbprint) {
+		f.unauthorized(ctx, a.Uid, invalidDPoP)
+		return
+	}
+
+	if !f.validateCookieBinding(r, a) {
+		f.unauthorized(ctx, a.Uid, bindingMismatch)
+		return
+	}
+
+	if !f.validateLifetime(a) {
+		f.unauthorized(ctx, a.Uid, tokenTooOld)
+		return
+	}
+
+	if !f.validateRealmScopes(a) {
+		f.unauthorized(ctx, a.Uid, scopeRealmViolation)
+		return
+	}
+
+	if !f.validateOnBehalfOf(r, a) {
+		f.unauthorized(ctx, a.Uid, impersonation)
+		return
+	}
+
+	if !f.validateMethod(r, a) {
+		f.unauthorized(ctx, a.Uid, methodNotPermitted)
+		return
+	}
+
+	if f.validateOnly {
+		f.authorized(ctx, a)
+		return
+	}
+
+	if f.revoked(a.Jti) {
+		f.unauthorized(ctx, a.Uid, tokenRevoked)
+		return
+	}
+
+	if intersect(f.options.DeniedScopes, a.Scopes) {
+		f.unauthorized(ctx, a.Uid, deniedScope)
+		return
+	}
+
+	if !f.validateTokenType(a) {
+		f.unauthorized(ctx, a.Uid, wrongTokenType)
+		return
+	}
+
+	if !f.validateRealm(a) {
+		f.unauthorized(ctx, a.Uid, invalidRealm)
+		return
+	}
+
+	if f.options.RequireCertIdentity && !f.validateCertIdentity(r, a) {
+		f.unauthorized(ctx, a.Uid, certIdentity)
+		return
+	}
+
+	if !f.validateDefaultScopes(r, a) {
+		f.unauthorized(ctx, a.Uid, invalidScope)
+		return
+	}
+
+	if !f.validateOwner(r, a) {
+		f.unauthorized(ctx, a.Uid, notResourceOwner)
+		return
+	}
+
+	switch f.typ {
+	case checkScope:
+		var (
+			valid   bool
+			matched []string
+		)
+
+		if f.options.ScopeRealmSeparator != "" {
+			valid, matched = f.validateRealmScope(r, a)
+		} else if prefix, ok := f.hostScopePrefix(r); ok {
+			if valid, matched = f.validateScope(r, tenantScopes(prefix, a.Scopes)); !valid {
+				f.unauthorized(ctx, a.Uid, tenantMismatch)
+				return
+			}
+		} else {
+			valid, matched = f.validateScope(r, a.Scopes)
+		}
+
+		if !valid && f.defaultScopeSufficient(a) {
+			valid, matched = true, matching(f.options.DefaultScopes, a.Scopes)
+		}
+
+		if !valid {
+			f.unauthorized(ctx, a.Uid, invalidScope)
+			return
+		}
+
+		if len(matched) > 0 {
+			ctx.StateBag()[authMatchedScopesKey] = matched
+		}
+
+		f.authorized(ctx, a)
+		return
+	case checkRole:
+		if valid, _ := f.validateScope(r, a.Roles); !valid {
+			f.unauthorized(ctx, a.Uid, invalidRole)
+			return
+		}
+
+		f.authorized(ctx, a)
+		return
+	case checkPolicy:
+		if allow, err := f.policyClient.allowed(a, r.Method, r.URL.Path); err != nil {
+			log.Println(err)
+			f.unauthorized(ctx, a.Uid, policyAccess)
+		} else if !allow {
+			f.unauthorized(ctx, a.Uid, policyDenied)
+		} else {
+			f.authorized(ctx, a)
+		}
+
+		return
+	}
+
+	if valid, teams, err := f.validateTeam(ctx, token, a); err != nil {
+		f.unauthorized(ctx, a.Uid, teamServiceAccess)
+		log.Println(err)
+	} else if !valid {
+		f.unauthorized(ctx, a.Uid, invalidTeam)
+	} else {
+		if f.options.ForwardTeams && len(teams) > 0 {
+			r.Header.Set(teamsHeaderName, strings.Join(teams, ","))
+		}
+
+		if len(teams) > 0 {
+			ctx.StateBag()[authMatchedTeamsKey] = teams
+		}
+
+		f.authorized(ctx, a)
+	}
+}
+
+func (f *filter) Response(_ filters.FilterContext) {}
+
+// Creates basicAuth filter specification.
+func NewBasicAuth() filters.Spec { return basic(BasicAuthName) }
+
+func (b basic) Name() string { return BasicAuthName }
+
+func (b basic) CreateFilter(args []interface{}) (filters.Filter, error) {
+	var (
+		uname, pwd string
+		ok         bool
+	)
+
+	if len(args) > 0 {
+		if uname, ok = args[0].(string); !ok {
+			return nil, filters.ErrInvalidFilterParameters
+		}
+	}
+
+	if len(args) > 1 {
+		if pwd, ok = args[1].(string); !ok {
+			return nil, filters.ErrInvalidFilterParameters
+		}
+	}
+
+	v := base64.StdEncoding.EncodeToString([]byte(uname + ":" + pwd))
+	return basic("Basic " + v), nil
+}
+
+func (b basic) Request(ctx filters.FilterContext) {
+	ctx.Request().Header.Set(authHeaderName, string(b))
+}
+
+func (b basic) Response(_ filters.FilterContext) {}
+
+func newTeeBody(rc io.ReadCloser, maxTee int) io.ReadCloser {
+	return &teeBody{
+		body:   rc,
+		buffer: bytes.NewBuffer(nil),
+		maxTee: maxTee}
+}
+
+// the bytes read are passed through unchanged, and only their copy is
+// truncated to the limit
+func (tb *teeBody) Read(b []byte) (int, error) {
+	tb.mu.Lock()
+	tb.read = true
+	tb.mu.Unlock()
+
+	n, err := tb.body.Read(b)
+
+	tb.mu.Lock()
+	tb.tee(b[:n])
+	tb.mu.Unlock()
+
+	return n, err
+}
+
+func (tb *teeBody) Close() error {
+	tb.mu.Lock()
+	tb.closed = true
+	tb.mu.Unlock()
+
+	return tb.body.Close()
+}
+
+func (tb *teeBody) tee(b []byte) {
+	if tb.maxTee < 0 {
+		tb.buffer.Write(b)
+		return
+	}
+
+	if len(b) > tb.maxTee {
+		b = b[:tb.maxTee]
+	}
+
+	tb.buffer.Write(b)
+	tb.maxTee -= len(b)
+}
+
+// returns the logged part of the body. When the body was not read by
+// the proxy, e.g. because the request was rejected, it reads the rest
+// of it up to the limit. Once the proxy started forwarding the body, it
+// is never read here, because it would take the bytes from the
+// backend.
+func (tb *teeBody) logged() string {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	if !tb.read && !tb.closed {
+		if tb.maxTee < 0 {
+			io.Copy(tb.buffer, tb.body)
+		} else {
+			io.CopyN(tb.buffer, tb.body, int64(tb.maxTee))
+		}
+	}
+
+	return tb.buffer.String()
+}
+
+// Creates an auditLog filter specification. It expects a writer for
+// the output of the log entries.
+//
+//     spec := NewAuditLog(os.Stderr)
+func NewAuditLog(w io.Writer) filters.Spec {
+	return NewAuditLogWithOptions(AuditLogOptions{Writer: w})
+}
+
+// Creates an auditLog filter specification with the settings in the
+// options. See AuditLogOptions. The specification implements
+// io.Closer. With AsyncBuffer, it needs to be closed on shutdown, to
+// write the queued entries.
+//
+//     spec := NewAuditLogWithOptions(AuditLogOptions{Writer: os.Stderr, Format: AuditCEF})
+func NewAuditLogWithOptions(o AuditLogOptions) filters.Spec {
+	al := &auditLog{options: &o}
+	if o.AsyncBuffer > 0 {
+		al.async = newAsyncAudit(al, o.AsyncBuffer, o.DropWhenFull)
+	}
+
+	return al
+}
+
+func (al *auditLog) Name() string { return AuditLogName }
 
 func (al *auditLog) CreateFilter(args []interface{}) (filters.Filter, error) {
 	if len(args) == 0 {
@@ -525,54 +3358,234 @@ func (al *auditLog) CreateFilter(args []interface{}) (filters.Filter, error) {
 	}
 
 	if mbl, ok := args[0].(float64); ok {
-		return &auditLog{writer: al.writer, maxBodyLog: int(mbl)}, nil
+		return &auditLog{options: al.options, maxBodyLog: int(mbl), async: al.async}, nil
 	} else {
 		return nil, filters.ErrInvalidFilterParameters
 	}
 }
 
+func (al *auditLog) debugRequested(r *http.Request) bool {
+	if al.options.DebugSecret == "" {
+		return false
+	}
+
+	debug := r.Header.Get(debugAuditHeaderName)
+	secret := r.Header.Get(debugAuditSecretHeaderName)
+	r.Header.Del(debugAuditHeaderName)
+	r.Header.Del(debugAuditSecretHeaderName)
+
+	return debug == debugAuditFull &&
+		subtle.ConstantTimeCompare([]byte(secret), []byte(al.options.DebugSecret)) == 1
+}
+
 func (al *auditLog) Request(ctx filters.FilterContext) {
-	if al.maxBodyLog != 0 {
-		ctx.Request().Body = newTeeBody(ctx.Request().Body, al.maxBodyLog)
+	maxBodyLog := al.maxBodyLog
+	if al.debugRequested(ctx.Request()) {
+		maxBodyLog = -1
+	}
+
+	// counted below the logged body, so that it is still found by the
+	// end of the request
+	if al.options.RecordSizes && ctx.Request().Body != nil {
+		cb := &countingBody{body: ctx.Request().Body}
+		ctx.Request().Body = cb
+		ctx.StateBag()[auditRequestBytesKey] = cb
+	}
+
+	if maxBodyLog != 0 {
+		ctx.Request().Body = newTeeBody(ctx.Request().Body, maxBodyLog)
+	}
+
+	// taken before the other filters can drop the Authorization header
+	if al.options.TokenFingerprint {
+		if token, err := getToken(ctx.Request()); err == nil {
+			ctx.StateBag()[auditFingerprintKey] = tokenFingerprint(token)
+		}
+	}
+
+	if al.options.PhaseEntries && !al.options.RejectedOnly {
+		al.writeStart(ctx)
+	}
+}
+
+func (al *auditLog) writeStart(ctx filters.FilterContext) {
+	req := ctx.Request()
+	doc := auditDoc{
+		Timestamp: time.Now().Format(time.RFC3339Nano),
+		Phase:     auditPhaseStart,
+		Method:    req.Method,
+		Path:      al.logPath(req.URL.Path),
+		Severity:  al.options.severity(""),
+		ClientIP:  clientIP(req)}
+
+	doc.TokenFingerprint, _ = ctx.StateBag()[auditFingerprintKey].(string)
+	if al.options.Sequence {
+		doc.Seq = atomic.AddUint64(&auditSeq, 1)
+	}
+
+	if err := al.write(&doc); err != nil {
+		log.Println(err)
 	}
 }
 
 func (al *auditLog) Response(ctx filters.FilterContext) {
+	sb := ctx.StateBag()
+	au, _ := sb[authUserKey].(string)
+	rr, _ := sb[authRejectReasonKey].(string)
+	grace, _ := sb[authGraceReasonKey].(string)
+	if al.options.RejectedOnly && rr == "" && grace == "" {
+		return
+	}
+
 	req := ctx.Request()
 
 	oreq := ctx.OriginalRequest()
+	if oreq == nil || al.options.LogCurrentRequest {
+		oreq = req
+	}
+
 	rsp := ctx.Response()
 	doc := auditDoc{
-		Method: oreq.Method,
-		Path:   oreq.URL.Path,
-		Status: rsp.StatusCode}
+		Timestamp: time.Now().Format(time.RFC3339Nano),
+		Method:    oreq.Method,
+		Path:      al.logPath(oreq.URL.Path),
+		Status:    rsp.StatusCode,
+		Severity:  al.options.severity(rr),
+		ClientIP:  clientIP(oreq)}
+
+	if al.options.PhaseEntries {
+		doc.Phase = auditPhaseEnd
+	}
 
-	sb := ctx.StateBag()
-	au, _ := sb[authUserKey].(string)
-	rr, _ := sb[authRejectReasonKey].(string)
-	if au != "" || rr != "" {
-		doc.AuthStatus = &authStatusDoc{User: au}
+	doc.TokenFingerprint, _ = sb[auditFingerprintKey].(string)
+	if al.options.Sequence {
+		doc.Seq = atomic.AddUint64(&auditSeq, 1)
+	}
+
+	trusted, _ := sb[authTrustedKey].(bool)
+	if au != "" || rr != "" || trusted || grace != "" {
+		doc.AuthStatus = &authStatusDoc{User: au, TrustedNetwork: trusted}
+		doc.AuthStatus.MatchedScopes, _ = sb[authMatchedScopesKey].([]string)
+		doc.AuthStatus.MatchedTeams, _ = sb[authMatchedTeamsKey].([]string)
+		doc.AuthStatus.ObservedScopes, _ = sb[authObservedKey].([]string)
+		doc.AuthStatus.AuthSource, _ = sb[authSourceKey].(string)
+		if realm, ok := sb[authRealmKey].(string); ok {
+			doc.AuthStatus.Realm = &realm
+		}
 		if rr != "" {
 			doc.AuthStatus.Rejected = true
 			doc.AuthStatus.Reason = rr
+		} else if grace != "" {
+			doc.AuthStatus.GraceAllowed = true
+			doc.AuthStatus.Reason = grace
 		}
 	}
 
 	if tb, ok := req.Body.(*teeBody); ok {
-		if tb.maxTee < 0 {
-			io.Copy(tb.buffer, tb.body)
-		} else {
-			io.CopyN(tb.buffer, tb.body, int64(tb.maxTee))
+		doc.RequestBody = tb.logged()
+	}
+
+	if al.options.RecordTimings {
+		doc.setTimings(sb, time.Now())
+	}
+
+	if al.options.RecordSizes {
+		al.writeWithSizes(sb, rsp, &doc)
+		return
+	}
+
+	al.writeOrLog(&doc)
+}
+
+func (al *auditLog) writeOrLog(doc *auditDoc) {
+	if err := al.write(doc); err != nil {
+		log.Println(err)
+	}
+}
+
+func (al *auditLog) logPath(p string) string {
+	if !al.options.NormalizePath || p == "" {
+		return p
+	}
+
+	return path.Clean(p)
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func (al *auditLog) write(doc *auditDoc) error {
+	if al.async != nil {
+		al.async.enqueue(doc)
+		return nil
+	}
+
+	return al.encode(doc)
+}
+
+func (al *auditLog) encode(doc *auditDoc) error {
+	var err error
+	if al.options.Writer != nil {
+		err = al.encodeTo(al.options.Writer, al.options.Format, doc)
+	}
+
+	// a failing sink doesn't prevent writing to the others
+	for _, s := range al.options.Sinks {
+		if serr := al.encodeTo(s.Writer, s.Format, doc); serr != nil && err == nil {
+			err = serr
+		}
+	}
+
+	return err
+}
+
+func (al *auditLog) encodeTo(w io.Writer, format AuditFormat, doc *auditDoc) error {
+	switch format {
+	case AuditCEF:
+		return writeCEF(w, doc)
+	case AuditLogfmt:
+		return writeLogfmt(w, doc)
+	default:
+		enc := json.NewEncoder(w)
+		if len(al.options.FieldNames) == 0 {
+			return enc.Encode(doc)
 		}
 
-		if tb.buffer.Len() > 0 {
-			doc.RequestBody = tb.buffer.String()
+		fields, err := renameFields(doc, al.options.FieldNames)
+		if err != nil {
+			return err
 		}
+
+		return enc.Encode(fields)
 	}
+}
 
-	enc := json.NewEncoder(al.writer)
-	err := enc.Encode(&doc)
+// returns the top level fields of the entry with the configured names
+func renameFields(doc *auditDoc, names map[string]string) (map[string]json.RawMessage, error) {
+	b, err := json.Marshal(doc)
 	if err != nil {
-		log.Println(err)
+		return nil, err
 	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+
+	renamed := make(map[string]json.RawMessage, len(fields))
+	for k, v := range fields {
+		if n, ok := names[k]; ok && n != "" {
+			k = n
+		}
+
+		renamed[k] = v
+	}
+
+	return renamed, nil
 }
@@ -1,16 +1,35 @@
 package skoap
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"reflect"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/zalando/skipper/eskip"
 	"github.com/zalando/skipper/filters"
+	"github.com/zalando/skipper/filters/filtertest"
 	"github.com/zalando/skipper/proxy/proxytest"
 )
 
@@ -34,8 +53,25 @@ type (
 		teamDoc
 		SomeOtherStuff string
 	}
+
+	// filtertest.Context doesn't provide the original request
+	testContext struct {
+		*filtertest.Context
+		originalRequest *http.Request
+	}
 )
 
+func (c *testContext) OriginalRequest() *http.Request { return c.originalRequest }
+
+func newTestContext(r *http.Request, rsp *http.Response) *testContext {
+	return &testContext{
+		Context: &filtertest.Context{
+			FRequest:  r,
+			FResponse: rsp,
+			FStateBag: make(map[string]interface{})},
+		originalRequest: r}
+}
+
 func lastQueryValue(url string) string {
 	s := strings.Split(url, "=")
 	if len(s) == 0 {
@@ -180,7 +216,7 @@ func Test(t *testing.T) {
 				return
 			}
 
-			d := testAuthDoc{authDoc{testUid, testRealm, []string{testScope}}, "noise"}
+			d := testAuthDoc{authDoc{Uid: testUid, Realm: realms{testRealm}, Scopes: []string{testScope}}, "noise"}
 			e := json.NewEncoder(w)
 			err = e.Encode(&d)
 			if err != nil {
@@ -278,7 +314,7 @@ func TestCaching(t *testing.T) {
 		backend := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {}))
 
 		authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			d := testAuthDoc{authDoc{testUid, testRealm, []string{testScope}}, "noise"}
+			d := testAuthDoc{authDoc{Uid: testUid, Realm: realms{testRealm}, Scopes: []string{testScope}}, "noise"}
 			e := json.NewEncoder(w)
 			err := e.Encode(&d)
 			if err != nil {
@@ -364,16 +400,16 @@ func TestUsers(t *testing.T) {
 
 		authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			token, err := getToken(r)
-			if err != nil || token != testToken || token != "test-token-2" {
+			if err != nil || token != testToken && token != "test-token-2" {
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
 
 			var d *testAuthDoc
 			if token == testToken {
-				d = &testAuthDoc{authDoc{testUid, testRealm, []string{testScope}}, "noise"}
+				d = &testAuthDoc{authDoc{Uid: testUid, Realm: realms{testRealm}, Scopes: []string{testScope}}, "noise"}
 			} else {
-				d = &testAuthDoc{authDoc{"john", testRealm, []string{testScope}}, "noise"}
+				d = &testAuthDoc{authDoc{Uid: "john", Realm: realms{testRealm}, Scopes: []string{testScope}}, "noise"}
 			}
 			e := json.NewEncoder(w)
 			err = e.Encode(d)
@@ -445,3 +481,4961 @@ func TestUsers(t *testing.T) {
 		}
 	}
 }
+
+func testAuthServer(t *testing.T, d interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := getToken(r)
+		if err != nil || token != testToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		e := json.NewEncoder(w)
+		if err := e.Encode(d); err != nil {
+			t.Error(err)
+		}
+	}))
+}
+
+func testRequest(t *testing.T, u, token string) *http.Response {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token != "" {
+		req.Header.Set(authHeaderName, "Bearer "+token)
+	}
+
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsp.Body.Close()
+	return rsp
+}
+
+func TestPathScopes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}, Scopes: []string{testScope}})
+	defer authServer.Close()
+
+	s := NewAuthWithOptions(Options{
+		AuthUrlBase: authServer.URL,
+		PathScopes: []PathScope{{
+			Path:   regexp.MustCompile("^/admin/"),
+			Scopes: []string{"admin"},
+		}, {
+			Path: regexp.MustCompile("^/public/"),
+		}, {
+			Path:   regexp.MustCompile("^/"),
+			Scopes: []string{testScope},
+		}}})
+
+	fr := make(filters.Registry)
+	fr.Register(s)
+	r := &eskip.Route{Filters: []*eskip.Filter{{Name: s.Name(), Args: []interface{}{"", "default-scope"}}}, Backend: backend.URL}
+	proxy := proxytest.New(fr, r)
+	defer proxy.Close()
+
+	for _, ti := range []struct {
+		msg        string
+		path       string
+		statusCode int
+	}{{
+		msg:        "admin path enforced",
+		path:       "/admin/users",
+		statusCode: http.StatusUnauthorized,
+	}, {
+		msg:        "public path passes",
+		path:       "/public/docs",
+		statusCode: http.StatusOK,
+	}, {
+		msg:        "first matching rule wins",
+		path:       "/orders",
+		statusCode: http.StatusOK,
+	}} {
+		rsp := testRequest(t, proxy.URL+ti.path, testToken)
+		if rsp.StatusCode != ti.statusCode {
+			t.Error(ti.msg, "auth filter failed", rsp.StatusCode, ti.statusCode)
+		}
+	}
+}
+
+func TestPathScopesDefault(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}, Scopes: []string{testScope}})
+	defer authServer.Close()
+
+	s := NewAuthWithOptions(Options{
+		AuthUrlBase: authServer.URL,
+		PathScopes: []PathScope{{
+			Path:   regexp.MustCompile("^/admin/"),
+			Scopes: []string{"admin"},
+		}}})
+
+	for _, ti := range []struct {
+		msg        string
+		args       []interface{}
+		statusCode int
+	}{{
+		msg:        "unmatched path, default scope not matching",
+		args:       []interface{}{"", "not-matching-scope"},
+		statusCode: http.StatusUnauthorized,
+	}, {
+		msg:        "unmatched path, default scope matching",
+		args:       []interface{}{"", testScope},
+		statusCode: http.StatusOK,
+	}} {
+		fr := make(filters.Registry)
+		fr.Register(s)
+		r := &eskip.Route{Filters: []*eskip.Filter{{Name: s.Name(), Args: ti.args}}, Backend: backend.URL}
+		proxy := proxytest.New(fr, r)
+
+		rsp := testRequest(t, proxy.URL+"/orders", testToken)
+		if rsp.StatusCode != ti.statusCode {
+			t.Error(ti.msg, "auth filter failed", rsp.StatusCode, ti.statusCode)
+		}
+
+		proxy.Close()
+	}
+}
+
+func TestRoles(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	authServer := testAuthServer(t, &authDoc{
+		Uid:    testUid,
+		Realm:  realms{testRealm},
+		Scopes: []string{testScope},
+		Roles:  []string{"operator"}})
+	defer authServer.Close()
+
+	for _, ti := range []struct {
+		msg        string
+		spec       filters.Spec
+		args       []interface{}
+		statusCode int
+	}{{
+		msg:        "auth only",
+		spec:       NewAuthRole(authServer.URL),
+		statusCode: http.StatusOK,
+	}, {
+		msg:        "matching role",
+		spec:       NewAuthRole(authServer.URL),
+		args:       []interface{}{testRealm, "admin", "operator"},
+		statusCode: http.StatusOK,
+	}, {
+		msg:        "no matching role",
+		spec:       NewAuthRole(authServer.URL),
+		args:       []interface{}{testRealm, "admin"},
+		statusCode: http.StatusUnauthorized,
+	}, {
+		msg:        "scope is not a role",
+		spec:       NewAuthRole(authServer.URL),
+		args:       []interface{}{testRealm, testScope},
+		statusCode: http.StatusUnauthorized,
+	}, {
+		msg:        "role is not a scope",
+		spec:       NewAuth(authServer.URL),
+		args:       []interface{}{testRealm, "operator"},
+		statusCode: http.StatusUnauthorized,
+	}, {
+		msg:        "invalid realm",
+		spec:       NewAuthRole(authServer.URL),
+		args:       []interface{}{"/not-matching-realm", "operator"},
+		statusCode: http.StatusUnauthorized,
+	}} {
+		fr := make(filters.Registry)
+		fr.Register(ti.spec)
+		r := &eskip.Route{Filters: []*eskip.Filter{{Name: ti.spec.Name(), Args: ti.args}}, Backend: backend.URL}
+		proxy := proxytest.New(fr, r)
+
+		rsp := testRequest(t, proxy.URL, testToken)
+		if rsp.StatusCode != ti.statusCode {
+			t.Error(ti.msg, "auth filter failed", rsp.StatusCode, ti.statusCode)
+		}
+
+		proxy.Close()
+	}
+}
+
+func TestAuthNoChecks(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}, Scopes: []string{testScope}})
+	defer authServer.Close()
+
+	s := NewAuth(authServer.URL)
+	for _, ti := range []struct {
+		msg          string
+		args         []interface{}
+		validateOnly bool
+	}{{
+		msg:          "no args",
+		validateOnly: true,
+	}, {
+		msg:          "empty realm",
+		args:         []interface{}{""},
+		validateOnly: true,
+	}, {
+		msg:  "realm",
+		args: []interface{}{testRealm},
+	}, {
+		msg:  "scopes",
+		args: []interface{}{"", testScope},
+	}} {
+		f, err := s.CreateFilter(ti.args)
+		if err != nil {
+			t.Error(ti.msg, err)
+			continue
+		}
+
+		if f.(*filter).validateOnly != ti.validateOnly {
+			t.Error(ti.msg, "invalid fast path setting")
+			continue
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, "Bearer "+testToken)
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if ctx.FServedWithResponse || ctx.StateBag()[authUserKey] != testUid {
+			t.Error(ti.msg, "failed to authorize")
+		}
+	}
+}
+
+func BenchmarkAuthNoChecks(b *testing.B) {
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"uid": "jdoe", "realm": "/immortals"}`))
+	}))
+	defer authServer.Close()
+
+	f, err := NewAuth(authServer.URL).CreateFilter(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "https://www.example.org", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	req.Header.Set(authHeaderName, "Bearer "+testToken)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if ctx.FServedWithResponse {
+			b.Fatal("failed to authorize")
+		}
+	}
+}
+
+func TestAuditRejectedOnly(t *testing.T) {
+	var b bytes.Buffer
+	s := NewAuditLogWithOptions(AuditLogOptions{Writer: &b, RejectedOnly: true})
+	f, err := s.CreateFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ti := range []struct {
+		msg        string
+		user       string
+		reason     rejectReason
+		statusCode int
+		logged     bool
+	}{{
+		msg:        "unauthenticated success",
+		statusCode: http.StatusOK,
+	}, {
+		msg:        "authenticated success",
+		user:       testUid,
+		statusCode: http.StatusOK,
+	}, {
+		msg:        "rejected, no user",
+		reason:     missingBearerToken,
+		statusCode: http.StatusUnauthorized,
+		logged:     true,
+	}, {
+		msg:        "rejected, user",
+		user:       testUid,
+		reason:     invalidScope,
+		statusCode: http.StatusUnauthorized,
+		logged:     true,
+	}} {
+		b.Reset()
+
+		req, err := http.NewRequest("GET", "https://www.example.org/foo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := newTestContext(req, &http.Response{StatusCode: ti.statusCode})
+		if ti.user != "" {
+			ctx.StateBag()[authUserKey] = ti.user
+		}
+
+		if ti.reason != "" {
+			ctx.StateBag()[authRejectReasonKey] = string(ti.reason)
+		}
+
+		f.Request(ctx)
+		f.Response(ctx)
+
+		if !ti.logged {
+			if b.Len() != 0 {
+				t.Error(ti.msg, "unexpected entry", b.String())
+			}
+
+			continue
+		}
+
+		var doc auditDoc
+		if err := json.Unmarshal(b.Bytes(), &doc); err != nil {
+			t.Error(ti.msg, err)
+			continue
+		}
+
+		if doc.Status != ti.statusCode || doc.AuthStatus == nil ||
+			!doc.AuthStatus.Rejected || doc.AuthStatus.Reason != string(ti.reason) ||
+			doc.AuthStatus.User != ti.user {
+			t.Error(ti.msg, "invalid entry", b.String())
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}})
+	defer authServer.Close()
+
+	teamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id": "test-team"}]`))
+	}))
+	defer teamServer.Close()
+
+	s := NewAuthTeamWithOptions(Options{AuthUrlBase: authServer.URL, TeamUrlBase: teamServer.URL + "?member="})
+	fr := make(filters.Registry)
+	fr.Register(s)
+	r := &eskip.Route{Filters: []*eskip.Filter{{Name: s.Name(), Args: []interface{}{testRealm, testTeam}}}, Backend: backend.URL}
+	proxy := proxytest.New(fr, r)
+	defer proxy.Close()
+
+	for i := 0; i < 3; i++ {
+		if rsp := testRequest(t, proxy.URL, testToken); rsp.StatusCode != http.StatusOK {
+			t.Fatal("auth filter failed", rsp.StatusCode)
+		}
+	}
+
+	st := s.Stats()
+	if st.Teams.Entries != 1 || st.Teams.Hits != 2 || st.Teams.Misses != 1 || st.Teams.Evictions != 0 {
+		t.Error("invalid team cache stats", st.Teams)
+	}
+
+	if st := NewAuthWithOptions(Options{}).Stats(); st != (Stats{}) {
+		t.Error("unexpected stats", st)
+	}
+}
+
+func TestRealmsDecoding(t *testing.T) {
+	for _, ti := range []struct {
+		msg    string
+		doc    string
+		realms realms
+		fail   bool
+	}{{
+		msg: "missing",
+		doc: `{"uid": "jdoe"}`,
+	}, {
+		msg: "empty",
+		doc: `{"uid": "jdoe", "realm": ""}`,
+	}, {
+		msg:    "single",
+		doc:    `{"uid": "jdoe", "realm": "/employees"}`,
+		realms: realms{"/employees"},
+	}, {
+		msg:    "multiple",
+		doc:    `{"uid": "jdoe", "realm": ["employees", "contractors"]}`,
+		realms: realms{"employees", "contractors"},
+	}, {
+		msg:  "invalid",
+		doc:  `{"uid": "jdoe", "realm": 42}`,
+		fail: true,
+	}} {
+		var a authDoc
+		err := json.Unmarshal([]byte(ti.doc), &a)
+		if ti.fail {
+			if err == nil {
+				t.Error(ti.msg, "failed to fail")
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Error(ti.msg, err)
+			continue
+		}
+
+		if len(a.Realm) != len(ti.realms) {
+			t.Error(ti.msg, "invalid realms", a.Realm, ti.realms)
+			continue
+		}
+
+		for i := range ti.realms {
+			if a.Realm[i] != ti.realms[i] {
+				t.Error(ti.msg, "invalid realms", a.Realm, ti.realms)
+			}
+		}
+	}
+}
+
+func TestMultipleRealms(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	for _, ti := range []struct {
+		msg        string
+		realms     string
+		args       []interface{}
+		statusCode int
+	}{{
+		msg:        "single realm token, matching",
+		realms:     `"/employees"`,
+		args:       []interface{}{"/employees"},
+		statusCode: http.StatusOK,
+	}, {
+		msg:        "single realm token, not matching",
+		realms:     `"/employees"`,
+		args:       []interface{}{"/services"},
+		statusCode: http.StatusUnauthorized,
+	}, {
+		msg:        "single realm token, matching an additional realm",
+		realms:     `"/employees"`,
+		args:       []interface{}{"/services", "/employees", testScope},
+		statusCode: http.StatusOK,
+	}, {
+		msg:        "multi realm token, matching",
+		realms:     `["/employees", "/contractors"]`,
+		args:       []interface{}{"/contractors"},
+		statusCode: http.StatusOK,
+	}, {
+		msg:        "multi realm token, not matching",
+		realms:     `["/employees", "/contractors"]`,
+		args:       []interface{}{"/services", "/partners"},
+		statusCode: http.StatusUnauthorized,
+	}, {
+		msg:        "multi realm token, matching, not matching scope",
+		realms:     `["/employees", "/contractors"]`,
+		args:       []interface{}{"/services", "/employees", "not-matching-scope"},
+		statusCode: http.StatusUnauthorized,
+	}, {
+		msg:        "scopes only",
+		realms:     `["/employees", "/contractors"]`,
+		args:       []interface{}{"", testScope},
+		statusCode: http.StatusOK,
+	}} {
+		authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"uid": "jdoe", "scope": ["test-scope"], "realm": ` + ti.realms + `}`))
+		}))
+
+		s := NewAuth(authServer.URL)
+		fr := make(filters.Registry)
+		fr.Register(s)
+		r := &eskip.Route{Filters: []*eskip.Filter{{Name: s.Name(), Args: ti.args}}, Backend: backend.URL}
+		proxy := proxytest.New(fr, r)
+
+		rsp := testRequest(t, proxy.URL, testToken)
+		if rsp.StatusCode != ti.statusCode {
+			t.Error(ti.msg, "auth filter failed", rsp.StatusCode, ti.statusCode)
+		}
+
+		proxy.Close()
+		authServer.Close()
+	}
+}
+
+func testClientCert(t *testing.T, cn string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCertIdentity(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}})
+	defer authServer.Close()
+
+	for _, ti := range []struct {
+		msg      string
+		options  Options
+		clientCN string
+		served   bool
+	}{{
+		msg:      "matching certificate",
+		options:  Options{RequireCertIdentity: true},
+		clientCN: testUid,
+	}, {
+		msg:      "mismatching certificate",
+		options:  Options{RequireCertIdentity: true},
+		clientCN: "john",
+		served:   true,
+	}, {
+		msg:     "missing certificate",
+		options: Options{RequireCertIdentity: true},
+		served:  true,
+	}, {
+		msg: "mapped identity",
+		options: Options{
+			RequireCertIdentity: true,
+			CertIdentity:        func(uid string) string { return uid + ".example.org" }},
+		clientCN: testUid + ".example.org",
+	}, {
+		msg:      "not required",
+		clientCN: "john",
+	}} {
+		ti.options.AuthUrlBase = authServer.URL
+		f, err := NewAuthWithOptions(ti.options).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := newTestContext(r, nil)
+			f.Request(ctx)
+			if ctx.FServedWithResponse {
+				w.WriteHeader(ctx.FResponse.StatusCode)
+			}
+		}))
+
+		server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+		server.StartTLS()
+
+		client := server.Client()
+		if ti.clientCN != "" {
+			client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{
+				testClientCert(t, ti.clientCN)}
+		}
+
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, "Bearer "+testToken)
+		rsp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(ti.msg, err)
+		}
+
+		rsp.Body.Close()
+		if ti.served && rsp.StatusCode != http.StatusUnauthorized ||
+			!ti.served && rsp.StatusCode != http.StatusOK {
+			t.Error(ti.msg, "cert identity check failed", rsp.StatusCode)
+		}
+
+		server.Close()
+	}
+}
+
+func TestDefaultScopes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	for _, ti := range []struct {
+		msg        string
+		scopes     []string
+		policy     DefaultScopePolicy
+		args       []interface{}
+		statusCode int
+	}{{
+		msg:        "and, missing default scope, matching filter scope",
+		scopes:     []string{testScope},
+		args:       []interface{}{"", testScope},
+		statusCode: http.StatusUnauthorized,
+	}, {
+		msg:        "and, missing default scope, no filter scope",
+		scopes:     []string{testScope},
+		args:       []interface{}{testRealm},
+		statusCode: http.StatusUnauthorized,
+	}, {
+		msg:        "and, default scope, no filter scope",
+		scopes:     []string{testScope, "api-access"},
+		args:       []interface{}{testRealm},
+		statusCode: http.StatusOK,
+	}, {
+		msg:        "and, default scope, not matching filter scope",
+		scopes:     []string{"api-access"},
+		args:       []interface{}{"", testScope},
+		statusCode: http.StatusUnauthorized,
+	}, {
+		msg:        "and, default scope, matching filter scope",
+		scopes:     []string{testScope, "api-access"},
+		args:       []interface{}{"", testScope},
+		statusCode: http.StatusOK,
+	}, {
+		msg:        "or, missing default scope, no filter scope",
+		scopes:     []string{testScope},
+		policy:     DefaultScopesOr,
+		statusCode: http.StatusUnauthorized,
+	}, {
+		msg:        "or, missing default scope, matching filter scope",
+		scopes:     []string{testScope},
+		policy:     DefaultScopesOr,
+		args:       []interface{}{"", testScope},
+		statusCode: http.StatusOK,
+	}, {
+		msg:        "or, default scope, not matching filter scope",
+		scopes:     []string{"api-access"},
+		policy:     DefaultScopesOr,
+		args:       []interface{}{"", testScope},
+		statusCode: http.StatusOK,
+	}, {
+		msg:        "or, no scope matching",
+		scopes:     []string{"other-scope"},
+		policy:     DefaultScopesOr,
+		args:       []interface{}{"", testScope},
+		statusCode: http.StatusUnauthorized,
+	}} {
+		authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}, Scopes: ti.scopes})
+		s := NewAuthWithOptions(Options{
+			AuthUrlBase:        authServer.URL,
+			DefaultScopes:      []string{"api-access"},
+			DefaultScopePolicy: ti.policy})
+
+		fr := make(filters.Registry)
+		fr.Register(s)
+		r := &eskip.Route{Filters: []*eskip.Filter{{Name: s.Name(), Args: ti.args}}, Backend: backend.URL}
+		proxy := proxytest.New(fr, r)
+
+		rsp := testRequest(t, proxy.URL, testToken)
+		if rsp.StatusCode != ti.statusCode {
+			t.Error(ti.msg, "auth filter failed", rsp.StatusCode, ti.statusCode)
+		}
+
+		proxy.Close()
+		authServer.Close()
+	}
+}
+
+func TestDefaultScopesRoles(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Roles: []string{"admin"}})
+	defer authServer.Close()
+
+	f, err := NewAuthRoleWithOptions(Options{
+		AuthUrlBase:        authServer.URL,
+		DefaultScopes:      []string{"api-access"},
+		DefaultScopePolicy: DefaultScopesOr}).CreateFilter([]interface{}{"", "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "https://www.example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set(authHeaderName, "Bearer "+testToken)
+	ctx := newTestContext(req, nil)
+	f.Request(ctx)
+	if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(invalidScope) {
+		t.Error("failed to require the default scope")
+	}
+}
+
+func TestBodyToken(t *testing.T) {
+	const body = `<?xml version="1.0"?>
+<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope">
+	<soap:Header><Token>test-token</Token></soap:Header>
+	<soap:Body><GetOrder><Id>42</Id></GetOrder></soap:Body>
+</soap:Envelope>`
+
+	var received string
+	backend := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		received = string(b)
+	}))
+	defer backend.Close()
+
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}})
+	defer authServer.Close()
+
+	s := NewAuthWithOptions(Options{
+		AuthUrlBase:           authServer.URL,
+		BodyToken:             regexp.MustCompile("<Token>([^<]*)</Token>"),
+		BodyTokenContentTypes: []string{"text/xml", "application/soap+xml"}})
+
+	fr := make(filters.Registry)
+	fr.Register(s)
+	r := &eskip.Route{Filters: []*eskip.Filter{{Name: s.Name()}}, Backend: backend.URL}
+	proxy := proxytest.New(fr, r)
+	defer proxy.Close()
+
+	for _, ti := range []struct {
+		msg         string
+		contentType string
+		body        string
+		statusCode  int
+	}{{
+		msg:         "token in the body",
+		contentType: "text/xml; charset=utf-8",
+		body:        body,
+		statusCode:  http.StatusOK,
+	}, {
+		msg:         "invalid token in the body",
+		contentType: "text/xml",
+		body:        strings.Replace(body, testToken, "invalid-token", -1),
+		statusCode:  http.StatusUnauthorized,
+	}, {
+		msg:         "no token in the body",
+		contentType: "text/xml",
+		body:        "<foo/>",
+		statusCode:  http.StatusUnauthorized,
+	}, {
+		msg:         "not matching content type",
+		contentType: "application/json",
+		body:        body,
+		statusCode:  http.StatusUnauthorized,
+	}} {
+		received = ""
+
+		req, err := http.NewRequest("POST", proxy.URL, strings.NewReader(ti.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Content-Type", ti.contentType)
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rsp.Body.Close()
+		if rsp.StatusCode != ti.statusCode {
+			t.Error(ti.msg, "auth filter failed", rsp.StatusCode, ti.statusCode)
+			continue
+		}
+
+		if ti.statusCode == http.StatusOK && received != ti.body {
+			t.Error(ti.msg, "failed to forward the body", received)
+		}
+	}
+}
+
+func TestBodyTokenLimit(t *testing.T) {
+	f, err := NewAuthWithOptions(Options{
+		BodyToken:         regexp.MustCompile("token=([a-z-]+)"),
+		MaxBodyTokenBytes: 16}).CreateFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := strings.Repeat("x", 16) + "token=test-token"
+	req, err := http.NewRequest("POST", "https://www.example.org", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.(*filter).bodyToken(req); err == nil {
+		t.Error("failed to limit the body")
+	}
+
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != body {
+		t.Error("failed to restore the body", string(b))
+	}
+}
+
+func TestStrictDecoding(t *testing.T) {
+	for _, ti := range []struct {
+		msg    string
+		strict bool
+		body   string
+		reason rejectReason
+	}{{
+		msg:  "lenient, unknown fields",
+		body: `{"uid": "jdoe", "realm": "/immortals", "foo": "bar"}`,
+	}, {
+		msg:  "lenient, trailing data",
+		body: `{"uid": "jdoe", "realm": "/immortals"}{"uid": "john"}`,
+	}, {
+		msg:    "strict, valid",
+		strict: true,
+		body:   "{\"uid\": \"jdoe\", \"realm\": \"/immortals\"}\n",
+	}, {
+		msg:    "strict, unknown fields",
+		strict: true,
+		body:   `{"uid": "jdoe", "realm": "/immortals", "foo": "bar"}`,
+		reason: authServiceFormat,
+	}, {
+		msg:    "strict, trailing data",
+		strict: true,
+		body:   `{"uid": "jdoe", "realm": "/immortals"}{"uid": "john"}`,
+		reason: authServiceFormat,
+	}, {
+		msg:    "strict, trailing garbage",
+		strict: true,
+		body:   `{"uid": "jdoe", "realm": "/immortals"} foo`,
+		reason: authServiceFormat,
+	}, {
+		msg:    "strict, invalid",
+		strict: true,
+		body:   `{"uid": 42}`,
+		reason: authServiceFormat,
+	}} {
+		authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(ti.body))
+		}))
+
+		f, err := NewAuthWithOptions(Options{
+			AuthUrlBase:    authServer.URL,
+			StrictDecoding: ti.strict}).CreateFilter([]interface{}{testRealm})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, "Bearer "+testToken)
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+
+		if ti.reason == "" {
+			if ctx.FServedWithResponse || ctx.StateBag()[authUserKey] != testUid {
+				t.Error(ti.msg, "failed to authorize")
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+
+		authServer.Close()
+	}
+}
+
+func TestRequireTokenType(t *testing.T) {
+	for _, ti := range []struct {
+		msg      string
+		required string
+		doc      *authDoc
+		reject   bool
+	}{{
+		msg: "not required",
+		doc: &authDoc{Uid: testUid, TokenType: "id"},
+	}, {
+		msg:      "matching token_type",
+		required: "access",
+		doc:      &authDoc{Uid: testUid, TokenType: "access"},
+	}, {
+		msg:      "matching typ, different case",
+		required: "access",
+		doc:      &authDoc{Uid: testUid, Typ: "Access"},
+	}, {
+		msg:      "mismatching token_type",
+		required: "access",
+		doc:      &authDoc{Uid: testUid, TokenType: "id"},
+		reject:   true,
+	}, {
+		msg:      "mismatching typ",
+		required: "access",
+		doc:      &authDoc{Uid: testUid, Typ: "id"},
+		reject:   true,
+	}, {
+		msg:      "missing",
+		required: "access",
+		doc:      &authDoc{Uid: testUid},
+		reject:   true,
+	}} {
+		authServer := testAuthServer(t, ti.doc)
+		f, err := NewAuthWithOptions(Options{
+			AuthUrlBase:      authServer.URL,
+			RequireTokenType: ti.required}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, "Bearer "+testToken)
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+
+		if ti.reject {
+			if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(wrongTokenType) {
+				t.Error(ti.msg, "failed to reject")
+			}
+		} else if ctx.FServedWithResponse {
+			t.Error(ti.msg, "failed to authorize")
+		}
+
+		authServer.Close()
+	}
+}
+
+// creates a filter from the spec, and executes its request phase with
+// the token
+func testAuthFilter(t *testing.T, s filters.Spec, args []interface{}, token string) *testContext {
+	f, err := s.CreateFilter(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "https://www.example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token != "" {
+		req.Header.Set(authHeaderName, "Bearer "+token)
+	}
+
+	ctx := newTestContext(req, nil)
+	f.Request(ctx)
+	return ctx
+}
+
+func TestForwardTeams(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}})
+	defer authServer.Close()
+
+	teamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id": "viewers"}, {"id": "test-team"}, {"id": "admins"}]`))
+	}))
+	defer teamServer.Close()
+
+	for _, ti := range []struct {
+		msg     string
+		forward bool
+		args    []interface{}
+		header  string
+	}{{
+		msg:  "not forwarded",
+		args: []interface{}{testRealm, "admins", "viewers"},
+	}, {
+		msg:     "forwarded in configured order",
+		forward: true,
+		args:    []interface{}{testRealm, "admins", "editors", "viewers"},
+		header:  "admins,viewers",
+	}, {
+		msg:     "forwarded in different configured order",
+		forward: true,
+		args:    []interface{}{testRealm, "viewers", testTeam, "admins"},
+		header:  "viewers,test-team,admins",
+	}, {
+		msg:     "no team check",
+		forward: true,
+		args:    []interface{}{testRealm},
+	}} {
+		s := NewAuthTeamWithOptions(Options{
+			AuthUrlBase:  authServer.URL,
+			TeamUrlBase:  teamServer.URL + "?member=",
+			ForwardTeams: ti.forward})
+
+		ctx := testAuthFilter(t, s, ti.args, testToken)
+		if ctx.FServedWithResponse {
+			t.Error(ti.msg, "failed to authorize")
+			continue
+		}
+
+		if h := ctx.Request().Header.Get(teamsHeaderName); h != ti.header {
+			t.Error(ti.msg, "invalid teams header", h, ti.header)
+		}
+	}
+}
+
+func TestEmptyTeams(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}})
+	defer authServer.Close()
+
+	for _, ti := range []struct {
+		msg    string
+		body   string
+		reason rejectReason
+	}{{
+		msg:    "null",
+		body:   "null",
+		reason: invalidTeam,
+	}, {
+		msg:    "empty list",
+		body:   "[]",
+		reason: invalidTeam,
+	}, {
+		msg:    "empty body",
+		reason: invalidTeam,
+	}, {
+		msg:    "whitespace body",
+		body:   " \n",
+		reason: invalidTeam,
+	}, {
+		msg:    "object",
+		body:   "{}",
+		reason: teamServiceAccess,
+	}, {
+		msg:    "malformed",
+		body:   `[{"id": "test-`,
+		reason: teamServiceAccess,
+	}} {
+		teamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(ti.body))
+		}))
+
+		s := NewAuthTeamWithOptions(Options{AuthUrlBase: authServer.URL, TeamUrlBase: teamServer.URL + "?member="})
+		ctx := testAuthFilter(t, s, []interface{}{testRealm, testTeam}, testToken)
+		if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "invalid reject reason", ctx.StateBag()[authRejectReasonKey], ti.reason)
+		}
+
+		teamServer.Close()
+	}
+}
+
+func TestAuditDebugHeader(t *testing.T) {
+	const body = "Hello, world!"
+
+	var b bytes.Buffer
+	s := NewAuditLogWithOptions(AuditLogOptions{Writer: &b, DebugSecret: "test-secret"})
+	for _, ti := range []struct {
+		msg     string
+		limit   interface{}
+		debug   string
+		secret  string
+		logged  string
+		removed bool
+	}{{
+		msg:    "no header",
+		limit:  float64(5),
+		logged: "Hello",
+	}, {
+		msg:     "debug header with secret",
+		limit:   float64(5),
+		debug:   "full",
+		secret:  "test-secret",
+		logged:  body,
+		removed: true,
+	}, {
+		msg:     "debug header with secret, body logging disabled",
+		limit:   float64(0),
+		debug:   "full",
+		secret:  "test-secret",
+		logged:  body,
+		removed: true,
+	}, {
+		msg:     "debug header with wrong secret",
+		limit:   float64(5),
+		debug:   "full",
+		secret:  "wrong-secret",
+		logged:  "Hello",
+		removed: true,
+	}, {
+		msg:     "debug header without secret",
+		limit:   float64(5),
+		debug:   "full",
+		logged:  "Hello",
+		removed: true,
+	}, {
+		msg:     "unknown debug value",
+		limit:   float64(5),
+		debug:   "verbose",
+		secret:  "test-secret",
+		logged:  "Hello",
+		removed: true,
+	}} {
+		b.Reset()
+
+		f, err := s.CreateFilter([]interface{}{ti.limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("POST", "https://www.example.org", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ti.debug != "" {
+			req.Header.Set(debugAuditHeaderName, ti.debug)
+		}
+
+		if ti.secret != "" {
+			req.Header.Set(debugAuditSecretHeaderName, ti.secret)
+		}
+
+		ctx := newTestContext(req, &http.Response{StatusCode: http.StatusOK})
+		f.Request(ctx)
+
+		if ti.removed && (req.Header.Get(debugAuditHeaderName) != "" || req.Header.Get(debugAuditSecretHeaderName) != "") {
+			t.Error(ti.msg, "failed to remove the debug headers")
+		}
+
+		if _, err := ioutil.ReadAll(req.Body); err != nil {
+			t.Fatal(err)
+		}
+
+		f.Response(ctx)
+
+		var doc auditDoc
+		if err := json.Unmarshal(b.Bytes(), &doc); err != nil {
+			t.Error(ti.msg, err)
+			continue
+		}
+
+		if doc.RequestBody != ti.logged {
+			t.Error(ti.msg, "invalid body logged", doc.RequestBody, ti.logged)
+		}
+	}
+}
+
+func TestAuditChunkedUpload(t *testing.T) {
+	// printable, to be logged unescaped
+	body := make([]byte, 3<<20)
+	for i := range body {
+		body[i] = byte('a' + (i*7+i/251)%26)
+	}
+
+	var (
+		mu       sync.Mutex
+		received []byte
+	)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		mu.Lock()
+		received = b
+		mu.Unlock()
+	}))
+	defer backend.Close()
+
+	for _, ti := range []struct {
+		msg   string
+		limit float64
+	}{{
+		msg:   "limited",
+		limit: 1000,
+	}, {
+		msg:   "limit above the body size",
+		limit: 4 << 20,
+	}, {
+		msg:   "unlimited",
+		limit: -1,
+	}} {
+		var logged bytes.Buffer
+		s := NewAuditLogWithOptions(AuditLogOptions{Writer: &logged})
+		fr := make(filters.Registry)
+		fr.Register(s)
+		r := &eskip.Route{Filters: []*eskip.Filter{{Name: s.Name(), Args: []interface{}{ti.limit}}}, Backend: backend.URL}
+		proxy := proxytest.New(fr, r)
+
+		// written in irregular chunks, with unknown length
+		pr, pw := io.Pipe()
+		go func() {
+			for i, n := 0, 1; i < len(body); i, n = i+n, n*3%65521+1 {
+				if i+n > len(body) {
+					n = len(body) - i
+				}
+
+				pw.Write(body[i : i+n])
+			}
+
+			pw.Close()
+		}()
+
+		req, err := http.NewRequest("POST", proxy.URL, pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rsp.Body.Close()
+		proxy.Close()
+
+		mu.Lock()
+		if !bytes.Equal(received, body) {
+			t.Error(ti.msg, "the backend received a different body", len(received), len(body))
+		}
+
+		received = nil
+		mu.Unlock()
+
+		var doc auditDoc
+		if err := json.Unmarshal(logged.Bytes(), &doc); err != nil {
+			t.Error(ti.msg, err)
+			continue
+		}
+
+		expected := body
+		if ti.limit >= 0 && int(ti.limit) < len(body) {
+			expected = body[:int(ti.limit)]
+		}
+
+		if doc.RequestBody != string(expected) {
+			t.Error(ti.msg, "invalid body logged", len(doc.RequestBody), len(expected))
+		}
+	}
+}
+
+func TestAuditPartiallyReadBody(t *testing.T) {
+	const body = "Hello, world!"
+
+	var b bytes.Buffer
+	f, err := NewAuditLogWithOptions(AuditLogOptions{Writer: &b}).CreateFilter([]interface{}{float64(10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "https://www.example.org", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := newTestContext(req, &http.Response{StatusCode: http.StatusOK})
+	f.Request(ctx)
+
+	p := make([]byte, 3)
+	if _, err := io.ReadFull(req.Body, p); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Response(ctx)
+
+	// the rest of the body is left for the backend
+	rest, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(p)+string(rest) != body {
+		t.Error("the body was altered", string(p)+string(rest))
+	}
+
+	var doc auditDoc
+	if err := json.Unmarshal(b.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.RequestBody != "Hel" {
+		t.Error("invalid body logged", doc.RequestBody)
+	}
+}
+
+func TestAuthCache(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	var authReqs int
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authReqs++
+		if token, err := getToken(r); err != nil || token != testToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Write([]byte(`{"uid": "jdoe", "realm": "/immortals"}`))
+	}))
+	defer authServer.Close()
+
+	for _, ti := range []struct {
+		msg      string
+		options  Options
+		token    string
+		authReqs int
+	}{{
+		msg:      "no caching",
+		options:  Options{},
+		token:    testToken,
+		authReqs: 3,
+	}, {
+		msg:      "caching",
+		options:  Options{AuthCacheTTL: time.Minute},
+		token:    testToken,
+		authReqs: 1,
+	}, {
+		msg:      "invalid tokens not cached",
+		options:  Options{AuthCacheTTL: time.Minute},
+		token:    "invalid-token",
+		authReqs: 3,
+	}, {
+		msg:      "bypass cache",
+		options:  Options{Name: "authFresh", AuthCacheTTL: time.Minute, BypassCache: true},
+		token:    testToken,
+		authReqs: 3,
+	}} {
+		authReqs = 0
+
+		ti.options.AuthUrlBase = authServer.URL
+		s := NewAuthWithOptions(ti.options)
+		if ti.options.Name != "" && s.Name() != ti.options.Name {
+			t.Error(ti.msg, "failed to override the name", s.Name())
+		}
+
+		fr := make(filters.Registry)
+		fr.Register(s)
+		r := &eskip.Route{Filters: []*eskip.Filter{{Name: s.Name(), Args: []interface{}{testRealm}}}, Backend: backend.URL}
+		proxy := proxytest.New(fr, r)
+
+		for i := 0; i < 3; i++ {
+			testRequest(t, proxy.URL, ti.token)
+		}
+
+		if authReqs != ti.authReqs {
+			t.Error(ti.msg, "invalid number of auth service requests", authReqs, ti.authReqs)
+		}
+
+		proxy.Close()
+	}
+}
+
+func TestScopeClaim(t *testing.T) {
+	const claim = "https://myapp.example.org/scopes"
+	for _, ti := range []struct {
+		msg    string
+		strict bool
+		body   string
+		reason rejectReason
+	}{{
+		msg:  "namespaced claim",
+		body: `{"uid": "jdoe", "realm": "/immortals", "https://myapp.example.org/scopes": ["foo", "bar"]}`,
+	}, {
+		msg:    "namespaced claim, strict",
+		strict: true,
+		body:   `{"uid": "jdoe", "realm": "/immortals", "https://myapp.example.org/scopes": ["foo", "bar"]}`,
+	}, {
+		msg:    "namespaced claim, not matching",
+		body:   `{"uid": "jdoe", "realm": "/immortals", "https://myapp.example.org/scopes": ["baz"], "scope": ["foo"]}`,
+		reason: invalidScope,
+	}, {
+		msg:  "fallback to the scope field",
+		body: `{"uid": "jdoe", "realm": "/immortals", "scope": ["bar"]}`,
+	}, {
+		msg:    "invalid claim, strict",
+		strict: true,
+		body:   `{"uid": "jdoe", "realm": "/immortals", "https://myapp.example.org/scopes": "foo"}`,
+		reason: authServiceFormat,
+	}, {
+		msg:    "unknown field, strict",
+		strict: true,
+		body:   `{"uid": "jdoe", "realm": "/immortals", "https://myapp.example.org/roles": ["foo"]}`,
+		reason: authServiceFormat,
+	}} {
+		authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(ti.body))
+		}))
+
+		f, err := NewAuthWithOptions(Options{
+			AuthUrlBase:    authServer.URL,
+			StrictDecoding: ti.strict,
+			ScopeClaim:     claim}).CreateFilter([]interface{}{testRealm, "foo", "bar"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, "Bearer "+testToken)
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+
+		if ti.reason == "" {
+			if ctx.FServedWithResponse || ctx.StateBag()[authUserKey] != testUid {
+				t.Error(ti.msg, "failed to authorize")
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+
+		authServer.Close()
+	}
+}
+
+func TestTrustedCIDRs(t *testing.T) {
+	var authReqs int
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authReqs++
+		if token, err := getToken(r); err != nil || token != testToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Write([]byte(`{"uid": "jdoe", "realm": "/immortals"}`))
+	}))
+	defer authServer.Close()
+
+	if _, err := NewAuthWithOptions(Options{
+		AuthUrlBase:  authServer.URL,
+		TrustedCIDRs: []string{"10.0.0.0"}}).CreateFilter(nil); err == nil {
+		t.Error("failed to fail on invalid network")
+	}
+
+	for _, ti := range []struct {
+		msg        string
+		cidrs      []string
+		remoteAddr string
+		token      string
+		user       string
+		reason     rejectReason
+		trusted    bool
+	}{{
+		msg:        "disabled by default",
+		remoteAddr: "10.0.0.1:5678",
+		reason:     missingBearerToken,
+	}, {
+		msg:        "trusted",
+		cidrs:      []string{"192.168.0.0/16", "10.0.0.0/8"},
+		remoteAddr: "10.0.0.1:5678",
+		user:       "mesh-service",
+		trusted:    true,
+	}, {
+		msg:        "trusted, ipv6",
+		cidrs:      []string{"fd00::/8"},
+		remoteAddr: "[fd00::1]:5678",
+		user:       "mesh-service",
+		trusted:    true,
+	}, {
+		msg:        "untrusted, no token",
+		cidrs:      []string{"10.0.0.0/8"},
+		remoteAddr: "172.16.0.1:5678",
+		reason:     missingBearerToken,
+	}, {
+		msg:        "untrusted, invalid token",
+		cidrs:      []string{"10.0.0.0/8"},
+		remoteAddr: "172.16.0.1:5678",
+		token:      "invalid-token",
+		reason:     invalidToken,
+	}, {
+		msg:        "untrusted, valid token",
+		cidrs:      []string{"10.0.0.0/8"},
+		remoteAddr: "172.16.0.1:5678",
+		token:      testToken,
+		user:       testUid,
+	}} {
+		authReqs = 0
+
+		f, err := NewAuthWithOptions(Options{
+			AuthUrlBase:     authServer.URL,
+			TrustedCIDRs:    ti.cidrs,
+			TrustedIdentity: "mesh-service"}).CreateFilter([]interface{}{testRealm})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org/foo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.RemoteAddr = ti.remoteAddr
+		if ti.token != "" {
+			req.Header.Set(authHeaderName, "Bearer "+ti.token)
+		}
+
+		var b bytes.Buffer
+		al, err := NewAuditLogWithOptions(AuditLogOptions{Writer: &b}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := newTestContext(req, &http.Response{StatusCode: http.StatusOK})
+		f.Request(ctx)
+
+		if ti.reason == "" {
+			if ctx.FServedWithResponse || ctx.StateBag()[authUserKey] != ti.user {
+				t.Error(ti.msg, "failed to authorize")
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+
+		if ti.trusted && authReqs != 0 {
+			t.Error(ti.msg, "unexpected token validation")
+		}
+
+		al.Response(ctx)
+
+		var doc auditDoc
+		if err := json.Unmarshal(b.Bytes(), &doc); err != nil {
+			t.Error(ti.msg, err)
+			continue
+		}
+
+		if doc.AuthStatus == nil || doc.AuthStatus.TrustedNetwork != ti.trusted {
+			t.Error(ti.msg, "invalid audit entry", b.String())
+		}
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}, Scopes: []string{"foo"}})
+	defer authServer.Close()
+
+	for _, ti := range []struct {
+		msg      string
+		options  Options
+		token    string
+		json     bool
+		expected errorDoc
+	}{{
+		msg:   "disabled",
+		token: testToken,
+	}, {
+		msg:      "default message",
+		options:  Options{JSONErrors: true},
+		token:    testToken,
+		json:     true,
+		expected: errorDoc{Error: "invalid-scope", Message: defaultRejectMessages[invalidScope]},
+	}, {
+		msg: "custom message",
+		options: Options{
+			JSONErrors:     true,
+			RejectMessages: map[string]string{"invalid-scope": "Fehlende Berechtigung."}},
+		token:    testToken,
+		json:     true,
+		expected: errorDoc{Error: "invalid-scope", Message: "Fehlende Berechtigung."},
+	}, {
+		msg: "unmapped reason",
+		options: Options{
+			JSONErrors:     true,
+			RejectMessages: map[string]string{"invalid-scope": "Fehlende Berechtigung."}},
+		token:    "invalid-token",
+		json:     true,
+		expected: errorDoc{Error: "invalid-token", Message: defaultRejectMessages[invalidToken]},
+	}} {
+		ti.options.AuthUrlBase = authServer.URL
+		ctx := testAuthFilter(t, NewAuthWithOptions(ti.options), []interface{}{testRealm, "bar"}, ti.token)
+
+		if !ctx.FServedWithResponse || ctx.FResponse.StatusCode != http.StatusUnauthorized {
+			t.Error(ti.msg, "failed to reject")
+			continue
+		}
+
+		if !ti.json {
+			if ctx.FResponse.Body != nil {
+				t.Error(ti.msg, "unexpected body")
+			}
+
+			continue
+		}
+
+		if ctx.FResponse.Header.Get("Content-Type") != "application/json" {
+			t.Error(ti.msg, "invalid content type", ctx.FResponse.Header.Get("Content-Type"))
+		}
+
+		var doc errorDoc
+		if err := json.NewDecoder(ctx.FResponse.Body).Decode(&doc); err != nil {
+			t.Error(ti.msg, err)
+			continue
+		}
+
+		if doc != ti.expected {
+			t.Error(ti.msg, "invalid error document", doc, ti.expected)
+		}
+	}
+}
+
+func TestProblemJSON(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}, Scopes: []string{"foo"}})
+	defer authServer.Close()
+
+	for _, ti := range []struct {
+		msg      string
+		options  Options
+		token    string
+		expected problemDoc
+	}{{
+		msg:     "default type base",
+		options: Options{ProblemJSON: true},
+		token:   testToken,
+		expected: problemDoc{
+			Type:   "urn:skoap:problem:invalid-scope",
+			Title:  "Unauthorized",
+			Status: http.StatusUnauthorized,
+			Detail: defaultRejectMessages[invalidScope]},
+	}, {
+		msg: "custom type base, precedence over JSON errors",
+		options: Options{
+			ProblemJSON:     true,
+			JSONErrors:      true,
+			ProblemTypeBase: "https://errors.example.org/auth/"},
+		token: "invalid-token",
+		expected: problemDoc{
+			Type:   "https://errors.example.org/auth/invalid-token",
+			Title:  "Unauthorized",
+			Status: http.StatusUnauthorized,
+			Detail: defaultRejectMessages[invalidToken]},
+	}, {
+		msg: "custom message",
+		options: Options{
+			ProblemJSON:    true,
+			RejectMessages: map[string]string{"invalid-scope": "Fehlende Berechtigung."}},
+		token: testToken,
+		expected: problemDoc{
+			Type:   "urn:skoap:problem:invalid-scope",
+			Title:  "Unauthorized",
+			Status: http.StatusUnauthorized,
+			Detail: "Fehlende Berechtigung."},
+	}} {
+		ti.options.AuthUrlBase = authServer.URL
+		ctx := testAuthFilter(t, NewAuthWithOptions(ti.options), []interface{}{testRealm, "bar"}, ti.token)
+
+		if !ctx.FServedWithResponse || ctx.FResponse.StatusCode != http.StatusUnauthorized {
+			t.Error(ti.msg, "failed to reject")
+			continue
+		}
+
+		if ctx.FResponse.Header.Get("Content-Type") != "application/problem+json" {
+			t.Error(ti.msg, "invalid content type", ctx.FResponse.Header.Get("Content-Type"))
+		}
+
+		var doc problemDoc
+		if err := json.NewDecoder(ctx.FResponse.Body).Decode(&doc); err != nil {
+			t.Error(ti.msg, err)
+			continue
+		}
+
+		if doc != ti.expected {
+			t.Error(ti.msg, "invalid problem document", doc, ti.expected)
+		}
+	}
+}
+
+func TestNoClaimsStatus(t *testing.T) {
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token, err := getToken(r); err != nil || token != testToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer authServer.Close()
+
+	for _, ti := range []struct {
+		msg     string
+		options Options
+		args    []interface{}
+		token   string
+		reason  rejectReason
+	}{{
+		msg:    "not enabled",
+		token:  testToken,
+		reason: invalidToken,
+	}, {
+		msg:     "valid",
+		options: Options{NoClaimsStatus: http.StatusNoContent},
+		token:   testToken,
+	}, {
+		msg:     "valid, strict",
+		options: Options{NoClaimsStatus: http.StatusNoContent, StrictDecoding: true},
+		token:   testToken,
+	}, {
+		msg:     "valid, scope claim",
+		options: Options{NoClaimsStatus: http.StatusNoContent, ScopeClaim: "https://example.org/scopes"},
+		token:   testToken,
+	}, {
+		msg:     "invalid",
+		options: Options{NoClaimsStatus: http.StatusNoContent},
+		token:   "invalid-token",
+		reason:  invalidToken,
+	}, {
+		msg:     "realm check",
+		options: Options{NoClaimsStatus: http.StatusNoContent},
+		args:    []interface{}{testRealm},
+		token:   testToken,
+		reason:  invalidRealm,
+	}} {
+		ti.options.AuthUrlBase = authServer.URL
+		ctx := testAuthFilter(t, NewAuthWithOptions(ti.options), ti.args, ti.token)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+	}
+}
+
+func TestAuditMatchedScopes(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{
+		Uid:    testUid,
+		Realm:  realms{testRealm},
+		Scopes: []string{"read", "write", "admin"}})
+	defer authServer.Close()
+
+	for _, ti := range []struct {
+		msg      string
+		options  Options
+		args     []interface{}
+		expected []string
+	}{{
+		msg:  "no scopes",
+		args: []interface{}{testRealm},
+	}, {
+		msg:      "single match",
+		args:     []interface{}{testRealm, "write", "delete"},
+		expected: []string{"write"},
+	}, {
+		msg:      "multiple matches",
+		args:     []interface{}{testRealm, "admin", "delete", "read"},
+		expected: []string{"admin", "read"},
+	}, {
+		msg:      "default scope",
+		options:  Options{DefaultScopes: []string{"admin"}, DefaultScopePolicy: DefaultScopesOr},
+		args:     []interface{}{testRealm, "delete"},
+		expected: []string{"admin"},
+	}} {
+		ti.options.AuthUrlBase = authServer.URL
+		ctx := testAuthFilter(t, NewAuthWithOptions(ti.options), ti.args, testToken)
+		if ctx.FServedWithResponse {
+			t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			continue
+		}
+
+		var b bytes.Buffer
+		al, err := NewAuditLogWithOptions(AuditLogOptions{Writer: &b}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx.FResponse = &http.Response{StatusCode: http.StatusOK}
+		al.Response(ctx)
+
+		var doc auditDoc
+		if err := json.Unmarshal(b.Bytes(), &doc); err != nil {
+			t.Error(ti.msg, err)
+			continue
+		}
+
+		if doc.AuthStatus == nil || !reflect.DeepEqual(doc.AuthStatus.MatchedScopes, ti.expected) {
+			t.Error(ti.msg, "invalid matched scopes", b.String())
+		}
+	}
+}
+
+func TestSlowCallThreshold(t *testing.T) {
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(30 * time.Millisecond)
+		}
+
+		w.Write([]byte(`{"uid": "jdoe", "realm": "/immortals"}`))
+	}))
+	defer authServer.Close()
+
+	teamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+		w.Write([]byte(`[{"id": "test-team"}]`))
+	}))
+	defer teamServer.Close()
+
+	var b bytes.Buffer
+	log.SetOutput(&b)
+	defer log.SetOutput(os.Stderr)
+
+	for _, ti := range []struct {
+		msg       string
+		spec      filters.Spec
+		args      []interface{}
+		slowCall  bool
+		logSubstr string
+	}{{
+		msg: "disabled",
+		spec: NewAuthWithOptions(Options{
+			AuthUrlBase: authServer.URL + "/slow"}),
+	}, {
+		msg: "fast",
+		spec: NewAuthWithOptions(Options{
+			AuthUrlBase:       authServer.URL + "/fast",
+			SlowCallThreshold: 20 * time.Millisecond}),
+	}, {
+		msg: "slow auth call",
+		spec: NewAuthWithOptions(Options{
+			AuthUrlBase:       authServer.URL + "/slow",
+			SlowCallThreshold: 20 * time.Millisecond}),
+		slowCall:  true,
+		logSubstr: authServer.URL + "/slow",
+	}, {
+		msg: "slow team call",
+		spec: NewAuthTeamWithOptions(Options{
+			AuthUrlBase:       authServer.URL + "/fast",
+			TeamUrlBase:       teamServer.URL + "/?uid=",
+			SlowCallThreshold: 20 * time.Millisecond}),
+		args:      []interface{}{testRealm, "test-team"},
+		slowCall:  true,
+		logSubstr: teamServer.URL + "/?uid=jdoe",
+	}} {
+		b.Reset()
+		ctx := testAuthFilter(t, ti.spec, ti.args, testToken)
+		if ctx.FServedWithResponse {
+			t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+		}
+
+		logged := strings.Contains(b.String(), "slow call")
+		if logged != ti.slowCall || !strings.Contains(b.String(), ti.logSubstr) {
+			t.Error(ti.msg, "invalid slow call log", b.String())
+		}
+	}
+}
+
+func TestAuthCacheControl(t *testing.T) {
+	for _, ti := range []struct {
+		msg          string
+		cacheControl string
+		ttl          time.Duration
+		cached       bool
+	}{{
+		msg:    "no header",
+		ttl:    time.Minute,
+		cached: true,
+	}, {
+		msg:          "max-age",
+		cacheControl: "max-age=30",
+		ttl:          30 * time.Second,
+		cached:       true,
+	}, {
+		msg:          "max-age with other directives",
+		cacheControl: "private, Max-Age=30",
+		ttl:          30 * time.Second,
+		cached:       true,
+	}, {
+		msg:          "max-age capped",
+		cacheControl: "max-age=3600",
+		ttl:          time.Minute,
+		cached:       true,
+	}, {
+		msg:          "max-age zero",
+		cacheControl: "max-age=0",
+	}, {
+		msg:          "invalid max-age",
+		cacheControl: "max-age=foo",
+	}, {
+		msg:          "no-store",
+		cacheControl: "no-store",
+	}} {
+		authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ti.cacheControl != "" {
+				w.Header().Set("Cache-Control", ti.cacheControl)
+			}
+
+			w.Write([]byte(`{"uid": "jdoe", "realm": "/immortals"}`))
+		}))
+
+		s := NewAuthWithOptions(Options{AuthUrlBase: authServer.URL, AuthCacheTTL: time.Minute})
+		now := time.Now()
+		ctx := testAuthFilter(t, s, []interface{}{testRealm}, testToken)
+		if ctx.FServedWithResponse {
+			t.Error(ti.msg, "failed to authorize")
+		}
+
+		i, ok := s.(*spec).authClient.cache.items[tokenHash(testToken)]
+		if ok != ti.cached {
+			t.Error(ti.msg, "invalid caching", ok)
+		} else if ok {
+			if ttl := i.expires.Sub(now); ttl < ti.ttl || ttl > ti.ttl+time.Second {
+				t.Error(ti.msg, "invalid TTL", ttl, ti.ttl)
+			}
+		}
+
+		authServer.Close()
+	}
+}
+
+func TestDeniedScopes(t *testing.T) {
+	for _, ti := range []struct {
+		msg    string
+		spec   func(Options) AuthSpec
+		scopes []string
+		args   []interface{}
+		reason rejectReason
+	}{{
+		msg:    "no denied scope",
+		spec:   NewAuthWithOptions,
+		scopes: []string{"read", "write"},
+		args:   []interface{}{testRealm, "read"},
+	}, {
+		msg:    "no denied scope, validate only",
+		spec:   NewAuthWithOptions,
+		scopes: []string{"read"},
+	}, {
+		msg:    "denied scope",
+		spec:   NewAuthWithOptions,
+		scopes: []string{"read", "suspended"},
+		args:   []interface{}{testRealm, "read"},
+		reason: deniedScope,
+	}, {
+		msg:    "denied scope, validate only",
+		spec:   NewAuthWithOptions,
+		scopes: []string{"suspended"},
+		reason: deniedScope,
+	}, {
+		msg:    "denied scope, no other scopes",
+		spec:   NewAuthWithOptions,
+		scopes: []string{"suspended"},
+		args:   []interface{}{testRealm, "read"},
+		reason: deniedScope,
+	}, {
+		msg:    "denied scope, roles",
+		spec:   NewAuthRoleWithOptions,
+		scopes: []string{"suspended"},
+		args:   []interface{}{testRealm},
+		reason: deniedScope,
+	}} {
+		authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}, Scopes: ti.scopes})
+		s := ti.spec(Options{
+			AuthUrlBase:  authServer.URL,
+			DeniedScopes: []string{"suspended", "blocked"}})
+
+		ctx := testAuthFilter(t, s, ti.args, testToken)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+
+		authServer.Close()
+	}
+}
+
+func TestAuditOriginalRequest(t *testing.T) {
+	for _, ti := range []struct {
+		msg            string
+		logCurrent     bool
+		noOriginal     bool
+		expectedMethod string
+		expectedPath   string
+	}{{
+		msg:            "original request",
+		expectedMethod: "POST",
+		expectedPath:   "/original",
+	}, {
+		msg:            "nil original request",
+		noOriginal:     true,
+		expectedMethod: "PUT",
+		expectedPath:   "/current",
+	}, {
+		msg:            "log current request",
+		logCurrent:     true,
+		expectedMethod: "PUT",
+		expectedPath:   "/current",
+	}} {
+		var b bytes.Buffer
+		f, err := NewAuditLogWithOptions(AuditLogOptions{
+			Writer:            &b,
+			LogCurrentRequest: ti.logCurrent}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		oreq, err := http.NewRequest("POST", "https://www.example.org/original", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("PUT", "https://www.example.org/current", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := newTestContext(req, &http.Response{StatusCode: http.StatusOK})
+		ctx.originalRequest = oreq
+		if ti.noOriginal {
+			ctx.originalRequest = nil
+		}
+
+		f.Request(ctx)
+		f.Response(ctx)
+
+		var doc auditDoc
+		if err := json.Unmarshal(b.Bytes(), &doc); err != nil {
+			t.Error(ti.msg, err)
+			continue
+		}
+
+		if doc.Method != ti.expectedMethod || doc.Path != ti.expectedPath {
+			t.Error(ti.msg, "invalid method or path", doc.Method, doc.Path)
+		}
+	}
+}
+
+func TestRequireUid(t *testing.T) {
+	for _, ti := range []struct {
+		msg        string
+		requireUid bool
+		uid        string
+		args       []interface{}
+		reason     rejectReason
+	}{{
+		msg: "not required, no uid",
+	}, {
+		msg:        "required, uid",
+		requireUid: true,
+		uid:        testUid,
+	}, {
+		msg:        "required, no uid",
+		requireUid: true,
+		reason:     missingUid,
+	}, {
+		msg:        "required, no uid, realm",
+		requireUid: true,
+		args:       []interface{}{testRealm},
+		reason:     missingUid,
+	}} {
+		authServer := testAuthServer(t, &authDoc{Uid: ti.uid, Realm: realms{testRealm}})
+		ctx := testAuthFilter(t, NewAuthWithOptions(Options{
+			AuthUrlBase: authServer.URL,
+			RequireUid:  ti.requireUid}), ti.args, testToken)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse || ctx.StateBag()[authUserKey] != ti.uid {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+
+		authServer.Close()
+	}
+}
+
+func TestMaxArgs(t *testing.T) {
+	args := []interface{}{testRealm, "/contractors", "read", "write"}
+	for _, ti := range []struct {
+		msg     string
+		maxArgs int
+		fail    bool
+	}{{
+		msg: "no limit",
+	}, {
+		msg:     "within the limit",
+		maxArgs: 4,
+	}, {
+		msg:     "limit exceeded",
+		maxArgs: 3,
+		fail:    true,
+	}} {
+		_, err := NewAuthWithOptions(Options{MaxArgs: ti.maxArgs}).CreateFilter(args)
+		if ti.fail && err != filters.ErrInvalidFilterParameters {
+			t.Error(ti.msg, "failed to fail", err)
+		} else if !ti.fail && err != nil {
+			t.Error(ti.msg, err)
+		}
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func testResponse(status int, body string) roundTripperFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: status,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+			Request:    r}, nil
+	}
+}
+
+func TestTransport(t *testing.T) {
+	for _, ti := range []struct {
+		msg       string
+		spec      func(Options) AuthSpec
+		args      []interface{}
+		strict    bool
+		transport roundTripperFunc
+		reason    rejectReason
+	}{{
+		msg:       "valid",
+		spec:      NewAuthWithOptions,
+		transport: testResponse(http.StatusOK, `{"uid": "jdoe", "realm": "/immortals"}`),
+	}, {
+		msg:       "server error",
+		spec:      NewAuthWithOptions,
+		transport: testResponse(http.StatusInternalServerError, ""),
+		reason:    invalidToken,
+	}, {
+		msg:  "timeout",
+		spec: NewAuthWithOptions,
+		transport: func(*http.Request) (*http.Response, error) {
+			return nil, timeoutError{}
+		},
+		reason: authServiceAccess,
+	}, {
+		msg:       "malformed body",
+		spec:      NewAuthWithOptions,
+		transport: testResponse(http.StatusOK, `{"uid": "jdoe", "realm`),
+		reason:    authServiceAccess,
+	}, {
+		msg:       "malformed body, strict",
+		spec:      NewAuthWithOptions,
+		strict:    true,
+		transport: testResponse(http.StatusOK, `{"uid": "jdoe", "realm`),
+		reason:    authServiceFormat,
+	}, {
+		msg:  "team service error",
+		spec: NewAuthTeamWithOptions,
+		args: []interface{}{testRealm, "test-team"},
+		transport: func(r *http.Request) (*http.Response, error) {
+			if r.URL.Host == "teams.example.org" {
+				return testResponse(http.StatusServiceUnavailable, "")(r)
+			}
+
+			return testResponse(http.StatusOK, `{"uid": "jdoe", "realm": "/immortals"}`)(r)
+		},
+		reason: teamServiceAccess,
+	}} {
+		s := ti.spec(Options{
+			AuthUrlBase:    "https://auth.example.org",
+			TeamUrlBase:    "https://teams.example.org/?uid=",
+			StrictDecoding: ti.strict,
+			Transport:      ti.transport})
+
+		ctx := testAuthFilter(t, s, ti.args, testToken)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+	}
+}
+
+func TestArgsSeparator(t *testing.T) {
+	for _, ti := range []struct {
+		msg    string
+		args   []string
+		realms []string
+		rest   []string
+	}{{
+		msg:    "no separator",
+		args:   []string{"/employees", "/contractors", "read"},
+		realms: []string{"/employees", "/contractors"},
+		rest:   []string{"read"},
+	}, {
+		msg:    "separator, slash scope",
+		args:   []string{"/employees", "--", "/read:special"},
+		realms: []string{"/employees"},
+		rest:   []string{"/read:special"},
+	}, {
+		msg:    "separator, multiple realms",
+		args:   []string{"/employees", "/contractors", "--", "/read:special", "write"},
+		realms: []string{"/employees", "/contractors"},
+		rest:   []string{"/read:special", "write"},
+	}, {
+		msg:  "separator, no realm",
+		args: []string{"", "--", "/read:special"},
+		rest: []string{"/read:special"},
+	}, {
+		msg:    "separator, no scopes",
+		args:   []string{"/employees", "--"},
+		realms: []string{"/employees"},
+		rest:   []string{},
+	}} {
+		realms, rest := parseRealms(ti.args)
+		if !reflect.DeepEqual(realms, ti.realms) || !reflect.DeepEqual(rest, ti.rest) {
+			t.Error(ti.msg, "invalid arguments", realms, rest)
+		}
+	}
+
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}, Scopes: []string{"/read:special"}})
+	defer authServer.Close()
+
+	s := NewAuth(authServer.URL)
+	if ctx := testAuthFilter(t, s, []interface{}{testRealm, "--", "/read:special"}, testToken); ctx.FServedWithResponse {
+		t.Error("failed to authorize with a slash scope", ctx.StateBag()[authRejectReasonKey])
+	}
+
+	if ctx := testAuthFilter(t, s, []interface{}{testRealm, "--", "/write:special"}, testToken); !ctx.FServedWithResponse ||
+		ctx.StateBag()[authRejectReasonKey] != string(invalidScope) {
+		t.Error("failed to reject with a slash scope", ctx.StateBag()[authRejectReasonKey])
+	}
+}
+
+func TestScopeRealmSeparator(t *testing.T) {
+	for _, ti := range []struct {
+		msg    string
+		realms realms
+		scopes []string
+		args   []interface{}
+		reason rejectReason
+	}{{
+		msg:    "same realm",
+		realms: realms{"/tenant-a"},
+		scopes: []string{"/tenant-a:orders.read"},
+		args:   []interface{}{"/tenant-a", "orders.read"},
+	}, {
+		msg:    "same realm, no realm configured",
+		realms: realms{"/tenant-a"},
+		scopes: []string{"/tenant-a:orders.read"},
+		args:   []interface{}{"", "orders.read"},
+	}, {
+		msg:    "cross realm",
+		realms: realms{"/tenant-a"},
+		scopes: []string{"/tenant-b:orders.read"},
+		args:   []interface{}{"/tenant-a", "orders.read"},
+		reason: invalidScope,
+	}, {
+		msg:    "cross realm, no realm configured",
+		realms: realms{"/tenant-a"},
+		scopes: []string{"/tenant-b:orders.read"},
+		args:   []interface{}{"", "orders.read"},
+		reason: invalidScope,
+	}, {
+		msg:    "unqualified scope",
+		realms: realms{"/tenant-a"},
+		scopes: []string{"orders.read"},
+		args:   []interface{}{"/tenant-a", "orders.read"},
+		reason: invalidScope,
+	}, {
+		msg:    "multiple realms, scope in a realm not accepted by the route",
+		realms: realms{"/tenant-a", "/tenant-b"},
+		scopes: []string{"/tenant-b:orders.read"},
+		args:   []interface{}{"/tenant-a", "orders.read"},
+		reason: invalidScope,
+	}, {
+		msg:    "multiple realms, scope in an accepted realm",
+		realms: realms{"/tenant-a", "/tenant-b"},
+		scopes: []string{"/tenant-b:orders.read"},
+		args:   []interface{}{"/tenant-a", "/tenant-b", "orders.read"},
+	}} {
+		authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: ti.realms, Scopes: ti.scopes})
+		ctx := testAuthFilter(t, NewAuthWithOptions(Options{
+			AuthUrlBase:         authServer.URL,
+			ScopeRealmSeparator: ":"}), ti.args, testToken)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+
+		authServer.Close()
+	}
+}
+
+func TestAuditTokenFingerprint(t *testing.T) {
+	audit := func(token string, enabled bool) (auditDoc, string) {
+		var b bytes.Buffer
+		f, err := NewAuditLogWithOptions(AuditLogOptions{
+			Writer:           &b,
+			TokenFingerprint: enabled}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org/foo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if token != "" {
+			req.Header.Set(authHeaderName, "Bearer "+token)
+		}
+
+		ctx := newTestContext(req, &http.Response{StatusCode: http.StatusOK})
+		f.Request(ctx)
+
+		// dropped by a subsequent filter
+		req.Header.Del(authHeaderName)
+
+		f.Response(ctx)
+
+		var doc auditDoc
+		if err := json.Unmarshal(b.Bytes(), &doc); err != nil {
+			t.Fatal(err)
+		}
+
+		return doc, b.String()
+	}
+
+	doc1, entry := audit(testToken, true)
+	if len(doc1.TokenFingerprint) != 8 || doc1.TokenFingerprint != tokenHash(testToken)[:8] {
+		t.Error("invalid fingerprint", doc1.TokenFingerprint)
+	}
+
+	if strings.Contains(entry, testToken) {
+		t.Error("token logged")
+	}
+
+	if doc2, _ := audit(testToken, true); doc2.TokenFingerprint != doc1.TokenFingerprint {
+		t.Error("fingerprint not stable", doc2.TokenFingerprint)
+	}
+
+	if doc, _ := audit("other-token", true); doc.TokenFingerprint == doc1.TokenFingerprint {
+		t.Error("fingerprint not distinct")
+	}
+
+	if doc, entry := audit("", true); doc.TokenFingerprint != "" || strings.Contains(entry, "tokenFingerprint") {
+		t.Error("unexpected fingerprint without a token", entry)
+	}
+
+	if doc, _ := audit(testToken, false); doc.TokenFingerprint != "" {
+		t.Error("unexpected fingerprint when disabled")
+	}
+}
+
+func TestBlockedRealms(t *testing.T) {
+	for _, ti := range []struct {
+		msg    string
+		realms realms
+		args   []interface{}
+		reason rejectReason
+	}{{
+		msg:    "allowed realm",
+		realms: realms{"/employees"},
+	}, {
+		msg:    "allowed realm, realm check",
+		realms: realms{"/employees"},
+		args:   []interface{}{"/employees"},
+	}, {
+		msg:    "blocked realm",
+		realms: realms{"/legacy"},
+		reason: blockedRealm,
+	}, {
+		msg:    "blocked realm, accepted by the route",
+		realms: realms{"/legacy"},
+		args:   []interface{}{"/legacy"},
+		reason: blockedRealm,
+	}, {
+		msg:    "one of multiple realms blocked",
+		realms: realms{"/employees", "/legacy"},
+		args:   []interface{}{"/employees"},
+		reason: blockedRealm,
+	}} {
+		authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: ti.realms})
+		ctx := testAuthFilter(t, NewAuthWithOptions(Options{
+			AuthUrlBase:   authServer.URL,
+			BlockedRealms: []string{"/legacy"}}), ti.args, testToken)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+
+		authServer.Close()
+	}
+}
+
+func TestRealmAliases(t *testing.T) {
+	for _, ti := range []struct {
+		msg       string
+		realms    realms
+		scopes    []string
+		args      []interface{}
+		separator string
+		reason    rejectReason
+	}{{
+		msg:    "new realm",
+		realms: realms{"/staff"},
+		args:   []interface{}{"/staff"},
+	}, {
+		msg:    "old realm accepted via the alias",
+		realms: realms{"/immortals"},
+		args:   []interface{}{"/staff"},
+	}, {
+		msg:    "alias not applied in reverse",
+		realms: realms{"/staff"},
+		args:   []interface{}{"/immortals"},
+		reason: invalidRealm,
+	}, {
+		msg:    "unrelated realm",
+		realms: realms{"/guests"},
+		args:   []interface{}{"/staff"},
+		reason: invalidRealm,
+	}, {
+		msg:       "old realm, qualified scope",
+		realms:    realms{"/immortals"},
+		scopes:    []string{"/immortals:orders.read"},
+		args:      []interface{}{"/staff", "orders.read"},
+		separator: ":",
+	}} {
+		authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: ti.realms, Scopes: ti.scopes})
+		ctx := testAuthFilter(t, NewAuthWithOptions(Options{
+			AuthUrlBase:         authServer.URL,
+			ScopeRealmSeparator: ti.separator,
+			RealmAliases:        map[string][]string{"/staff": {"/immortals"}}}), ti.args, testToken)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+
+		authServer.Close()
+	}
+}
+
+func TestTeamCacheCoherence(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		uid       = "jdoe"
+		teamFetch = make(map[string]int)
+	)
+
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write([]byte(`{"uid": "` + uid + `", "realm": "/immortals"}`))
+	}))
+	defer authServer.Close()
+
+	teamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		teamFetch[r.URL.Query().Get("uid")]++
+		w.Write([]byte(`[{"id": "test-team"}]`))
+	}))
+	defer teamServer.Close()
+
+	s := NewAuthTeamWithOptions(Options{
+		AuthUrlBase:  authServer.URL,
+		TeamUrlBase:  teamServer.URL + "/?uid=",
+		AuthCacheTTL: 30 * time.Millisecond})
+
+	request := func(u string) {
+		mu.Lock()
+		uid = u
+		mu.Unlock()
+
+		ctx := testAuthFilter(t, s, []interface{}{testRealm, "test-team"}, testToken)
+		if ctx.FServedWithResponse || ctx.StateBag()[authUserKey] != u {
+			t.Error("failed to authorize", u, ctx.StateBag()[authRejectReasonKey])
+		}
+	}
+
+	// cached auth result, cached teams
+	request("jdoe")
+	request("jdoe")
+	if teamFetch["jdoe"] != 1 {
+		t.Error("unexpected team fetch", teamFetch["jdoe"])
+	}
+
+	// the uid of the token changes, when the auth result is refreshed
+	time.Sleep(60 * time.Millisecond)
+	request("jane")
+	if teamFetch["jane"] != 1 {
+		t.Error("failed to fetch the teams of the new uid", teamFetch["jane"])
+	}
+
+	// the team cache of the old uid is still valid, but invalidated
+	time.Sleep(60 * time.Millisecond)
+	request("jdoe")
+	if teamFetch["jdoe"] != 2 {
+		t.Error("failed to fetch the teams again", teamFetch["jdoe"])
+	}
+}
+
+func TestWarmTeams(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}})
+	defer authServer.Close()
+
+	var teamCalls int32
+	teamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&teamCalls, 1)
+		w.Write([]byte(`[{"id": "other-team"}]`))
+	}))
+	defer teamServer.Close()
+
+	s := NewAuthTeamWithOptions(Options{AuthUrlBase: authServer.URL, TeamUrlBase: teamServer.URL + "/"})
+	if err := s.WarmTeams(context.Background(), map[string][]string{testUid: {"test-team"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := testAuthFilter(t, s, []interface{}{testRealm, "test-team"}, testToken)
+	if ctx.FServedWithResponse {
+		t.Error("failed to authorize with the seeded teams", ctx.StateBag()[authRejectReasonKey])
+	}
+
+	if n := atomic.LoadInt32(&teamCalls); n != 0 {
+		t.Error("unexpected team service calls", n)
+	}
+
+	if err := NewAuthWithOptions(Options{AuthUrlBase: authServer.URL}).WarmTeams(
+		context.Background(),
+		map[string][]string{testUid: {"test-team"}},
+	); err != errNoTeamCache {
+		t.Error("failed to fail without a team cache", err)
+	}
+
+	cctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.WarmTeams(cctx, map[string][]string{"jdoe": {"test-team"}}); err != context.Canceled {
+		t.Error("failed to stop on a canceled context", err)
+	}
+}
+
+func TestRequiredClaims(t *testing.T) {
+	for _, ti := range []struct {
+		msg    string
+		strict bool
+		body   string
+		reason rejectReason
+	}{{
+		msg:  "matching",
+		body: `{"uid": "jdoe", "realm": "/immortals", "plan": "enterprise", "verified": true}`,
+	}, {
+		msg:    "matching, strict",
+		strict: true,
+		body:   `{"uid": "jdoe", "realm": "/immortals", "plan": "enterprise", "verified": true}`,
+	}, {
+		msg:    "missing",
+		body:   `{"uid": "jdoe", "realm": "/immortals", "verified": true}`,
+		reason: missingClaim,
+	}, {
+		msg:    "wrong value",
+		body:   `{"uid": "jdoe", "realm": "/immortals", "plan": "free", "verified": true}`,
+		reason: missingClaim,
+	}, {
+		msg:    "wrong type",
+		body:   `{"uid": "jdoe", "realm": "/immortals", "plan": "enterprise", "verified": "yes"}`,
+		reason: missingClaim,
+	}, {
+		msg:    "unknown field, strict",
+		strict: true,
+		body:   `{"uid": "jdoe", "realm": "/immortals", "plan": "enterprise", "verified": true, "foo": "bar"}`,
+		reason: authServiceFormat,
+	}} {
+		authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(ti.body))
+		}))
+
+		ctx := testAuthFilter(t, NewAuthWithOptions(Options{
+			AuthUrlBase:    authServer.URL,
+			StrictDecoding: ti.strict,
+			RequiredClaims: map[string]string{"plan": "enterprise", "verified": "true"}}), nil, testToken)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse || ctx.StateBag()[authUserKey] != testUid {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+
+		authServer.Close()
+	}
+}
+
+func TestAuditTimestampSeq(t *testing.T) {
+	for _, ti := range []struct {
+		msg      string
+		sequence bool
+	}{{
+		msg: "timestamp only",
+	}, {
+		msg:      "timestamp and seq",
+		sequence: true,
+	}} {
+		var b bytes.Buffer
+		f, err := NewAuditLogWithOptions(AuditLogOptions{
+			Writer:   &b,
+			Sequence: ti.sequence}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			req, err := http.NewRequest("GET", "https://www.example.org/foo", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := newTestContext(req, &http.Response{StatusCode: http.StatusOK})
+			f.Request(ctx)
+			f.Response(ctx)
+		}
+
+		var (
+			lastSeq uint64
+			lastTs  time.Time
+		)
+
+		d := json.NewDecoder(&b)
+		for i := 0; i < 3; i++ {
+			var doc auditDoc
+			if err := d.Decode(&doc); err != nil {
+				t.Fatal(ti.msg, err)
+			}
+
+			ts, err := time.Parse(time.RFC3339Nano, doc.Timestamp)
+			if err != nil || ts.Before(start.Truncate(time.Second)) || ts.Before(lastTs) {
+				t.Error(ti.msg, "invalid timestamp", doc.Timestamp)
+			}
+
+			lastTs = ts
+
+			if !ti.sequence {
+				if doc.Seq != 0 {
+					t.Error(ti.msg, "unexpected seq", doc.Seq)
+				}
+
+				continue
+			}
+
+			if doc.Seq <= lastSeq {
+				t.Error(ti.msg, "seq not increasing", doc.Seq, lastSeq)
+			}
+
+			lastSeq = doc.Seq
+		}
+	}
+}
+
+func TestDecodeToken(t *testing.T) {
+	const rawToken = "abc+def/ghi=="
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token, err := getToken(r); err != nil || token != rawToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Write([]byte(`{"uid": "jdoe", "realm": "/immortals"}`))
+	}))
+	defer authServer.Close()
+
+	for _, ti := range []struct {
+		msg    string
+		decode bool
+		token  string
+		reason rejectReason
+	}{{
+		msg:   "raw token, not decoding",
+		token: rawToken,
+	}, {
+		msg:    "encoded token, not decoding",
+		token:  url.QueryEscape(rawToken),
+		reason: invalidToken,
+	}, {
+		msg:    "encoded token, decoding",
+		decode: true,
+		token:  url.QueryEscape(rawToken),
+	}, {
+		msg:    "raw token, decoding",
+		decode: true,
+		token:  rawToken,
+	}, {
+		msg:    "invalid escape sequence",
+		decode: true,
+		token:  "abc%zz",
+		reason: invalidToken,
+	}} {
+		ctx := testAuthFilter(t, NewAuthWithOptions(Options{
+			AuthUrlBase: authServer.URL,
+			DecodeToken: ti.decode}), nil, ti.token)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+	}
+}
+
+func TestTokenCookieRequireHeader(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}})
+	defer authServer.Close()
+
+	for _, ti := range []struct {
+		msg     string
+		header  bool
+		cookie  string
+		headers map[string]string
+		reason  rejectReason
+	}{{
+		msg:     "cookie token, required header present",
+		cookie:  testToken,
+		headers: map[string]string{"X-Requested-With": "XMLHttpRequest", "X-Csrf-Token": "abc"},
+	}, {
+		msg:     "cookie token, required header missing",
+		cookie:  testToken,
+		headers: map[string]string{"X-Csrf-Token": "abc"},
+		reason:  csrfCheck,
+	}, {
+		msg:     "cookie token, wrong header value",
+		cookie:  testToken,
+		headers: map[string]string{"X-Requested-With": "fetch", "X-Csrf-Token": "abc"},
+		reason:  csrfCheck,
+	}, {
+		msg:     "cookie token, any value header missing",
+		cookie:  testToken,
+		headers: map[string]string{"X-Requested-With": "XMLHttpRequest"},
+		reason:  csrfCheck,
+	}, {
+		msg:    "header token, not checked",
+		header: true,
+	}, {
+		msg:    "invalid cookie token",
+		cookie: "invalid-token",
+		headers: map[string]string{
+			"X-Requested-With": "XMLHttpRequest",
+			"X-Csrf-Token":     "abc"},
+		reason: invalidToken,
+	}, {
+		msg:    "no token",
+		reason: missingBearerToken,
+	}} {
+		f, err := NewAuthWithOptions(Options{
+			AuthUrlBase: authServer.URL,
+			TokenCookie: "session",
+			RequireHeader: map[string]string{
+				"X-Requested-With": "XMLHttpRequest",
+				"X-Csrf-Token":     ""}}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ti.header {
+			req.Header.Set(authHeaderName, "Bearer "+testToken)
+		}
+
+		if ti.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "session", Value: ti.cookie})
+		}
+
+		for k, v := range ti.headers {
+			req.Header.Set(k, v)
+		}
+
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+	}
+}
+
+func TestTokenSources(t *testing.T) {
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := getToken(r)
+		if err != nil || !strings.HasSuffix(token, "-token") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Write([]byte(`{"uid": "` + strings.TrimSuffix(token, "-token") + `", "realm": "/immortals"}`))
+	}))
+	defer authServer.Close()
+
+	for _, ti := range []struct {
+		msg     string
+		sources []TokenSource
+		header  bool
+		cookie  bool
+		query   bool
+		uid     string
+	}{{
+		msg:    "default order, all present",
+		header: true,
+		cookie: true,
+		query:  true,
+		uid:    "header",
+	}, {
+		msg:    "default order, cookie before query",
+		cookie: true,
+		query:  true,
+		uid:    "cookie",
+	}, {
+		msg:     "query first",
+		sources: []TokenSource{TokenFromQuery, TokenFromHeader, TokenFromCookie},
+		header:  true,
+		cookie:  true,
+		query:   true,
+		uid:     "query",
+	}, {
+		msg:     "cookie first, falling back to the header",
+		sources: []TokenSource{TokenFromCookie, TokenFromHeader},
+		header:  true,
+		uid:     "header",
+	}, {
+		msg:     "unlisted source ignored",
+		sources: []TokenSource{TokenFromHeader, TokenFromCookie},
+		query:   true,
+	}, {
+		msg:     "header not listed",
+		sources: []TokenSource{TokenFromQuery},
+		header:  true,
+	}} {
+		f, err := NewAuthWithOptions(Options{
+			AuthUrlBase:     authServer.URL,
+			TokenCookie:     "session",
+			TokenQueryParam: "access_token",
+			TokenSources:    ti.sources}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		u := "https://www.example.org/"
+		if ti.query {
+			u += "?access_token=query-token"
+		}
+
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ti.header {
+			req.Header.Set(authHeaderName, "Bearer header-token")
+		}
+
+		if ti.cookie {
+			req.AddCookie(&http.Cookie{Name: "session", Value: "cookie-token"})
+		}
+
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if ti.uid == "" {
+			if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(missingBearerToken) {
+				t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if ctx.FServedWithResponse || ctx.StateBag()[authUserKey] != ti.uid {
+			t.Error(ti.msg, "invalid token source", ctx.StateBag()[authUserKey], ctx.StateBag()[authRejectReasonKey])
+		}
+	}
+}
+
+func TestGraceUserAgents(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}, Scopes: []string{"read"}})
+	defer authServer.Close()
+
+	s := NewAuthWithOptions(Options{
+		AuthUrlBase:     authServer.URL,
+		GraceUserAgents: []*regexp.Regexp{regexp.MustCompile(`^legacy-client/1\.`)}})
+
+	for _, ti := range []struct {
+		msg       string
+		userAgent string
+		args      []interface{}
+		grace     bool
+		reason    rejectReason
+	}{{
+		msg:       "grace user agent, would be rejected",
+		userAgent: "legacy-client/1.4",
+		args:      []interface{}{testRealm, "write"},
+		grace:     true,
+		reason:    invalidScope,
+	}, {
+		msg:       "grace user agent, authorized",
+		userAgent: "legacy-client/1.4",
+		args:      []interface{}{testRealm, "read"},
+	}, {
+		msg:       "other user agent, rejected",
+		userAgent: "legacy-client/2.0",
+		args:      []interface{}{testRealm, "write"},
+		reason:    invalidScope,
+	}, {
+		msg:    "no user agent, rejected",
+		args:   []interface{}{testRealm, "write"},
+		reason: invalidScope,
+	}} {
+		f, err := s.CreateFilter(ti.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, "Bearer "+testToken)
+		req.Header.Set("User-Agent", ti.userAgent)
+
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+
+		if ti.reason != "" && !ti.grace {
+			if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+				t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+			}
+
+			continue
+		}
+
+		if ctx.FServedWithResponse {
+			t.Error(ti.msg, "failed to let through", ctx.StateBag()[authRejectReasonKey])
+			continue
+		}
+
+		var b bytes.Buffer
+		al, err := NewAuditLogWithOptions(AuditLogOptions{Writer: &b, RejectedOnly: true}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx.FResponse = &http.Response{StatusCode: http.StatusOK}
+		al.Response(ctx)
+
+		if !ti.grace {
+			if b.Len() != 0 {
+				t.Error(ti.msg, "unexpected audit entry", b.String())
+			}
+
+			continue
+		}
+
+		var doc auditDoc
+		if err := json.Unmarshal(b.Bytes(), &doc); err != nil {
+			t.Error(ti.msg, err)
+			continue
+		}
+
+		if doc.AuthStatus == nil || !doc.AuthStatus.GraceAllowed || doc.AuthStatus.Rejected ||
+			doc.AuthStatus.Reason != string(ti.reason) || doc.AuthStatus.User != testUid {
+			t.Error(ti.msg, "invalid audit entry", b.String())
+		}
+	}
+}
+
+func TestGraceUserAgentsGuards(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}, Scopes: []string{"read"}})
+	defer authServer.Close()
+
+	grace := []*regexp.Regexp{regexp.MustCompile(`^legacy-client/1\.`)}
+	for _, ti := range []struct {
+		msg     string
+		options Options
+		header  http.Header
+		token   string
+		reason  rejectReason
+	}{{
+		msg:     "untrusted proxy",
+		options: Options{TrustedProxies: []string{"10.0.0.0/8"}},
+		header:  http.Header{"X-Forwarded-For": []string{"192.0.2.1"}},
+		token:   testToken,
+		reason:  untrustedProxy,
+	}, {
+		msg:     "blocked country",
+		options: Options{BlockedCountries: []string{"XX"}},
+		header:  http.Header{DefaultCountryHeader: []string{"XX"}},
+		token:   testToken,
+		reason:  geoBlocked,
+	}, {
+		msg:    "invalid token",
+		token:  "invalid-token",
+		reason: invalidToken,
+	}} {
+		ti.options.AuthUrlBase = authServer.URL
+		ti.options.GraceUserAgents = grace
+		f, err := NewAuthWithOptions(ti.options).CreateFilter([]interface{}{testRealm})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for k, v := range ti.header {
+			req.Header.Set(k, v[0])
+		}
+
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set(authHeaderName, "Bearer "+ti.token)
+		req.Header.Set("User-Agent", "legacy-client/1.4")
+
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+
+		if _, ok := ctx.StateBag()[authGraceReasonKey]; ok {
+			t.Error(ti.msg, "unexpected grace")
+		}
+	}
+}
+
+type entryWriter chan []byte
+
+func (w entryWriter) Write(p []byte) (int, error) {
+	w <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func TestAuditPhaseEntries(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("done"))
+	}))
+	defer backend.Close()
+
+	entries := make(entryWriter, 4)
+	s := NewAuditLogWithOptions(AuditLogOptions{Writer: entries, PhaseEntries: true, Sequence: true})
+	fr := make(filters.Registry)
+	fr.Register(s)
+	r := &eskip.Route{Filters: []*eskip.Filter{{Name: s.Name()}}, Backend: backend.URL}
+	proxy := proxytest.New(fr, r)
+	defer proxy.Close()
+
+	done := make(chan int)
+	go func() {
+		rsp, err := http.Get(proxy.URL + "/stream")
+		if err != nil {
+			t.Error(err)
+			done <- 0
+			return
+		}
+
+		ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		done <- rsp.StatusCode
+	}()
+
+	next := func() (doc auditDoc) {
+		select {
+		case b := <-entries:
+			if err := json.Unmarshal(b, &doc); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("timeout waiting for the audit entry")
+		}
+
+		return
+	}
+
+	start := next()
+	if start.Phase != "start" || start.Method != "GET" || start.Path != "/stream" || start.Status != 0 {
+		t.Error("invalid start entry", start)
+	}
+
+	// nothing else is logged while the backend is in progress
+	select {
+	case b := <-entries:
+		t.Error("unexpected entry before the response", string(b))
+	case <-time.After(30 * time.Millisecond):
+	}
+
+	close(release)
+	if status := <-done; status != http.StatusOK {
+		t.Fatal("request failed", status)
+	}
+
+	end := next()
+	if end.Phase != "end" || end.Path != "/stream" || end.Status != http.StatusOK || end.Seq <= start.Seq {
+		t.Error("invalid end entry", end)
+	}
+}
+
+func TestScopeThreshold(t *testing.T) {
+	args := []interface{}{testRealm, "read", "write", "admin"}
+	for _, ti := range []struct {
+		msg       string
+		threshold int
+		realms    realms
+		scopes    []string
+		separator string
+		args      []interface{}
+		reason    rejectReason
+	}{{
+		msg:    "default, any",
+		scopes: []string{"write"},
+		args:   args,
+	}, {
+		msg:       "below threshold",
+		threshold: 2,
+		scopes:    []string{"write", "other"},
+		args:      args,
+		reason:    invalidScope,
+	}, {
+		msg:       "at threshold",
+		threshold: 2,
+		scopes:    []string{"write", "admin"},
+		args:      args,
+	}, {
+		msg:       "above threshold",
+		threshold: 2,
+		scopes:    []string{"read", "write", "admin"},
+		args:      args,
+	}, {
+		msg:       "threshold above the required scopes, all granted",
+		threshold: 5,
+		scopes:    []string{"read", "write", "admin"},
+		args:      args,
+	}, {
+		msg:       "threshold above the required scopes, not all granted",
+		threshold: 5,
+		scopes:    []string{"read", "write"},
+		args:      args,
+		reason:    invalidScope,
+	}, {
+		msg:       "realm qualified, at threshold",
+		threshold: 2,
+		scopes:    []string{testRealm + ":read", testRealm + ":admin"},
+		separator: ":",
+		args:      args,
+	}, {
+		msg:       "realm qualified, same scope in multiple realms",
+		threshold: 2,
+		realms:    realms{testRealm, "/other"},
+		scopes:    []string{testRealm + ":read", "/other:read"},
+		separator: ":",
+		args:      []interface{}{testRealm, "/other", "read", "write", "admin"},
+		reason:    invalidScope,
+	}} {
+		if ti.realms == nil {
+			ti.realms = realms{testRealm}
+		}
+
+		authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: ti.realms, Scopes: ti.scopes})
+		ctx := testAuthFilter(t, NewAuthWithOptions(Options{
+			AuthUrlBase:         authServer.URL,
+			ScopeThreshold:      ti.threshold,
+			ScopeRealmSeparator: ti.separator}), ti.args, testToken)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+
+		authServer.Close()
+	}
+}
+
+func TestAuditNormalizePath(t *testing.T) {
+	for _, ti := range []struct {
+		msg       string
+		normalize bool
+		path      string
+		logged    string
+	}{{
+		msg:    "not normalized",
+		path:   "/orders/",
+		logged: "/orders/",
+	}, {
+		msg:       "trailing slash",
+		normalize: true,
+		path:      "/orders/",
+		logged:    "/orders",
+	}, {
+		msg:       "dot segments",
+		normalize: true,
+		path:      "/orders/./items/../42",
+		logged:    "/orders/42",
+	}, {
+		msg:       "double slashes",
+		normalize: true,
+		path:      "//orders//42",
+		logged:    "/orders/42",
+	}, {
+		msg:       "root",
+		normalize: true,
+		path:      "/",
+		logged:    "/",
+	}} {
+		var b bytes.Buffer
+		f, err := NewAuditLogWithOptions(AuditLogOptions{
+			Writer:        &b,
+			NormalizePath: ti.normalize}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.URL.Path = ti.path
+		ctx := newTestContext(req, &http.Response{StatusCode: http.StatusOK})
+		f.Request(ctx)
+		f.Response(ctx)
+
+		var doc auditDoc
+		if err := json.Unmarshal(b.Bytes(), &doc); err != nil {
+			t.Error(ti.msg, err)
+			continue
+		}
+
+		if doc.Path != ti.logged {
+			t.Error(ti.msg, "invalid path logged", doc.Path, ti.logged)
+		}
+
+		if req.URL.Path != ti.path {
+			t.Error(ti.msg, "the request path was changed", req.URL.Path)
+		}
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}})
+	defer authServer.Close()
+
+	if _, err := NewAuthWithOptions(Options{
+		AuthUrlBase:    authServer.URL,
+		TrustedProxies: []string{"10.0.0.0"}}).CreateFilter(nil); err == nil {
+		t.Error("failed to fail on invalid network")
+	}
+
+	for _, ti := range []struct {
+		msg          string
+		proxies      []string
+		remoteAddr   string
+		forwardedFor string
+		reason       rejectReason
+	}{{
+		msg:        "disabled by default",
+		remoteAddr: "172.16.0.1:5678",
+	}, {
+		msg:          "trusted proxy",
+		proxies:      []string{"10.0.0.0/8"},
+		remoteAddr:   "10.0.0.1:5678",
+		forwardedFor: "203.0.113.7",
+	}, {
+		msg:          "trusted proxy, chain",
+		proxies:      []string{"10.0.0.0/8", "fd00::/8"},
+		remoteAddr:   "[fd00::1]:5678",
+		forwardedFor: "203.0.113.7, 10.0.0.1",
+	}, {
+		msg:          "untrusted upstream",
+		proxies:      []string{"10.0.0.0/8"},
+		remoteAddr:   "172.16.0.1:5678",
+		forwardedFor: "203.0.113.7",
+		reason:       untrustedProxy,
+	}, {
+		msg:          "direct client forging the header",
+		proxies:      []string{"10.0.0.0/8"},
+		remoteAddr:   "203.0.113.7:5678",
+		forwardedFor: "10.0.0.1",
+		reason:       untrustedProxy,
+	}, {
+		msg:        "trusted upstream, not forwarded",
+		proxies:    []string{"10.0.0.0/8"},
+		remoteAddr: "10.0.0.1:5678",
+		reason:     untrustedProxy,
+	}} {
+		f, err := NewAuthWithOptions(Options{
+			AuthUrlBase:    authServer.URL,
+			TrustedProxies: ti.proxies}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.RemoteAddr = ti.remoteAddr
+		req.Header.Set(authHeaderName, "Bearer "+testToken)
+		if ti.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", ti.forwardedFor)
+		}
+
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+	}
+}
+
+func TestAuditMatchedTeams(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}})
+	defer authServer.Close()
+
+	teamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id": "viewers"}, {"id": "test-team"}, {"id": "admins"}]`))
+	}))
+	defer teamServer.Close()
+
+	for _, ti := range []struct {
+		msg      string
+		args     []interface{}
+		expected []string
+	}{{
+		msg:  "no teams",
+		args: []interface{}{testRealm},
+	}, {
+		msg:      "single match",
+		args:     []interface{}{testRealm, "test-team", "other-team"},
+		expected: []string{"test-team"},
+	}, {
+		msg:      "multiple matches",
+		args:     []interface{}{testRealm, "admins", "other-team", "test-team"},
+		expected: []string{"admins", "test-team"},
+	}} {
+		s := NewAuthTeamWithOptions(Options{AuthUrlBase: authServer.URL, TeamUrlBase: teamServer.URL + "/"})
+		ctx := testAuthFilter(t, s, ti.args, testToken)
+		if ctx.FServedWithResponse {
+			t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			continue
+		}
+
+		var b bytes.Buffer
+		al, err := NewAuditLogWithOptions(AuditLogOptions{Writer: &b}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx.FResponse = &http.Response{StatusCode: http.StatusOK}
+		al.Response(ctx)
+
+		var doc auditDoc
+		if err := json.Unmarshal(b.Bytes(), &doc); err != nil {
+			t.Error(ti.msg, err)
+			continue
+		}
+
+		if doc.AuthStatus == nil || !reflect.DeepEqual(doc.AuthStatus.MatchedTeams, ti.expected) {
+			t.Error(ti.msg, "invalid matched teams", b.String())
+		}
+	}
+}
+
+func TestObservedScopes(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{
+		Uid:    testUid,
+		Realm:  realms{testRealm},
+		Scopes: []string{"read", "feature.beta", "feature.export"}})
+	defer authServer.Close()
+
+	for _, ti := range []struct {
+		msg      string
+		observed []string
+		args     []interface{}
+		reason   rejectReason
+		expected []string
+	}{{
+		msg:  "none observed",
+		args: []interface{}{testRealm, "read"},
+	}, {
+		msg:      "observed, not required",
+		observed: []string{"feature.export", "feature.dark-mode", "feature.beta"},
+		args:     []interface{}{testRealm, "read"},
+		expected: []string{"feature.export", "feature.beta"},
+	}, {
+		msg:      "observed, validate only",
+		observed: []string{"feature.beta"},
+		expected: []string{"feature.beta"},
+	}, {
+		msg:      "observed but not held",
+		observed: []string{"feature.dark-mode"},
+		args:     []interface{}{testRealm, "read"},
+	}, {
+		msg:      "observed scope doesn't authorize",
+		observed: []string{"feature.beta"},
+		args:     []interface{}{testRealm, "write"},
+		reason:   invalidScope,
+	}} {
+		ctx := testAuthFilter(t, NewAuthWithOptions(Options{
+			AuthUrlBase:    authServer.URL,
+			ObservedScopes: ti.observed}), ti.args, testToken)
+		if ti.reason != "" {
+			if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+				t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+			}
+
+			continue
+		}
+
+		if ctx.FServedWithResponse {
+			t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			continue
+		}
+
+		var b bytes.Buffer
+		al, err := NewAuditLogWithOptions(AuditLogOptions{Writer: &b}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx.FResponse = &http.Response{StatusCode: http.StatusOK}
+		al.Response(ctx)
+
+		var doc auditDoc
+		if err := json.Unmarshal(b.Bytes(), &doc); err != nil {
+			t.Error(ti.msg, err)
+			continue
+		}
+
+		if doc.AuthStatus == nil || !reflect.DeepEqual(doc.AuthStatus.ObservedScopes, ti.expected) {
+			t.Error(ti.msg, "invalid observed scopes", b.String())
+		}
+	}
+}
+
+func TestGeoBlocked(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}})
+	defer authServer.Close()
+
+	for _, ti := range []struct {
+		msg     string
+		options Options
+		header  string
+		country string
+		status  int
+	}{{
+		msg:     "disabled by default",
+		header:  DefaultCountryHeader,
+		country: "XX",
+	}, {
+		msg:     "allowed country",
+		options: Options{BlockedCountries: []string{"XX", "YY"}},
+		header:  DefaultCountryHeader,
+		country: "DE",
+	}, {
+		msg:     "no country header",
+		options: Options{BlockedCountries: []string{"XX"}},
+	}, {
+		msg:     "blocked country",
+		options: Options{BlockedCountries: []string{"XX", "YY"}},
+		header:  DefaultCountryHeader,
+		country: "yy",
+		status:  http.StatusUnavailableForLegalReasons,
+	}, {
+		msg: "custom header and status",
+		options: Options{
+			BlockedCountries: []string{"XX"},
+			CountryHeader:    "X-Country-Code",
+			GeoBlockedStatus: http.StatusForbidden},
+		header:  "X-Country-Code",
+		country: "XX",
+		status:  http.StatusForbidden,
+	}, {
+		msg: "custom header, default header ignored",
+		options: Options{
+			BlockedCountries: []string{"XX"},
+			CountryHeader:    "X-Country-Code"},
+		header:  DefaultCountryHeader,
+		country: "XX",
+	}} {
+		o := ti.options
+		o.AuthUrlBase = authServer.URL
+		f, err := NewAuthWithOptions(o).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, "Bearer "+testToken)
+		if ti.header != "" {
+			req.Header.Set(ti.header, ti.country)
+		}
+
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if ti.status == 0 {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse ||
+			ctx.FResponse.StatusCode != ti.status ||
+			ctx.StateBag()[authRejectReasonKey] != string(geoBlocked) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+	}
+}
+
+func TestMaxRequestBytes(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}})
+	defer authServer.Close()
+
+	for _, ti := range []struct {
+		msg       string
+		max       int64
+		body      string
+		chunked   bool
+		bodyToken bool
+		reject    bool
+	}{{
+		msg:  "disabled by default",
+		body: strings.Repeat("x", 64),
+	}, {
+		msg:  "within the limit",
+		max:  64,
+		body: strings.Repeat("x", 64),
+	}, {
+		msg:    "oversized",
+		max:    64,
+		body:   strings.Repeat("x", 65),
+		reject: true,
+	}, {
+		msg:     "streamed, within the limit",
+		max:     64,
+		body:    strings.Repeat("x", 48) + "token=test-token",
+		chunked: true,
+	}, {
+		msg:       "streamed, oversized, token in body",
+		max:       64,
+		body:      strings.Repeat("x", 64) + "token=test-token",
+		chunked:   true,
+		bodyToken: true,
+		reject:    true,
+	}} {
+		o := Options{AuthUrlBase: authServer.URL, MaxRequestBytes: ti.max}
+		if ti.bodyToken {
+			o.BodyToken = regexp.MustCompile("token=([a-z-]+)")
+		}
+
+		f, err := NewAuthWithOptions(o).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("POST", "https://www.example.org", strings.NewReader(ti.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ti.chunked {
+			req.ContentLength = -1
+		}
+
+		if !ti.bodyToken {
+			req.Header.Set(authHeaderName, "Bearer "+testToken)
+		}
+
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if !ti.reject {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+				continue
+			}
+
+			b, err := ioutil.ReadAll(req.Body)
+			if err != nil || string(b) != ti.body {
+				t.Error(ti.msg, "failed to forward the body", err)
+			}
+		} else if !ctx.FServedWithResponse ||
+			ctx.FResponse.StatusCode != http.StatusRequestEntityTooLarge ||
+			ctx.StateBag()[authRejectReasonKey] != string(requestTooLarge) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+	}
+}
+
+func TestLimitedBody(t *testing.T) {
+	req, err := http.NewRequest("POST", "https://www.example.org", strings.NewReader(strings.Repeat("x", 65)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.ContentLength = -1
+	f := &filter{options: &Options{MaxRequestBytes: 64}}
+	if !f.limitBody(req) {
+		t.Fatal("failed to accept unknown length")
+	}
+
+	b, err := ioutil.ReadAll(req.Body)
+	if err != errRequestTooLarge || len(b) != 64 {
+		t.Error("failed to limit the body", len(b), err)
+	}
+}
+
+func TestEmptyBearerToken(t *testing.T) {
+	var calls int32
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer authServer.Close()
+
+	f, err := NewAuthWithOptions(Options{AuthUrlBase: authServer.URL}).CreateFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, h := range []string{"Bearer ", "Bearer   "} {
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, h)
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(missingBearerToken) {
+			t.Errorf("failed to reject %q: %v", h, ctx.StateBag()[authRejectReasonKey])
+		}
+	}
+
+	if calls != 0 {
+		t.Error("unexpected call to the auth service", calls)
+	}
+}
+
+func TestPassPreflight(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}})
+	defer authServer.Close()
+
+	for _, ti := range []struct {
+		msg     string
+		options Options
+		method  string
+		origin  string
+		reason  rejectReason
+	}{{
+		msg:    "disabled by default",
+		method: "OPTIONS",
+		origin: "https://app.example.org",
+		reason: missingBearerToken,
+	}, {
+		msg:     "preflight",
+		options: Options{PassPreflight: true},
+		method:  "OPTIONS",
+		origin:  "https://app.example.org",
+	}, {
+		msg:     "not a preflight",
+		options: Options{PassPreflight: true},
+		method:  "GET",
+		origin:  "https://app.example.org",
+		reason:  missingBearerToken,
+	}, {
+		msg: "allowed origin",
+		options: Options{
+			PassPreflight:  true,
+			AllowedOrigins: []string{"https://app.example.org"}},
+		method: "OPTIONS",
+		origin: "https://app.example.org",
+	}, {
+		msg: "disallowed origin",
+		options: Options{
+			PassPreflight:  true,
+			AllowedOrigins: []string{"https://app.example.org"}},
+		method: "OPTIONS",
+		origin: "https://evil.example.com",
+		reason: originNotAllowed,
+	}} {
+		o := ti.options
+		o.AuthUrlBase = authServer.URL
+		f, err := NewAuthWithOptions(o).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(ti.method, "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Origin", ti.origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to pass", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+	}
+}
+
+func TestAuthCacheClock(t *testing.T) {
+	var calls int32
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(`{"uid": "jdoe", "realm": "/immortals"}`))
+	}))
+	defer authServer.Close()
+
+	clock := newTestClock()
+	f, err := NewAuthWithOptions(Options{
+		AuthUrlBase:  authServer.URL,
+		AuthCacheTTL: time.Minute,
+		Now:          clock.Now}).CreateFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func() {
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, "Bearer "+testToken)
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if ctx.FServedWithResponse {
+			t.Fatal("failed to authorize", ctx.StateBag()[authRejectReasonKey])
+		}
+	}
+
+	request()
+	clock.advance(30 * time.Second)
+	request()
+	if calls != 1 {
+		t.Error("failed to cache the validation", calls)
+	}
+
+	clock.advance(30 * time.Second)
+	request()
+	if calls != 2 {
+		t.Error("failed to expire the cached validation", calls)
+	}
+}
+
+func TestTeamPagination(t *testing.T) {
+	var calls, otherCalls int32
+	otherServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&otherCalls, 1)
+		w.Write([]byte(`[{"id": "team-other"}]`))
+	}))
+	defer otherServer.Close()
+
+	teamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		switch r.URL.Query().Get("page") {
+		case "":
+			w.Header().Set("Link", `<?page=2>; rel="next", <?page=1>; rel="first"`)
+			w.Write([]byte(`[{"id": "team-1"}]`))
+		case "2":
+			w.Write([]byte(`[{"id": "team-2"}]`))
+		case "cross":
+			// next link pointing to a different host
+			w.Header().Set("Link", `<`+otherServer.URL+`/?page=2>; rel=next`)
+			w.Write([]byte(`[{"id": "team-1"}]`))
+		default:
+			// pagination loop, linking to itself
+			w.Header().Set("Link", `<`+r.URL.String()+`>; rel=next`)
+			w.Write([]byte(`[{"id": "team-loop"}]`))
+		}
+	}))
+	defer teamServer.Close()
+
+	for _, ti := range []struct {
+		msg      string
+		url      string
+		maxPages int
+		fail     bool
+		teams    []string
+		calls    int32
+	}{{
+		msg:   "multiple pages",
+		url:   teamServer.URL + "/?uid=",
+		teams: []string{"team-1", "team-2"},
+		calls: 2,
+	}, {
+		msg:   "self-referential next link, default limit",
+		url:   teamServer.URL + "/?page=loop&uid=",
+		teams: []string{"team-loop"},
+		calls: DefaultMaxTeamPages,
+	}, {
+		msg:      "self-referential next link, custom limit",
+		url:      teamServer.URL + "/?page=loop&uid=",
+		maxPages: 3,
+		teams:    []string{"team-loop"},
+		calls:    3,
+	}, {
+		msg:      "self-referential next link, failing",
+		url:      teamServer.URL + "/?page=loop&uid=",
+		maxPages: 3,
+		fail:     true,
+		calls:    3,
+	}, {
+		msg:   "cross-host next link",
+		url:   teamServer.URL + "/?page=cross&uid=",
+		teams: []string{"team-1"},
+		calls: 1,
+	}} {
+		atomic.StoreInt32(&calls, 0)
+		s := NewAuthTeamWithOptions(Options{
+			TeamUrlBase:         ti.url,
+			MaxTeamPages:        ti.maxPages,
+			FailOnTeamPageLimit: ti.fail}).(*spec)
+
+		teams, err := s.teamClient.getTeams(testUid, testToken)
+		if ti.fail {
+			if err != errTeamPageLimit {
+				t.Error(ti.msg, "failed to fail", err)
+			}
+		} else if err != nil {
+			t.Error(ti.msg, err)
+		} else if !intersect(teams, ti.teams) || len(teams) < len(ti.teams) {
+			t.Error(ti.msg, "invalid teams", teams)
+		}
+
+		if calls != ti.calls {
+			t.Error(ti.msg, "invalid number of calls", calls)
+		}
+
+		if otherCalls != 0 {
+			t.Error(ti.msg, "followed a next link to a different host")
+		}
+	}
+}
+
+func TestAuditSinks(t *testing.T) {
+	var jsonLog, logfmtLog bytes.Buffer
+	f, err := NewAuditLogWithOptions(AuditLogOptions{
+		Sinks: []AuditSink{
+			{Writer: &logfmtLog, Format: AuditLogfmt},
+			{Writer: &jsonLog, Format: AuditJSON}}}).CreateFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "https://www.example.org/orders", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := newTestContext(req, &http.Response{StatusCode: http.StatusUnauthorized})
+	ctx.StateBag()[authUserKey] = testUid
+	ctx.StateBag()[authRejectReasonKey] = string(invalidScope)
+	f.Request(ctx)
+	f.Response(ctx)
+
+	var doc auditDoc
+	if err := json.Unmarshal(jsonLog.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.Path != "/orders" || doc.AuthStatus == nil || doc.AuthStatus.Reason != string(invalidScope) {
+		t.Error("invalid JSON entry", jsonLog.String())
+	}
+
+	entry := logfmtLog.String()
+	if !strings.Contains(entry, "path=/orders") ||
+		!strings.Contains(entry, "user=jdoe") ||
+		!strings.Contains(entry, "reason=invalid-scope") ||
+		strings.Count(entry, "\n") != 1 {
+		t.Error("invalid logfmt entry", entry)
+	}
+}
+
+func TestRequireScopeField(t *testing.T) {
+	for _, ti := range []struct {
+		msg        string
+		response   string
+		scopeClaim string
+		require    bool
+		reason     rejectReason
+	}{{
+		msg:      "absent, not required",
+		response: `{"uid": "jdoe", "realm": "/immortals"}`,
+	}, {
+		msg:      "absent",
+		response: `{"uid": "jdoe", "realm": "/immortals"}`,
+		require:  true,
+		reason:   missingScopeField,
+	}, {
+		msg:      "null",
+		response: `{"uid": "jdoe", "realm": "/immortals", "scope": null}`,
+		require:  true,
+		reason:   missingScopeField,
+	}, {
+		msg:      "empty",
+		response: `{"uid": "jdoe", "realm": "/immortals", "scope": []}`,
+		require:  true,
+	}, {
+		msg:      "present",
+		response: `{"uid": "jdoe", "realm": "/immortals", "scope": ["read"]}`,
+		require:  true,
+	}, {
+		msg:        "custom claim absent",
+		response:   `{"uid": "jdoe", "realm": "/immortals"}`,
+		scopeClaim: "scp",
+		require:    true,
+		reason:     missingScopeField,
+	}, {
+		msg:        "custom claim empty",
+		response:   `{"uid": "jdoe", "realm": "/immortals", "scp": []}`,
+		scopeClaim: "scp",
+		require:    true,
+	}} {
+		authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(ti.response))
+		}))
+
+		f, err := NewAuthWithOptions(Options{
+			AuthUrlBase:       authServer.URL,
+			ScopeClaim:        ti.scopeClaim,
+			RequireScopeField: ti.require}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, "Bearer "+testToken)
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+
+		authServer.Close()
+	}
+}
+
+func TestMaxCacheAge(t *testing.T) {
+	var calls int32
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(`{"uid": "jdoe", "realm": "/immortals"}`))
+	}))
+	defer authServer.Close()
+
+	clock := newTestClock()
+	f, err := NewAuthWithOptions(Options{
+		AuthUrlBase:  authServer.URL,
+		AuthCacheTTL: 5 * time.Minute,
+		MaxCacheAge:  time.Minute,
+		Now:          clock.Now}).CreateFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, advance := range []time.Duration{0, 30 * time.Second, 30 * time.Second, 30 * time.Second} {
+		clock.advance(advance)
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, "Bearer "+testToken)
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if ctx.FServedWithResponse {
+			t.Fatal(i, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+		}
+	}
+
+	// validated at 0s, cached until 60s, validated again at 60s, and
+	// cached at 90s
+	if calls != 2 {
+		t.Error("failed to revalidate after the max age", calls)
+	}
+}
+
+func TestCoalesceValidations(t *testing.T) {
+	for _, ti := range []struct {
+		msg      string
+		cacheTTL time.Duration
+	}{{
+		msg: "without cache",
+	}, {
+		msg:      "with cache",
+		cacheTTL: time.Minute,
+	}} {
+		var calls int32
+		release := make(chan struct{})
+		authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			w.Write([]byte(`{"uid": "jdoe", "realm": "/immortals"}`))
+		}))
+
+		f, err := NewAuthWithOptions(Options{
+			AuthUrlBase:         authServer.URL,
+			AuthCacheTTL:        ti.cacheTTL,
+			CoalesceValidations: true}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			req, err := http.NewRequest("GET", "https://www.example.org", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Set(authHeaderName, "Bearer "+testToken)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ctx := newTestContext(req, nil)
+				f.Request(ctx)
+				if ctx.FServedWithResponse {
+					t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+				}
+			}()
+		}
+
+		// let the requests arrive while the validation is pending
+		time.Sleep(120 * time.Millisecond)
+		close(release)
+		wg.Wait()
+		authServer.Close()
+
+		if calls != 1 {
+			t.Error(ti.msg, "failed to coalesce the validations", calls)
+		}
+	}
+}
+
+func TestHostScopes(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{
+		Uid:    testUid,
+		Realm:  realms{testRealm},
+		Scopes: []string{"tenant-a.read", "tenant-b.write"}})
+	defer authServer.Close()
+
+	hostScopes := []HostScope{
+		{Host: regexp.MustCompile(`^a\.example\.org$`), Prefix: "tenant-a."},
+		{Host: regexp.MustCompile(`^b\.example\.org$`), Prefix: "tenant-b."},
+		{Host: regexp.MustCompile(`^c\.example\.org$`), Prefix: "tenant-c."}}
+
+	for _, ti := range []struct {
+		msg    string
+		host   string
+		scope  string
+		reason rejectReason
+	}{{
+		msg:   "matching tenant",
+		host:  "a.example.org",
+		scope: "read",
+	}, {
+		msg:   "matching tenant, with port",
+		host:  "b.example.org:8443",
+		scope: "write",
+	}, {
+		msg:    "scope of another tenant",
+		host:   "a.example.org",
+		scope:  "write",
+		reason: tenantMismatch,
+	}, {
+		msg:    "tenant without scopes",
+		host:   "c.example.org",
+		scope:  "read",
+		reason: tenantMismatch,
+	}, {
+		msg:   "no matching host, unqualified",
+		host:  "www.example.org",
+		scope: "tenant-a.read",
+	}, {
+		msg:    "no matching host, missing scope",
+		host:   "www.example.org",
+		scope:  "read",
+		reason: invalidScope,
+	}} {
+		f, err := NewAuthWithOptions(Options{
+			AuthUrlBase: authServer.URL,
+			HostScopes:  hostScopes}).CreateFilter([]interface{}{testRealm, ti.scope})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://"+ti.host, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, "Bearer "+testToken)
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+	}
+}
+
+func TestErrorField(t *testing.T) {
+	for _, ti := range []struct {
+		msg        string
+		errorField string
+		errorValue string
+		strict     bool
+		response   string
+		reason     rejectReason
+	}{{
+		msg:      "disabled by default",
+		response: `{"error": "invalid_token"}`,
+	}, {
+		msg:        "error in the body",
+		errorField: "error",
+		response:   `{"error": "invalid_token"}`,
+		reason:     invalidToken,
+	}, {
+		msg:        "error in the body, strict decoding",
+		errorField: "error",
+		strict:     true,
+		response:   `{"error": "invalid_token"}`,
+		reason:     invalidToken,
+	}, {
+		msg:        "no error",
+		errorField: "error",
+		response:   `{"uid": "jdoe", "realm": "/immortals"}`,
+	}, {
+		msg:        "empty error",
+		errorField: "error",
+		response:   `{"uid": "jdoe", "realm": "/immortals", "error": null}`,
+	}, {
+		msg:        "matching error value",
+		errorField: "active",
+		errorValue: "false",
+		response:   `{"uid": "jdoe", "active": false}`,
+		reason:     invalidToken,
+	}, {
+		msg:        "other error value",
+		errorField: "active",
+		errorValue: "false",
+		response:   `{"uid": "jdoe", "active": true}`,
+	}} {
+		var calls int32
+		authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.Write([]byte(ti.response))
+		}))
+
+		f, err := NewAuthWithOptions(Options{
+			AuthUrlBase:    authServer.URL,
+			AuthCacheTTL:   time.Minute,
+			StrictDecoding: ti.strict,
+			ErrorField:     ti.errorField,
+			ErrorValue:     ti.errorValue}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			req, err := http.NewRequest("GET", "https://www.example.org", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Set(authHeaderName, "Bearer "+testToken)
+			ctx := newTestContext(req, nil)
+			f.Request(ctx)
+			if ti.reason == "" {
+				if ctx.FServedWithResponse {
+					t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+				}
+			} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+				t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+			}
+		}
+
+		// the errors are not cached
+		if ti.reason != "" && calls != 2 {
+			t.Error(ti.msg, "unexpected number of calls", calls)
+		}
+
+		authServer.Close()
+	}
+}
+
+func TestOwnerPath(t *testing.T) {
+	for _, template := range []string{"/users", "/users/{id}/orders/{order}", "/users/{}"} {
+		if _, err := NewAuthWithOptions(Options{OwnerPath: template}).CreateFilter(nil); err == nil {
+			t.Error("failed to fail on invalid template", template)
+		}
+	}
+
+	for _, ti := range []struct {
+		msg    string
+		scopes []string
+		path   string
+		reason rejectReason
+	}{{
+		msg:  "owner",
+		path: "/users/jdoe",
+	}, {
+		msg:  "owner, sub-resource",
+		path: "/users/jdoe/orders/42",
+	}, {
+		msg:    "not the owner",
+		path:   "/users/jane",
+		reason: notResourceOwner,
+	}, {
+		msg:    "not the owner, prefix of the uid",
+		path:   "/users/jdoex",
+		reason: notResourceOwner,
+	}, {
+		msg:    "admin bypass",
+		scopes: []string{"admin"},
+		path:   "/users/jane",
+	}, {
+		msg:  "other path",
+		path: "/orders/42",
+	}} {
+		authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}, Scopes: ti.scopes})
+		f, err := NewAuthWithOptions(Options{
+			AuthUrlBase:       authServer.URL,
+			OwnerPath:         "/users/{id}",
+			OwnerBypassScopes: []string{"admin"}}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org"+ti.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, "Bearer "+testToken)
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+
+		authServer.Close()
+	}
+}
+
+func TestAuditFieldNames(t *testing.T) {
+	var b bytes.Buffer
+	f, err := NewAuditLogWithOptions(AuditLogOptions{
+		Writer: &b,
+		FieldNames: map[string]string{
+			"method": "http_method",
+			"path":   "http_path",
+			"status": "http_status"}}).CreateFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "https://www.example.org/orders", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := newTestContext(req, &http.Response{StatusCode: http.StatusUnauthorized})
+	ctx.StateBag()[authUserKey] = testUid
+	ctx.StateBag()[authRejectReasonKey] = string(invalidScope)
+	f.Request(ctx)
+	f.Response(ctx)
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc["http_method"] != "GET" || doc["http_path"] != "/orders" || doc["http_status"] != float64(401) {
+		t.Error("failed to rename the fields", b.String())
+	}
+
+	for _, k := range []string{"method", "path", "status"} {
+		if _, ok := doc[k]; ok {
+			t.Error("failed to remove the default field name", k)
+		}
+	}
+
+	if s, ok := doc["authStatus"].(map[string]interface{}); !ok || s["reason"] != string(invalidScope) {
+		t.Error("failed to keep the unmapped fields", b.String())
+	}
+}
+
+func TestBindingCookie(t *testing.T) {
+	const session = "session-value"
+	for _, ti := range []struct {
+		msg      string
+		claims   string
+		claim    string
+		cookie   string
+		reason   rejectReason
+		noCookie bool
+	}{{
+		msg:    "matching",
+		claims: `, "binding": "` + tokenHashClaim(session) + `"`,
+		cookie: session,
+	}, {
+		msg:    "mismatching",
+		claims: `, "binding": "` + tokenHashClaim(session) + `"`,
+		cookie: "stolen-token-other-session",
+		reason: bindingMismatch,
+	}, {
+		msg:      "missing cookie",
+		claims:   `, "binding": "` + tokenHashClaim(session) + `"`,
+		noCookie: true,
+		reason:   bindingMismatch,
+	}, {
+		msg:      "unbound token",
+		noCookie: true,
+	}, {
+		msg:    "custom claim",
+		claims: `, "sid_hash": "` + tokenHashClaim(session) + `"`,
+		claim:  "sid_hash",
+		cookie: session,
+	}, {
+		msg:    "custom claim, mismatching",
+		claims: `, "sid_hash": "` + tokenHashClaim("other") + `"`,
+		claim:  "sid_hash",
+		cookie: session,
+		reason: bindingMismatch,
+	}} {
+		authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"uid": "jdoe", "realm": "/immortals"` + ti.claims + `}`))
+		}))
+
+		f, err := NewAuthWithOptions(Options{
+			AuthUrlBase:   authServer.URL,
+			BindingCookie: "session",
+			BindingClaim:  ti.claim}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, "Bearer "+testToken)
+		if !ti.noCookie {
+			req.AddCookie(&http.Cookie{Name: "session", Value: ti.cookie})
+		}
+
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+
+		authServer.Close()
+	}
+}
+
+func TestCacheReaper(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}})
+	defer authServer.Close()
+
+	clock := newTestClock()
+	s := NewAuthWithOptions(Options{
+		AuthUrlBase:       authServer.URL,
+		AuthCacheTTL:      time.Minute,
+		CacheReapInterval: 5 * time.Millisecond,
+		Now:               clock.Now})
+	defer s.Close()
+
+	f, err := s.CreateFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "https://www.example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set(authHeaderName, "Bearer "+testToken)
+	f.Request(newTestContext(req, nil))
+	if st := s.Stats().Auth; st.Entries != 1 {
+		t.Fatal("failed to cache the validation", st)
+	}
+
+	// the entry expires, and it is evicted without being accessed
+	clock.advance(time.Minute)
+	deadline := time.Now().Add(time.Second)
+	for {
+		st := s.Stats().Auth
+		if st.Entries == 0 && st.Evictions == 1 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("failed to reap the expired entry", st)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRejectStatus(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}, Scopes: []string{"read"}})
+	defer authServer.Close()
+
+	rejectStatus := map[string]int{
+		string(invalidScope):    http.StatusUnprocessableEntity,
+		string(invalidRealm):    http.StatusForbidden,
+		string(geoBlocked):      http.StatusForbidden,
+		string(requestTooLarge): 0}
+
+	for _, ti := range []struct {
+		msg     string
+		args    []interface{}
+		country string
+		body    string
+		json    bool
+		noToken bool
+		status  int
+	}{{
+		msg:    "mapped scope failure",
+		args:   []interface{}{testRealm, "write"},
+		status: http.StatusUnprocessableEntity,
+	}, {
+		msg:    "mapped scope failure, JSON",
+		args:   []interface{}{testRealm, "write"},
+		json:   true,
+		status: http.StatusUnprocessableEntity,
+	}, {
+		msg:    "mapped realm failure",
+		args:   []interface{}{"/other-realm"},
+		status: http.StatusForbidden,
+	}, {
+		msg:     "mapped over the custom default",
+		country: "XX",
+		status:  http.StatusForbidden,
+	}, {
+		msg:     "unmapped",
+		noToken: true,
+		status:  http.StatusUnauthorized,
+	}, {
+		msg:    "zero status ignored",
+		body:   strings.Repeat("x", 65),
+		status: http.StatusRequestEntityTooLarge,
+	}} {
+		f, err := NewAuthWithOptions(Options{
+			AuthUrlBase:      authServer.URL,
+			RejectStatus:     rejectStatus,
+			JSONErrors:       ti.json,
+			BlockedCountries: []string{"XX"},
+			MaxRequestBytes:  64}).CreateFilter(ti.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("POST", "https://www.example.org", strings.NewReader(ti.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !ti.noToken {
+			req.Header.Set(authHeaderName, "Bearer "+testToken)
+		}
+
+		if ti.country != "" {
+			req.Header.Set(DefaultCountryHeader, ti.country)
+		}
+
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if !ctx.FServedWithResponse || ctx.FResponse.StatusCode != ti.status {
+			t.Error(ti.msg, "invalid status", ctx.StateBag()[authRejectReasonKey])
+		}
+	}
+}
+
+func TestAuditAuthSource(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}})
+	defer authServer.Close()
+
+	u, err := url.Parse(authServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ti := range []struct {
+		msg      string
+		record   bool
+		token    string
+		expected string
+	}{{
+		msg:   "not recorded by default",
+		token: testToken,
+	}, {
+		msg:      "authorized",
+		record:   true,
+		token:    testToken,
+		expected: u.Host,
+	}, {
+		msg:      "rejected",
+		record:   true,
+		token:    "invalid-token",
+		expected: u.Host,
+	}} {
+		s := NewAuthWithOptions(Options{
+			AuthUrlBase:      authServer.URL + "/oauth2/tokeninfo?realm=" + testRealm,
+			RecordAuthSource: ti.record})
+		ctx := testAuthFilter(t, s, nil, ti.token)
+
+		var b bytes.Buffer
+		al, err := NewAuditLogWithOptions(AuditLogOptions{Writer: &b}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx.FResponse = &http.Response{StatusCode: http.StatusOK}
+		al.Response(ctx)
+
+		var doc auditDoc
+		if err := json.Unmarshal(b.Bytes(), &doc); err != nil {
+			t.Error(ti.msg, err)
+			continue
+		}
+
+		if doc.AuthStatus == nil || doc.AuthStatus.AuthSource != ti.expected {
+			t.Error(ti.msg, "invalid auth source", b.String())
+		}
+	}
+}
+
+func TestMaxTokenLifetime(t *testing.T) {
+	clock := newTestClock()
+	now := clock.Now().Unix()
+	for _, ti := range []struct {
+		msg      string
+		lifetime time.Duration
+		claims   string
+		reason   rejectReason
+	}{{
+		msg:    "not checked by default",
+		claims: fmt.Sprintf(`, "iat": %d`, now-24*3600),
+	}, {
+		msg:      "within the lifetime",
+		lifetime: 8 * time.Hour,
+		claims:   fmt.Sprintf(`, "iat": %d`, now-7*3600),
+	}, {
+		msg:      "over the lifetime",
+		lifetime: 8 * time.Hour,
+		claims:   fmt.Sprintf(`, "iat": %d`, now-9*3600),
+		reason:   tokenTooOld,
+	}, {
+		msg:      "without iat",
+		lifetime: 8 * time.Hour,
+	}, {
+		msg:      "invalid iat",
+		lifetime: 8 * time.Hour,
+		claims:   `, "iat": "yesterday"`,
+		reason:   tokenTooOld,
+	}} {
+		authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"uid": "jdoe", "realm": "/immortals"` + ti.claims + `}`))
+		}))
+
+		f, err := NewAuthWithOptions(Options{
+			AuthUrlBase:      authServer.URL,
+			MaxTokenLifetime: ti.lifetime,
+			Now:              clock.Now}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, "Bearer "+testToken)
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+
+		authServer.Close()
+	}
+}
+
+func TestRealmScopes(t *testing.T) {
+	realmScopes := map[string][]string{
+		"/services":  {"read", "write"},
+		"/employees": {"read", "admin"}}
+
+	for _, ti := range []struct {
+		msg    string
+		realms realms
+		scopes []string
+		reason rejectReason
+	}{{
+		msg:    "allowed scopes",
+		realms: realms{"/services"},
+		scopes: []string{"read", "write"},
+	}, {
+		msg:    "no scopes",
+		realms: realms{"/services"},
+	}, {
+		msg:    "cross-realm scope",
+		realms: realms{"/services"},
+		scopes: []string{"read", "admin"},
+		reason: scopeRealmViolation,
+	}, {
+		msg:    "multiple realms",
+		realms: realms{"/services", "/employees"},
+		scopes: []string{"write", "admin"},
+	}, {
+		msg:    "realm not restricted",
+		realms: realms{"/contractors"},
+		scopes: []string{"admin"},
+	}, {
+		msg:    "unmapped realm next to a mapped one",
+		realms: realms{"/services", "/contractors"},
+		scopes: []string{"read", "admin"},
+		reason: scopeRealmViolation,
+	}, {
+		msg:    "unmapped realm next to a mapped one, allowed scopes",
+		realms: realms{"/services", "/contractors"},
+		scopes: []string{"read", "write"},
+	}} {
+		authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: ti.realms, Scopes: ti.scopes})
+		f, err := NewAuthWithOptions(Options{
+			AuthUrlBase: authServer.URL,
+			RealmScopes: realmScopes}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, "Bearer "+testToken)
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+
+		authServer.Close()
+	}
+}
+
+func TestOnBehalfOf(t *testing.T) {
+	for _, ti := range []struct {
+		msg        string
+		scopes     []string
+		onBehalfOf []string
+		reason     rejectReason
+	}{{
+		msg: "no header",
+	}, {
+		msg:        "matching uid",
+		onBehalfOf: []string{testUid},
+	}, {
+		msg:        "mismatched uid",
+		onBehalfOf: []string{"jane"},
+		reason:     impersonation,
+	}, {
+		msg:        "empty header",
+		onBehalfOf: []string{""},
+		reason:     impersonation,
+	}, {
+		msg:        "multiple values",
+		onBehalfOf: []string{testUid, "jane"},
+		reason:     impersonation,
+	}, {
+		msg:        "mismatched uid with impersonation scope",
+		scopes:     []string{"impersonate"},
+		onBehalfOf: []string{"jane"},
+	}} {
+		authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}, Scopes: ti.scopes})
+		f, err := NewAuthWithOptions(Options{
+			AuthUrlBase:         authServer.URL,
+			OnBehalfOfHeader:    "X-On-Behalf-Of",
+			ImpersonationScopes: []string{"impersonate"}}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, "Bearer "+testToken)
+		for _, v := range ti.onBehalfOf {
+			req.Header.Add("X-On-Behalf-Of", v)
+		}
+
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+
+		authServer.Close()
+	}
+}
+
+func TestRealmPresence(t *testing.T) {
+	for _, ti := range []struct {
+		msg      string
+		response string
+		present  bool
+		realm    string
+	}{{
+		msg:      "absent",
+		response: `{"uid": "jdoe"}`,
+	}, {
+		msg:      "null",
+		response: `{"uid": "jdoe", "realm": null}`,
+	}, {
+		msg:      "empty string",
+		response: `{"uid": "jdoe", "realm": ""}`,
+		present:  true,
+	}, {
+		msg:      "single",
+		response: `{"uid": "jdoe", "realm": "/employees"}`,
+		present:  true,
+		realm:    "/employees",
+	}, {
+		msg:      "multiple",
+		response: `{"uid": "jdoe", "realm": ["/employees", "/services"]}`,
+		present:  true,
+		realm:    "/employees,/services",
+	}} {
+		authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(ti.response))
+		}))
+
+		s := NewAuthWithOptions(Options{AuthUrlBase: authServer.URL, ForwardIdentity: true})
+		ctx := testAuthFilter(t, s, nil, testToken)
+		authServer.Close()
+		if ctx.FServedWithResponse {
+			t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			continue
+		}
+
+		values, ok := ctx.Request().Header[realmHeaderName]
+		if ok != ti.present || ok && (len(values) != 1 || values[0] != ti.realm) {
+			t.Error(ti.msg, "invalid realm header", values, ok)
+		}
+
+		var b bytes.Buffer
+		al, err := NewAuditLogWithOptions(AuditLogOptions{Writer: &b}).CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx.FResponse = &http.Response{StatusCode: http.StatusOK}
+		al.Response(ctx)
+
+		var doc auditDoc
+		if err := json.Unmarshal(b.Bytes(), &doc); err != nil || doc.AuthStatus == nil {
+			t.Error(ti.msg, "invalid audit entry", err, b.String())
+			continue
+		}
+
+		if ti.present != (doc.AuthStatus.Realm != nil) || ti.present && *doc.AuthStatus.Realm != ti.realm {
+			t.Error(ti.msg, "invalid audit realm", b.String())
+		}
+	}
+}
+
+func TestScopeMethods(t *testing.T) {
+	scopeMethods := map[string][]string{
+		"reader": {"GET", "HEAD"},
+		"writer": {"*"}}
+
+	for _, ti := range []struct {
+		msg    string
+		scopes []string
+		method string
+		reject bool
+	}{{
+		msg:    "reader, GET",
+		scopes: []string{"reader"},
+		method: "GET",
+	}, {
+		msg:    "reader, HEAD",
+		scopes: []string{"reader"},
+		method: "HEAD",
+	}, {
+		msg:    "reader, POST",
+		scopes: []string{"reader"},
+		method: "POST",
+		reject: true,
+	}, {
+		msg:    "writer, POST",
+		scopes: []string{"writer"},
+		method: "POST",
+	}, {
+		msg:    "reader and writer, DELETE",
+		scopes: []string{"reader", "writer"},
+		method: "DELETE",
+	}, {
+		msg:    "unmapped scope",
+		scopes: []string{"admin"},
+		method: "GET",
+		reject: true,
+	}, {
+		msg:    "no scopes",
+		method: "GET",
+		reject: true,
+	}} {
+		authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}, Scopes: ti.scopes})
+		f, err := NewAuthWithOptions(Options{
+			AuthUrlBase:  authServer.URL,
+			ScopeMethods: scopeMethods}).CreateFilter([]interface{}{testRealm})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(ti.method, "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(authHeaderName, "Bearer "+testToken)
+		ctx := newTestContext(req, nil)
+		f.Request(ctx)
+		authServer.Close()
+
+		if !ti.reject {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+			}
+		} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(methodNotPermitted) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+	}
+}
+
+func TestAuthServiceErrorStatus(t *testing.T) {
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}})
+	defer authServer.Close()
+
+	for _, ti := range []struct {
+		msg     string
+		options Options
+		token   string
+		status  int
+		reason  rejectReason
+	}{{
+		msg:     "unreachable, default",
+		options: Options{AuthUrlBase: unreachable.URL},
+		token:   testToken,
+		status:  http.StatusServiceUnavailable,
+		reason:  authServiceAccess,
+	}, {
+		msg:     "unreachable, configured",
+		options: Options{AuthUrlBase: unreachable.URL, AuthServiceErrorStatus: http.StatusGatewayTimeout},
+		token:   testToken,
+		status:  http.StatusGatewayTimeout,
+		reason:  authServiceAccess,
+	}, {
+		msg: "unreachable, overridden by reason",
+		options: Options{
+			AuthUrlBase:            unreachable.URL,
+			AuthServiceErrorStatus: http.StatusGatewayTimeout,
+			RejectStatus:           map[string]int{string(authServiceAccess): http.StatusBadGateway}},
+		token:  testToken,
+		status: http.StatusBadGateway,
+		reason: authServiceAccess,
+	}, {
+		msg:     "invalid token",
+		options: Options{AuthUrlBase: authServer.URL},
+		token:   "invalid-token",
+		status:  http.StatusUnauthorized,
+		reason:  invalidToken,
+	}} {
+		ctx := testAuthFilter(t, NewAuthWithOptions(ti.options), []interface{}{testRealm}, ti.token)
+		if !ctx.FServedWithResponse ||
+			ctx.FResponse.StatusCode != ti.status ||
+			ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+		}
+	}
+}
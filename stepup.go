@@ -0,0 +1,146 @@
+package skoap
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zalando/skipper/filters"
+)
+
+// StepUpAuthName is the name of the stepUpAuth filter.
+const StepUpAuthName = "stepUpAuth"
+
+const (
+	otpHeaderName = "X-OTP"
+
+	// RFC 6238 defaults, as used by the common authenticator apps
+	otpStep   = 30 * time.Second
+	otpDigits = 6
+
+	// the number of steps accepted before and after the current one,
+	// to tolerate clock drift
+	otpSkew = 1
+)
+
+const (
+	otpRequired     rejectReason = "otp-required"
+	otpInvalid      rejectReason = "otp-invalid"
+	otpSecretAccess rejectReason = "otp-secret-access"
+)
+
+type stepUp struct {
+	secretLookup func(uid string) (string, error)
+	now          func() time.Time
+}
+
+// NewStepUpAuth creates a stepUpAuth filter specification, requiring a
+// TOTP second factor (RFC 6238) from the authenticated user. The filter
+// needs to be placed after an auth filter in the route. It expects the
+// current code of the user in the X-OTP header, and verifies it with
+// the base32 encoded secret returned by otpSecretLookup for the user
+// id. Requests without the header are rejected with otp-required, and
+// requests with a wrong code with otp-invalid, both with 401. When the
+// lookup fails, the request is rejected with 503. Requests without an
+// authenticated user are rejected with 401.
+//
+//     * -> auth("/employees") -> stepUpAuth() -> "https://www.example.org"
+//
+func NewStepUpAuth(otpSecretLookup func(uid string) (string, error)) filters.Spec {
+	return &stepUp{secretLookup: otpSecretLookup, now: time.Now}
+}
+
+func (s *stepUp) Name() string { return StepUpAuthName }
+
+func (s *stepUp) CreateFilter(args []interface{}) (filters.Filter, error) {
+	if len(args) != 0 {
+		return nil, filters.ErrInvalidFilterParameters
+	}
+
+	return s, nil
+}
+
+func rejectStepUp(ctx filters.FilterContext, reason rejectReason, status int) {
+	ctx.StateBag()[authRejectReasonKey] = string(reason)
+	ctx.Serve(&http.Response{StatusCode: status})
+}
+
+// returns the code of a base32 encoded secret for a time step, as in
+// RFC 4226
+func totp(secret string, step int64) (string, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return "", err
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	m := hmac.New(sha1.New, key)
+	m.Write(counter[:])
+	sum := m.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", otpDigits, code%1000000), nil
+}
+
+func (s *stepUp) verify(secret, code string) (bool, error) {
+	if len(code) != otpDigits {
+		return false, nil
+	}
+
+	step := s.now().Unix() / int64(otpStep/time.Second)
+	for i := int64(-otpSkew); i <= otpSkew; i++ {
+		expected, err := totp(secret, step+i)
+		if err != nil {
+			return false, err
+		}
+
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *stepUp) Request(ctx filters.FilterContext) {
+	uid, _ := ctx.StateBag()[authUserKey].(string)
+	if uid == "" {
+		rejectStepUp(ctx, missingUser, http.StatusUnauthorized)
+		return
+	}
+
+	code := ctx.Request().Header.Get(otpHeaderName)
+	if code == "" {
+		rejectStepUp(ctx, otpRequired, http.StatusUnauthorized)
+		return
+	}
+
+	secret, err := s.secretLookup(uid)
+	if err != nil {
+		log.Println(err)
+		rejectStepUp(ctx, otpSecretAccess, http.StatusServiceUnavailable)
+		return
+	}
+
+	valid, err := s.verify(secret, code)
+	if err != nil {
+		log.Println(err)
+		rejectStepUp(ctx, otpSecretAccess, http.StatusServiceUnavailable)
+		return
+	}
+
+	if !valid {
+		rejectStepUp(ctx, otpInvalid, http.StatusUnauthorized)
+	}
+}
+
+func (s *stepUp) Response(_ filters.FilterContext) {}
@@ -0,0 +1,149 @@
+package skoap
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// the RFC 6238 test secret, "12345678901234567890", base32 encoded
+const testOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTP(t *testing.T) {
+	// the RFC 6238 SHA1 test vectors, truncated to six digits
+	for _, ti := range []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{20000000000, "353130"},
+	} {
+		code, err := totp(testOTPSecret, ti.time/30)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code != ti.code {
+			t.Error("invalid code", ti.time, code)
+		}
+	}
+
+	if _, err := totp("not base32!", 1); err == nil {
+		t.Error("failed to fail on invalid secret")
+	}
+}
+
+func TestStepUpAuth(t *testing.T) {
+	if _, err := NewStepUpAuth(nil).CreateFilter([]interface{}{"foo"}); err == nil {
+		t.Error("failed to fail on invalid args")
+	}
+
+	now := time.Unix(1111111109, 0)
+	for _, ti := range []struct {
+		msg    string
+		user   string
+		code   string
+		secret string
+		err    error
+		status int
+		reason rejectReason
+	}{{
+		msg:    "valid code",
+		user:   testUid,
+		code:   "081804",
+		secret: testOTPSecret,
+	}, {
+		msg:    "previous step",
+		user:   testUid,
+		code:   func() string { c, _ := totp(testOTPSecret, now.Unix()/30-1); return c }(),
+		secret: testOTPSecret,
+	}, {
+		msg:    "invalid code",
+		user:   testUid,
+		code:   "123456",
+		secret: testOTPSecret,
+		status: http.StatusUnauthorized,
+		reason: otpInvalid,
+	}, {
+		msg:    "expired code",
+		user:   testUid,
+		code:   func() string { c, _ := totp(testOTPSecret, now.Unix()/30-2); return c }(),
+		secret: testOTPSecret,
+		status: http.StatusUnauthorized,
+		reason: otpInvalid,
+	}, {
+		msg:    "missing code",
+		user:   testUid,
+		secret: testOTPSecret,
+		status: http.StatusUnauthorized,
+		reason: otpRequired,
+	}, {
+		msg:    "no user",
+		code:   "081804",
+		secret: testOTPSecret,
+		status: http.StatusUnauthorized,
+		reason: missingUser,
+	}, {
+		msg:    "lookup failure",
+		user:   testUid,
+		code:   "081804",
+		err:    errors.New("secret store down"),
+		status: http.StatusServiceUnavailable,
+		reason: otpSecretAccess,
+	}, {
+		msg:    "invalid secret",
+		user:   testUid,
+		code:   "081804",
+		secret: "not base32!",
+		status: http.StatusServiceUnavailable,
+		reason: otpSecretAccess,
+	}} {
+		var lookedUp string
+		s := NewStepUpAuth(func(uid string) (string, error) {
+			lookedUp = uid
+			return ti.secret, ti.err
+		})
+
+		s.(*stepUp).now = func() time.Time { return now }
+		f, err := s.CreateFilter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "https://www.example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ti.code != "" {
+			req.Header.Set(otpHeaderName, ti.code)
+		}
+
+		ctx := newTestContext(req, nil)
+		if ti.user != "" {
+			authorized(ctx, ti.user)
+		}
+
+		f.Request(ctx)
+		if ti.reason == "" {
+			if ctx.FServedWithResponse {
+				t.Error(ti.msg, "failed to allow request", ctx.StateBag()[authRejectReasonKey])
+			}
+
+			if lookedUp != ti.user {
+				t.Error(ti.msg, "invalid user looked up", lookedUp)
+			}
+
+			continue
+		}
+
+		if !ctx.FServedWithResponse ||
+			ctx.FResponse.StatusCode != ti.status ||
+			ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+			t.Error(ti.msg, "failed to reject request", ctx.StateBag()[authRejectReasonKey])
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package skoap
+
+import "time"
+
+const (
+	authDurationKey  = "auth-duration"
+	teamDurationKey  = "team-duration"
+	authForwardedKey = "auth-forwarded"
+)
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// takes the durations of the upstream calls recorded by the auth
+// filters. The service time is measured from when the auth filter let
+// the request through, so it includes the filters after it.
+func (doc *auditDoc) setTimings(sb map[string]interface{}, now time.Time) {
+	if d, ok := sb[authDurationKey].(time.Duration); ok {
+		doc.AuthMs = durationMs(d)
+	}
+
+	if d, ok := sb[teamDurationKey].(time.Duration); ok {
+		doc.TeamMs = durationMs(d)
+	}
+
+	if t, ok := sb[authForwardedKey].(time.Time); ok {
+		doc.ServiceMs = durationMs(now.Sub(t))
+	}
+}
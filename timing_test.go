@@ -0,0 +1,122 @@
+package skoap
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zalando/skipper/eskip"
+	"github.com/zalando/skipper/filters"
+	"github.com/zalando/skipper/proxy/proxytest"
+)
+
+func TestAuditTimings(t *testing.T) {
+	const (
+		authDelay    = 10 * time.Millisecond
+		teamDelay    = 100 * time.Millisecond
+		serviceDelay = 50 * time.Millisecond
+	)
+
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(authDelay)
+		w.Write([]byte(`{"uid": "jdoe", "realm": "/immortals"}`))
+	}))
+	defer authServer.Close()
+
+	teamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(teamDelay)
+		w.Write([]byte(`[{"id": "test-team"}]`))
+	}))
+	defer teamServer.Close()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(serviceDelay)
+	}))
+	defer backend.Close()
+
+	var logged bytes.Buffer
+	al := NewAuditLogWithOptions(AuditLogOptions{Writer: &logged, RecordTimings: true})
+	auth := NewAuthTeam(authServer.URL, teamServer.URL+"/")
+	fr := make(filters.Registry)
+	fr.Register(al)
+	fr.Register(auth)
+
+	r := &eskip.Route{Filters: []*eskip.Filter{
+		{Name: al.Name()},
+		{Name: auth.Name(), Args: []interface{}{testRealm, "test-team"}}},
+		Backend: backend.URL}
+	proxy := proxytest.New(fr, r)
+	defer proxy.Close()
+
+	req, err := http.NewRequest("GET", proxy.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set(authHeaderName, "Bearer "+testToken)
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatal("failed to authorize", rsp.StatusCode)
+	}
+
+	var doc auditDoc
+	if err := json.Unmarshal(logged.Bytes(), &doc); err != nil {
+		t.Fatal(err, logged.String())
+	}
+
+	// only the lower bounds are checked, because the calls can take
+	// longer on a loaded machine
+	if doc.AuthMs < durationMs(authDelay) {
+		t.Error("invalid auth duration", doc.AuthMs)
+	}
+
+	if doc.TeamMs < durationMs(teamDelay) {
+		t.Error("invalid team duration", doc.TeamMs)
+	}
+
+	if doc.ServiceMs < durationMs(serviceDelay) {
+		t.Error("invalid service duration", doc.ServiceMs)
+	}
+
+	// the delays are far enough apart that their order holds under
+	// load, too, and it shows that each duration is recorded in its
+	// own field
+	if doc.AuthMs >= doc.ServiceMs || doc.ServiceMs >= doc.TeamMs {
+		t.Error("invalid breakdown", doc.AuthMs, doc.ServiceMs, doc.TeamMs)
+	}
+}
+
+func TestAuditTimingsRejected(t *testing.T) {
+	authServer := testAuthServer(t, &authDoc{Uid: testUid, Realm: realms{testRealm}})
+	defer authServer.Close()
+
+	ctx := testAuthFilter(t, NewAuth(authServer.URL), []interface{}{testRealm, "write"}, testToken)
+	if !ctx.FServedWithResponse {
+		t.Fatal("failed to reject")
+	}
+
+	var logged bytes.Buffer
+	al, err := NewAuditLogWithOptions(AuditLogOptions{Writer: &logged, RecordTimings: true}).CreateFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	al.Response(ctx)
+
+	var doc auditDoc
+	if err := json.Unmarshal(logged.Bytes(), &doc); err != nil {
+		t.Fatal(err, logged.String())
+	}
+
+	if doc.AuthMs <= 0 || doc.TeamMs != 0 || doc.ServiceMs != 0 {
+		t.Error("invalid timings", logged.String())
+	}
+}
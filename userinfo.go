@@ -0,0 +1,82 @@
+package skoap
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultUserInfoCacheTTL is the default value of
+// Options.UserInfoCacheTTL.
+const DefaultUserInfoCacheTTL = time.Second
+
+type (
+	userInfoClient struct {
+		client   *http.Client
+		url      string
+		cache    *cache
+		slowCall time.Duration
+	}
+
+	// the scope field can be a space separated string, or a list
+	userInfoDoc struct {
+		Scope json.RawMessage `json:"scope"`
+	}
+)
+
+func newUserInfoClient(client *http.Client, o Options) *userInfoClient {
+	ttl := o.UserInfoCacheTTL
+	if ttl <= 0 {
+		ttl = DefaultUserInfoCacheTTL
+	}
+
+	return &userInfoClient{
+		client:   client,
+		url:      o.UserInfoUrl,
+		cache:    newCache(ttl, o.Now),
+		slowCall: o.SlowCallThreshold}
+}
+
+func (d *userInfoDoc) scopes() ([]string, error) {
+	if len(d.Scope) == 0 || string(d.Scope) == "null" {
+		return []string{}, nil
+	}
+
+	var single string
+	if err := json.Unmarshal(d.Scope, &single); err == nil {
+		return append([]string{}, strings.Fields(single)...), nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(d.Scope, &multiple); err != nil {
+		return nil, errMalformedResponse
+	}
+
+	return multiple, nil
+}
+
+// fetches the scopes of the token from the userinfo endpoint. They are
+// cached by the token.
+func (uc *userInfoClient) getScopes(token string) ([]string, error) {
+	key := tokenHash(token)
+	if scopes, ok := uc.cache.get(key); ok {
+		return scopes.([]string), nil
+	}
+
+	var d userInfoDoc
+	start := time.Now()
+	_, err := jsonGet(uc.client, uc.url, token, &d, false, 0)
+	logSlowCall(uc.slowCall, uc.url, start)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes, err := d.scopes()
+	if err != nil {
+		return nil, err
+	}
+
+	uc.cache.set(key, scopes)
+	return scopes, nil
+}
@@ -0,0 +1,113 @@
+package skoap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUserInfoScopes(t *testing.T) {
+	for _, ti := range []struct {
+		msg           string
+		introspection string
+		userInfo      string
+		userInfoFails bool
+		args          []interface{}
+		reason        rejectReason
+		userInfoCalls int
+	}{{
+		msg:           "scopes from userinfo, string",
+		introspection: `{"active": true, "sub": "jdoe"}`,
+		userInfo:      `{"sub": "jdoe", "scope": "read write"}`,
+		args:          []interface{}{"", "write"},
+		userInfoCalls: 1,
+	}, {
+		msg:           "scopes from userinfo, list",
+		introspection: `{"active": true, "sub": "jdoe", "scope": ""}`,
+		userInfo:      `{"sub": "jdoe", "scope": ["read", "write"]}`,
+		args:          []interface{}{"", "write"},
+		userInfoCalls: 1,
+	}, {
+		msg:           "missing scope",
+		introspection: `{"active": true, "sub": "jdoe"}`,
+		userInfo:      `{"sub": "jdoe", "scope": "read"}`,
+		args:          []interface{}{"", "write"},
+		reason:        invalidScope,
+		userInfoCalls: 1,
+	}, {
+		msg:           "no scopes in userinfo",
+		introspection: `{"active": true, "sub": "jdoe"}`,
+		userInfo:      `{"sub": "jdoe"}`,
+		args:          []interface{}{"", "write"},
+		reason:        invalidScope,
+		userInfoCalls: 1,
+	}, {
+		msg:           "scopes from introspection",
+		introspection: `{"active": true, "sub": "jdoe", "scope": "write"}`,
+		args:          []interface{}{"", "write"},
+	}, {
+		msg:           "userinfo rejects the token",
+		introspection: `{"active": true, "sub": "jdoe"}`,
+		userInfoFails: true,
+		args:          []interface{}{"", "write"},
+		reason:        invalidToken,
+		userInfoCalls: 1,
+	}, {
+		msg:           "malformed userinfo",
+		introspection: `{"active": true, "sub": "jdoe"}`,
+		userInfo:      `{"scope": 42}`,
+		args:          []interface{}{"", "write"},
+		reason:        authServiceFormat,
+		userInfoCalls: 1,
+	}} {
+		introspectionServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(ti.introspection))
+		}))
+
+		var userInfoCalls int
+		userInfoServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userInfoCalls++
+			if token, err := getToken(r); err != nil || token != testToken || ti.userInfoFails {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			w.Write([]byte(ti.userInfo))
+		}))
+
+		s := NewAuthWithOptions(Options{
+			AuthUrlBase:   introspectionServer.URL,
+			Introspection: true,
+			UserInfoUrl:   userInfoServer.URL})
+
+		// the second request is served from the cache
+		for i := 0; i < 2; i++ {
+			ctx := testAuthFilter(t, s, ti.args, testToken)
+			if ti.reason == "" {
+				if ctx.FServedWithResponse {
+					t.Error(ti.msg, "failed to authorize", ctx.StateBag()[authRejectReasonKey])
+				}
+			} else if !ctx.FServedWithResponse || ctx.StateBag()[authRejectReasonKey] != string(ti.reason) {
+				t.Error(ti.msg, "failed to reject", ctx.StateBag()[authRejectReasonKey])
+			}
+		}
+
+		introspectionServer.Close()
+		userInfoServer.Close()
+
+		expectedCalls := ti.userInfoCalls
+		if ti.userInfoFails || ti.reason == authServiceFormat {
+			// the failures are not cached
+			expectedCalls *= 2
+		}
+
+		if userInfoCalls != expectedCalls {
+			t.Error(ti.msg, "invalid number of userinfo calls", userInfoCalls)
+		}
+
+		if ti.userInfoCalls > 0 && !ti.userInfoFails && ti.reason != authServiceFormat &&
+			s.Stats().UserInfo.Hits != 1 {
+			t.Error(ti.msg, "invalid userinfo cache stats", s.Stats().UserInfo)
+		}
+	}
+}